@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// adminServer serves the operational endpoints of the db service under
+// /admin/ and the metrics on /metrics, on their own listener or,
+// optionally, on the data port.
+type adminServer struct {
+	db      *datastore.Db
+	dir     string
+	flags   *flag.FlagSet
+	metrics *metrics
+	started time.Time
+
+	// ready is set once the listeners are up and cleared when the service
+	// starts shutting down.
+	ready atomic.Bool
+	// readyCheck, if set, tells why the service cannot serve yet, e.g. a
+	// cluster node without a leader.
+	readyCheck func() error
+}
+
+func newAdminServer(db *datastore.Db, dir string, flags *flag.FlagSet, m *metrics) *adminServer {
+	return &adminServer{db: db, dir: dir, flags: flags, metrics: m, started: time.Now()}
+}
+
+func (a *adminServer) handler() http.Handler {
+	h := http.NewServeMux()
+	h.HandleFunc("/admin/health", a.serveHealth)
+	h.HandleFunc("/admin/ready", a.serveReady)
+	h.HandleFunc("/admin/stats", a.serveStats)
+	h.HandleFunc("/admin/compact", a.serveCompact)
+	h.HandleFunc("/admin/segments", a.serveSegments)
+	h.HandleFunc("/admin/config", a.serveConfig)
+	h.HandleFunc("/metrics", a.metrics.handler(a.db))
+	return h
+}
+
+// serveHealth checks the datastore answers and its directory is writable on
+// GET /admin/health. It responds with 503 if a check fails.
+func (a *adminServer) serveHealth(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	checks := map[string]string{"store": "ok", "disk": "ok"}
+	status, healthy := http.StatusOK, "ok"
+	if _, err := a.db.GetContext(req.Context(), "health"); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		checks["store"], status, healthy = err.Error(), http.StatusServiceUnavailable, "failing"
+	}
+	if err := checkWritable(a.dir); err != nil {
+		checks["disk"], status, healthy = err.Error(), http.StatusServiceUnavailable, "failing"
+	}
+	writeJSON(res, status, map[string]any{"status": healthy, "checks": checks})
+}
+
+// checkWritable writes and syncs a file in the directory.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ok"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// serveReady responds with 200 on GET /admin/ready while the service takes
+// the requests and with 503 while it starts, shuts down or, in the cluster
+// mode, has no leader.
+func (a *adminServer) serveReady(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.ready.Load() {
+		writeJSON(res, http.StatusServiceUnavailable, map[string]any{"ready": false, "reason": "not serving"})
+		return
+	}
+	if a.readyCheck != nil {
+		if err := a.readyCheck(); err != nil {
+			writeJSON(res, http.StatusServiceUnavailable, map[string]any{"ready": false, "reason": err.Error()})
+			return
+		}
+	}
+	writeJSON(res, http.StatusOK, map[string]any{"ready": true})
+}
+
+// adminStats is the response of GET /admin/stats.
+type adminStats struct {
+	Store         datastore.Stats `json:"store"`
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	Goroutines    int             `json:"goroutines"`
+	HeapBytes     uint64          `json:"heap_bytes"`
+}
+
+func (a *adminServer) serveStats(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	writeJSON(res, http.StatusOK, adminStats{
+		Store:         a.db.Stats(),
+		UptimeSeconds: int64(time.Since(a.started).Seconds()),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapBytes:     memory.HeapAlloc,
+	})
+}
+
+// compactResult is the response of POST /admin/compact.
+type compactResult struct {
+	SegmentsBefore int   `json:"segments_before"`
+	SegmentsAfter  int   `json:"segments_after"`
+	BytesBefore    int64 `json:"bytes_before"`
+	BytesAfter     int64 `json:"bytes_after"`
+	DurationMillis int64 `json:"duration_ms"`
+}
+
+// serveCompact merges all the segments into one on POST /admin/compact and
+// responds when it is done.
+func (a *adminServer) serveCompact(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	before, start := a.db.Stats(), time.Now()
+	if err := a.db.Compact(); err != nil {
+		if errors.Is(err, datastore.ErrReadOnly) {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+		writeStoreError(res, err, "Failed to compact the datastore")
+		return
+	}
+	after := a.db.Stats()
+	writeJSON(res, http.StatusOK, compactResult{
+		SegmentsBefore: before.Segments,
+		SegmentsAfter:  after.Segments,
+		BytesBefore:    before.Bytes,
+		BytesAfter:     after.Bytes,
+		DurationMillis: time.Since(start).Milliseconds(),
+	})
+}
+
+func (a *adminServer) serveSegments(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(res, http.StatusOK, a.db.Segments())
+}
+
+// serveConfig lists the values of the flags and the data directory on GET
+// /admin/config. The values of the token flags are masked.
+func (a *adminServer) serveConfig(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config := map[string]string{"data_dir": a.dir}
+	a.flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if strings.Contains(f.Name, "token") && value != "" {
+			value = "***"
+		}
+		config[f.Name] = value
+	})
+	writeJSON(res, http.StatusOK, config)
+}
+
+// errNoLeader is the readiness failure of a cluster node without a leader.
+var errNoLeader = errors.New("no leader is elected")
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestAdminServer(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		db.Put("key", strings.Repeat("v", i))
+	}
+	flags := flag.NewFlagSet("db", flag.ContinueOnError)
+	flags.Int("port", 8083, "")
+	flags.String("leader-token", "secret", "")
+	admin := newAdminServer(db, dir, flags, newMetrics())
+	h := admin.handler()
+
+	if rec := doRequest(h, "GET", "/admin/health", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"ok"`) {
+		t.Errorf("Unexpected health %d %s", rec.Code, rec.Body.String())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".health-*")); len(files) != 0 {
+		t.Errorf("Expected the health check files removed, got %v", files)
+	}
+
+	if rec := doRequest(h, "GET", "/admin/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the start, got %d", rec.Code)
+	}
+	admin.ready.Store(true)
+	if rec := doRequest(h, "GET", "/admin/ready", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 when ready, got %d", rec.Code)
+	}
+	admin.readyCheck = func() error { return errNoLeader }
+	if rec := doRequest(h, "GET", "/admin/ready", ""); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "no leader") {
+		t.Errorf("Expected 503 without a leader, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var segments []datastore.SegmentInfo
+	rec := doRequest(h, "GET", "/admin/segments", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &segments); err != nil || len(segments) < 2 || segments[0].Size == 0 {
+		t.Errorf("Unexpected segments %s, %v", rec.Body.String(), err)
+	}
+
+	var compacted compactResult
+	rec = doRequest(h, "POST", "/admin/compact", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &compacted); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected compaction %d %s", rec.Code, rec.Body.String())
+	}
+	if compacted.SegmentsBefore != len(segments) || compacted.BytesAfter >= compacted.BytesBefore {
+		t.Errorf("Unexpected compaction result %+v", compacted)
+	}
+	if value, _ := db.Get("key"); value != strings.Repeat("v", 19) {
+		t.Errorf("Unexpected value after the compaction %q", value)
+	}
+	if rec := doRequest(h, "GET", "/admin/compact", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+
+	var stats adminStats
+	rec = doRequest(h, "GET", "/admin/stats", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.Store.Keys != 1 || stats.Goroutines == 0 {
+		t.Errorf("Unexpected stats %s, %v", rec.Body.String(), err)
+	}
+
+	var config map[string]string
+	rec = doRequest(h, "GET", "/admin/config", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["port"] != "8083" || config["leader-token"] != "***" || config["data_dir"] != dir {
+		t.Errorf("Unexpected config %v", config)
+	}
+
+	os.Chmod(dir, 0o500)
+	defer os.Chmod(dir, 0o700)
+	if f, err := os.CreateTemp(dir, "probe"); err == nil {
+		// Permissions do not stop root.
+		f.Close()
+		os.Remove(f.Name())
+	} else if rec := doRequest(h, "GET", "/admin/health", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a read-only directory, got %d", rec.Code)
+	}
+	os.Chmod(dir, 0o700)
+
+	db.Close()
+	rec = doRequest(h, "GET", "/admin/health", "")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), datastore.ErrClosed.Error()) {
+		t.Errorf("Expected 503 from a closed store, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "POST", "/admin/compact", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 compacting a closed store, got %d", rec.Code)
+	}
+}
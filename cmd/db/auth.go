@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Token scopes. A read token gets the keys, a write token changes them and
+// an admin token may do anything, including what read and write allow.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// token is an entry of the tokens file. A token with prefixes reaches only
+// the keys starting with one of them, in every bucket.
+type token struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token"`
+	Scopes   []string `json:"scopes"`
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	hash [sha256.Size]byte
+}
+
+func (t *token) has(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the token reaches the key.
+func (t *token) allows(key string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range t.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTokens reads the tokens file, a JSON array of the tokens:
+//
+//	[{"name":"server","token":"…","scopes":["read","write"],"prefixes":["users/"]}]
+func loadTokens(path string) ([]*token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %w", path, err)
+	}
+	names := make(map[string]bool, len(tokens))
+	secrets := make(map[string]bool, len(tokens))
+	for i, t := range tokens {
+		switch {
+		case t.Name == "" || names[t.Name]:
+			return nil, fmt.Errorf("token %d has an empty or repeated name", i)
+		case t.Token == "" || secrets[t.Token]:
+			return nil, fmt.Errorf("token %s is empty or repeated", t.Name)
+		case len(t.Scopes) == 0:
+			return nil, fmt.Errorf("token %s has no scopes", t.Name)
+		}
+		for _, scope := range t.Scopes {
+			if scope != scopeRead && scope != scopeWrite && scope != scopeAdmin {
+				return nil, fmt.Errorf("token %s has an unknown scope %q", t.Name, scope)
+			}
+		}
+		for _, prefix := range t.Prefixes {
+			if prefix == "" {
+				return nil, fmt.Errorf("token %s has an empty prefix", t.Name)
+			}
+		}
+		names[t.Name], secrets[t.Token] = true, true
+		t.hash = sha256.Sum256([]byte(t.Token))
+	}
+	return tokens, nil
+}
+
+type tokenKey struct{}
+
+// allowedKey reports whether the token of the request reaches the key. All
+// the keys are allowed when the authentication is off.
+func allowedKey(req *http.Request, key string) bool {
+	t, ok := req.Context().Value(tokenKey{}).(*token)
+	return !ok || t.allows(key)
+}
+
+// auditDenied logs a denied request. The secret of the token is never
+// logged, only its name.
+func auditDenied(req *http.Request, status int, reason string) {
+	name := "-"
+	if t, ok := req.Context().Value(tokenKey{}).(*token); ok {
+		name = t.Name
+	}
+	log.Printf("audit: denied %s %s from %s, token %s: %d %s", req.Method, req.URL.RequestURI(), req.RemoteAddr, name, status, reason)
+}
+
+// newAuthHandler lets through the requests with the bearer tokens allowing
+// them. It responds with 401 to the requests without a known token and with
+// 403 to the ones the token does not allow. The handlers of the requests
+// naming several keys in their bodies check them with allowedKey.
+func newAuthHandler(tokens []*token, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		t := findToken(tokens, req)
+		if t == nil {
+			auditDenied(req, http.StatusUnauthorized, "missing or unknown token")
+			res.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), tokenKey{}, t))
+		if err := authorize(t, req); err != nil {
+			auditDenied(req, http.StatusForbidden, err.Error())
+			http.Error(res, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(res, req)
+	})
+}
+
+// findToken compares the bearer token of the request with every known one
+// in constant time, so that the time of the response does not tell how
+// much of a token matches.
+func findToken(tokens []*token, req *http.Request) *token {
+	secret, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	var found *token
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+var (
+	errNoScope  = errors.New("token lacks the scope")
+	errNoPrefix = errors.New("token does not reach the keys")
+)
+
+// authorize checks the token has the scope of the request and reaches its
+// key. The export and the import read and write any key, so they need a
+// token without prefixes.
+func authorize(t *token, req *http.Request) error {
+	read := req.Method == "GET" || req.Method == "HEAD"
+	scope := scopeWrite
+	if read {
+		scope = scopeRead
+	}
+	var unrestricted bool
+	switch path := req.URL.Path; {
+	case path == "/db":
+		if !t.allows(req.URL.Query().Get("prefix")) {
+			return fmt.Errorf("%w with the prefix %q", errNoPrefix, req.URL.Query().Get("prefix"))
+		}
+	case path == "/db/_mget":
+		scope = scopeRead
+	case path == "/db/_mset", path == "/db/_batch":
+	case path == "/db/_export", path == "/db/_import":
+		unrestricted = true
+	case path == "/db/_stats":
+		scope = scopeRead
+	case path == "/db/_buckets", strings.HasPrefix(path, "/db/_buckets/"):
+		if !read {
+			scope = scopeAdmin
+		}
+	case path == "/db/_replication", path == "/db/_replication/snapshot", path == "/db/_promote":
+		scope = scopeAdmin
+	case strings.HasPrefix(path, "/db/"):
+		// An invalid key path is left to the handler to reject.
+		if key, err := requestKey(req); err == nil && !t.allows(key.key) {
+			return fmt.Errorf("%w %q", errNoPrefix, key.key)
+		}
+	default:
+		scope = scopeAdmin
+	}
+	if !t.has(scope) {
+		return fmt.Errorf("%w %s", errNoScope, scope)
+	}
+	if unrestricted && len(t.Prefixes) > 0 {
+		return fmt.Errorf("%w: all the keys are needed", errNoPrefix)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+)
+
+func writeTokens(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthHandler(t *testing.T) {
+	tokens, err := loadTokens(writeTokens(t, `[
+		{"name":"reader","token":"read-secret","scopes":["read"]},
+		{"name":"users","token":"users-secret","scopes":["read","write"],"prefixes":["users/"]},
+		{"name":"admin","token":"admin-secret","scopes":["admin"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := datastore.NewMemoryStore()
+	store.Put("users/1", "v1")
+	h := newAuthHandler(tokens, newHandler(store))
+
+	var audit bytes.Buffer
+	log.SetOutput(&audit)
+	defer log.SetOutput(os.Stderr)
+
+	request := func(secret, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("", "GET", "/db/users%2F1", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with a challenge without a token, got %d", rec.Code)
+	}
+	if rec := request("wrong-secret", "GET", "/db/users%2F1", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", rec.Code)
+	}
+
+	for _, c := range []struct {
+		secret, method, target, body string
+		status                       int
+	}{
+		{"read-secret", "GET", "/db/users%2F1", "", http.StatusOK},
+		{"read-secret", "GET", "/db", "", http.StatusOK},
+		{"read-secret", "POST", "/db/users%2F1", `{"value":"v2"}`, http.StatusForbidden},
+		{"read-secret", "GET", "/db/_export", "", http.StatusOK},
+		{"read-secret", "GET", "/db/_replication", "", http.StatusForbidden},
+		{"users-secret", "POST", "/db/users%2F2", `{"value":"v2"}`, http.StatusCreated},
+		{"users-secret", "POST", "/db/other", `{"value":"v2"}`, http.StatusForbidden},
+		{"users-secret", "GET", "/db?prefix=users/", "", http.StatusOK},
+		{"users-secret", "GET", "/db", "", http.StatusForbidden},
+		{"users-secret", "GET", "/db/_export", "", http.StatusForbidden},
+		{"users-secret", "POST", "/db/_mget", `{"keys":["users/1","other"]}`, http.StatusForbidden},
+		{"users-secret", "POST", "/db/_mget", `{"keys":["users/1"]}`, http.StatusOK},
+		{"users-secret", "PUT", "/db/_buckets/team", `{}`, http.StatusForbidden},
+		{"admin-secret", "POST", "/db/other", `{"value":"v2"}`, http.StatusCreated},
+		{"admin-secret", "GET", "/db/_export", "", http.StatusOK},
+	} {
+		if rec := request(c.secret, c.method, c.target, c.body); rec.Code != c.status {
+			t.Errorf("Expected %d for %s %s with %s, got %d %s", c.status, c.method, c.target, c.secret, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec = request("users-secret", "POST", "/db/_mset", `[{"key":"users/3","value":"v3"},{"key":"other","value":"v3"}]`)
+	want := `{"results":[{"key":"users/3","status":201},{"key":"other","status":403,"error":"token does not reach the key"}]}`
+	if rec.Body.String() != want {
+		t.Errorf("Unexpected multi-put response %s", rec.Body.String())
+	}
+	rec = request("users-secret", "POST", "/db/_batch", `[{"op":"delete","key":"other"},{"op":"delete","key":"users/3"}]`)
+	want = `{"results":[{"status":403,"error":"token does not reach the key"},{"status":200}]}`
+	if rec.Body.String() != want {
+		t.Errorf("Unexpected batch response %s", rec.Body.String())
+	}
+	if value, _ := store.Get("other"); value != "v2" {
+		t.Errorf("Expected the denied key unchanged, got %q", value)
+	}
+
+	logged := audit.String()
+	if n := strings.Count(logged, "audit: denied"); n != 11 {
+		t.Errorf("Expected 11 audit lines, got %d:\n%s", n, logged)
+	}
+	if !strings.Contains(logged, "token users") || strings.Contains(logged, "secret") {
+		t.Errorf("Expected the token names and no secrets logged:\n%s", logged)
+	}
+}
+
+func TestAuthHandler_Client(t *testing.T) {
+	tokens, err := loadTokens(writeTokens(t, `[{"name":"reader","token":"read-secret","scopes":["read"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	server := httptest.NewServer(newAuthHandler(tokens, newHandler(datastore.NewMemoryStore())))
+	defer server.Close()
+	ctx := context.Background()
+
+	if _, err := dbclient.NewHTTP(server.URL).Get(ctx, "key"); !errors.Is(err, dbclient.ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized without a token, got %v", err)
+	}
+	c := dbclient.NewHTTP(server.URL, dbclient.WithToken("read-secret"))
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound with the token, got %v", err)
+	}
+	if err := c.Put(ctx, "key", "value"); !errors.Is(err, dbclient.ErrForbidden) {
+		t.Errorf("Expected ErrForbidden for a write, got %v", err)
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	for _, content := range []string{
+		`{}`,
+		`[{"name":"a","token":"s","scopes":["delete"]}]`,
+		`[{"name":"a","token":"s","scopes":[]}]`,
+		`[{"name":"a","token":"","scopes":["read"]}]`,
+		`[{"name":"a","token":"s","scopes":["read"]},{"name":"b","token":"s","scopes":["read"]}]`,
+		`[{"name":"a","token":"s","scopes":["read"]},{"name":"a","token":"t","scopes":["read"]}]`,
+		`[{"name":"a","token":"s","scopes":["read"],"prefixes":[""]}]`,
+	} {
+		if _, err := loadTokens(writeTokens(t, content)); err == nil {
+			t.Errorf("Expected an error for %s", content)
+		}
+	}
+	if _, err := loadTokens(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// maxBatchOperations limits the operations of a batch.
+const maxBatchOperations = 1000
+
+// batchOperation is an operation of POST /db/_batch, op is put or delete.
+type batchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// batchResult is the outcome of an operation, status is the status of the
+// response to the same request on /db/<key>.
+type batchResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchHandler runs a JSON array of the put and delete operations on the
+// keys of the default bucket, or of the one named by the bucket parameter,
+// on POST /db/_batch. The operations run in order and each of them succeeds
+// or fails on its own, the response lists their results in the same order.
+// The operations on the keys the token of the request does not reach fail
+// with 403.
+func batchHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, ok := readBody(res, req, maxMultiRequestSize)
+		if !ok {
+			return
+		}
+		var operations []batchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if len(operations) > maxBatchOperations {
+			http.Error(res, fmt.Sprintf("Batch has over %d operations", maxBatchOperations), http.StatusRequestEntityTooLarge)
+			return
+		}
+		for i, op := range operations {
+			if op.Op != "put" && op.Op != "delete" {
+				http.Error(res, fmt.Sprintf("Unknown operation %q at %d", op.Op, i), http.StatusBadRequest)
+				return
+			}
+		}
+		store, err := requestBucket(defaultStore, req)
+		if err != nil {
+			writeStoreError(res, err, err.Error())
+			return
+		}
+
+		results := make([]batchResult, len(operations))
+		for i, op := range operations {
+			result := &results[i]
+			if !allowedKey(req, op.Key) {
+				result.Status, result.Error = http.StatusForbidden, "token does not reach the key"
+				auditDenied(req, result.Status, fmt.Sprintf("token does not reach %q", op.Key))
+				continue
+			}
+			if op.Op == "put" {
+				result.Status = http.StatusCreated
+				err = store.PutContext(req.Context(), op.Key, op.Value)
+			} else {
+				result.Status = http.StatusOK
+				err = store.DeleteContext(req.Context(), op.Key)
+			}
+			if errors.Is(err, datastore.ErrNotFound) {
+				result.Status, result.Error = http.StatusNotFound, err.Error()
+			} else if err != nil {
+				result.Status, result.Error = storeError(err, "Failed to store the data")
+			}
+		}
+		writeJSON(res, http.StatusOK, map[string][]batchResult{"results": results})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_Batch(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	store.Put("old", "value")
+	h := newHandler(store)
+
+	rec := doRequest(h, "POST", "/db/_batch", `[
+		{"op":"put","key":"new","value":"v1"},
+		{"op":"delete","key":"old"},
+		{"op":"delete","key":"missing"},
+		{"op":"put","key":"","value":"v2"}
+	]`)
+	want := `{"results":[{"status":201},{"status":200},{"status":404,"error":"record does not exist"},{"status":400,"error":"invalid key"}]}`
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("Unexpected batch response %d %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := store.Get("new"); value != "v1" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+	if _, err := store.Get("old"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the old key deleted, got %v", err)
+	}
+
+	if rec := doRequest(h, "POST", "/db/_batch", `[{"op":"merge","key":"k"}]`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown operation, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_batch", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+	large := "["
+	for i := 0; i <= maxBatchOperations; i++ {
+		large += fmt.Sprintf(`{"op":"put","key":"k%d","value":"v"},`, i)
+	}
+	large = large[:len(large)-1] + "]"
+	if rec := doRequest(h, "POST", "/db/_batch", large); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large batch, got %d", rec.Code)
+	}
+	huge := fmt.Sprintf(`[{"op":"put","key":"k","value":"%s"}]`, strings.Repeat("v", maxMultiRequestSize))
+	if rec := doRequest(h, "POST", "/db/_batch", huge); rec.Code != http.StatusRequestEntityTooLarge || !strings.HasPrefix(rec.Body.String(), "Request is over") {
+		t.Errorf("Expected 413 for a body over the limit, got %d %s", rec.Code, rec.Body.String())
+	}
+}
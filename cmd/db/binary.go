@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/dbproto"
+)
+
+// maxInFlight limits the requests of a connection served at once, the next
+// requests are read once one of them is done.
+const maxInFlight = 128
+
+// binaryServer serves the dbproto requests. The requests of a connection
+// are served concurrently and answered as they are done.
+type binaryServer struct {
+	tcp   tcpServer
+	store datastore.Store
+}
+
+func newBinaryServer(store datastore.Store) *binaryServer {
+	return &binaryServer{store: store}
+}
+
+// Serve accepts the connections until the server is closed.
+func (s *binaryServer) Serve(l net.Listener) error {
+	return s.tcp.serve(l, s.serveConn)
+}
+
+// Close stops accepting the connections, closes the open ones and waits
+// for their requests to finish.
+func (s *binaryServer) Close() error {
+	return s.tcp.close()
+}
+
+// frameWriter serializes the responses written by the requests of
+// a connection.
+type frameWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+func (w *frameWriter) write(resp dbproto.Response) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if w.err = dbproto.WriteResponse(w.w, resp); w.err == nil {
+		w.err = w.w.Flush()
+	}
+}
+
+func (s *binaryServer) serveConn(conn net.Conn) {
+	var requests sync.WaitGroup
+	defer requests.Wait()
+	// The requests in flight are cancelled once the connection is gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := bufio.NewReader(conn)
+	w := &frameWriter{w: bufio.NewWriter(conn)}
+	inFlight := make(chan struct{}, maxInFlight)
+	for {
+		req, err := dbproto.ReadRequest(r)
+		if err != nil {
+			if errors.Is(err, dbproto.ErrMalformed) || errors.Is(err, dbproto.ErrFrameTooLarge) {
+				w.write(dbproto.Response{ID: req.ID, Status: dbproto.StatusInvalid, Value: err.Error()})
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Binary connection from %s failed: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		inFlight <- struct{}{}
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			w.write(s.handle(ctx, req))
+			<-inFlight
+		}()
+	}
+}
+
+// handle runs the request against the store.
+func (s *binaryServer) handle(ctx context.Context, req dbproto.Request) dbproto.Response {
+	resp := dbproto.Response{ID: req.ID}
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	store := s.store
+	var err error
+	if req.Bucket != "" {
+		store, err = findBucket(s.store, req.Bucket)
+	}
+	if err == nil {
+		switch req.Op {
+		case dbproto.OpPing:
+		case dbproto.OpGet:
+			resp.Value, err = store.GetContext(ctx, req.Key)
+		case dbproto.OpPut:
+			err = store.PutContext(ctx, req.Key, req.Value)
+		case dbproto.OpDelete:
+			err = store.DeleteContext(ctx, req.Key)
+		default:
+			err = fmt.Errorf("unknown operation %s", req.Op)
+			resp.Status = dbproto.StatusInvalid
+		}
+	}
+	if err != nil {
+		if resp.Status == dbproto.StatusOK {
+			resp.Status = binaryStatus(err)
+		}
+		resp.Value = err.Error()
+	}
+	return resp
+}
+
+// binaryStatus maps the store errors to the response statuses the way
+// writeStoreError maps them to the HTTP ones.
+func binaryStatus(err error) dbproto.Status {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return dbproto.StatusNotFound
+	case errors.Is(err, datastore.ErrBucketNotFound), errors.Is(err, datastore.ErrInvalidBucket),
+		errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrKeyTooLarge),
+		errors.Is(err, datastore.ErrValueTooLarge):
+		return dbproto.StatusInvalid
+	case errors.Is(err, datastore.ErrNotLeader):
+		return dbproto.StatusNotLeader
+	case errors.Is(err, datastore.ErrClosed), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled):
+		return dbproto.StatusUnavailable
+	}
+	return dbproto.StatusError
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+	"github.com/roman-mazur/architecture-practice-4-template/dbproto"
+)
+
+func startBinary(t *testing.T, store datastore.Store) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newBinaryServer(store)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+func TestBinaryServer(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.CreateBucket("team", 0); err != nil {
+		t.Fatal(err)
+	}
+	c := dbclient.New(startBinary(t, db), dbclient.WithPoolSize(2))
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("key"); value != "value" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+	if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if err := c.Bucket("team").Put(ctx, "key", "team value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Bucket("team").Get(ctx, "key"); err != nil || value != "team value" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if _, err := c.Bucket("missing").Get(ctx, "key"); !errors.Is(err, dbclient.ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for a missing bucket, got %v", err)
+	}
+	if err := c.Put(ctx, "", "value"); !errors.Is(err, dbclient.ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for an empty key, got %v", err)
+	}
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "key"); err != dbclient.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// The requests in flight on the pooled connections.
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i%20)
+			if err := c.Put(ctx, key, key); err != nil {
+				t.Error(err)
+				return
+			}
+			if value, err := c.Get(ctx, key); err != nil || value != key {
+				t.Errorf("Unexpected value %q of %s, %v", value, key, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBinaryServer_Timeout(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024, datastore.WithConsensus(blockedLog{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := dbclient.New(startBinary(t, db), dbclient.WithTimeout(50*time.Millisecond), dbclient.WithRetries(0, 0))
+	defer c.Close()
+	if err := c.Put(context.Background(), "key", "value"); !errors.Is(err, dbclient.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable after the timeout, got %v", err)
+	}
+}
+
+// blockedLog never commits the writes.
+type blockedLog struct{}
+
+func (blockedLog) Replicate(ctx context.Context, _ ...[]byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBinaryServer_Malformed(t *testing.T) {
+	conn, err := net.Dial("tcp", startBinary(t, datastore.NewMemoryStore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0, 0, 0, 1, 0})
+	r := bufio.NewReader(conn)
+	resp, err := dbproto.ReadResponse(r)
+	if err != nil || resp.Status != dbproto.StatusInvalid {
+		t.Errorf("Expected an invalid status, got %+v, %v", resp, err)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Expected the connection closed after a malformed frame")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// bucketStore is implemented by the stores with named buckets, see datastore.Db.
+type bucketStore interface {
+	Bucket(name string) (*datastore.Bucket, error)
+	CreateBucket(name string, quota int64) (*datastore.Bucket, error)
+	SetQuota(name string, quota int64) error
+	Buckets() []datastore.BucketInfo
+}
+
+// maxBucketOptionsSize limits the body of PUT /db/_buckets/<name>.
+const maxBucketOptionsSize = 4 << 10
+
+var errNoBuckets = fmt.Errorf("%w: buckets are not supported by the store", datastore.ErrBucketNotFound)
+
+func findBucket(store datastore.Store, name string) (datastore.Store, error) {
+	buckets, ok := store.(bucketStore)
+	if !ok {
+		return nil, errNoBuckets
+	}
+	return buckets.Bucket(name)
+}
+
+// requestBucket selects the bucket named by the bucket query parameter, the
+// default one if there is none.
+func requestBucket(store datastore.Store, req *http.Request) (datastore.Store, error) {
+	if name := req.URL.Query().Get("bucket"); name != "" {
+		return findBucket(store, name)
+	}
+	return store, nil
+}
+
+// bucketsHandler lists the buckets on GET /db/_buckets, describes one on
+// GET /db/_buckets/<name> and creates one or updates its quota on
+// PUT /db/_buckets/<name> with an optional {"quota": <bytes>} body.
+func bucketsHandler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		buckets, ok := store.(bucketStore)
+		if !ok {
+			http.Error(res, errNoBuckets.Error(), http.StatusNotFound)
+			return
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/db/_buckets"), "/")
+
+		switch {
+		case req.Method == "GET" && name == "":
+			writeJSON(res, http.StatusOK, buckets.Buckets())
+
+		case req.Method == "GET":
+			bucket, err := buckets.Bucket(name)
+			if err != nil {
+				writeStoreError(res, err, err.Error())
+				return
+			}
+			writeJSON(res, http.StatusOK, bucket.Info())
+
+		case req.Method == "PUT" && name != "":
+			var options struct {
+				Quota int64 `json:"quota"`
+			}
+			body, ok := readBody(res, req, maxBucketOptionsSize)
+			if !ok {
+				return
+			}
+			if len(body) > 0 {
+				if err := json.Unmarshal(body, &options); err != nil || options.Quota < 0 {
+					http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+					return
+				}
+			}
+			status := http.StatusCreated
+			bucket, err := buckets.CreateBucket(name, options.Quota)
+			if errors.Is(err, datastore.ErrBucketExists) {
+				status = http.StatusOK
+				if err = buckets.SetQuota(name, options.Quota); err == nil {
+					bucket, err = buckets.Bucket(name)
+				}
+			}
+			if err != nil {
+				writeStoreError(res, err, "Failed to create the bucket")
+				return
+			}
+			writeJSON(res, status, bucket.Info())
+
+		default:
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, value any) {
+	response, _ := json.Marshal(value)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(response)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestBucketsHandler(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newHandler(db)
+
+	if rec := doRequest(h, "POST", "/db/team/key", `{"value":"v1"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing bucket, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PUT", "/db/_buckets/team", `{"quota":100}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on bucket creation, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "PUT", "/db/_buckets/team", `{"quota":60}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on a quota update, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PUT", "/db/_buckets/big", `{"quota":1`+strings.Repeat(" ", maxBucketOptionsSize)+`}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for bucket options over the limit, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PUT", "/db/_buckets/_team", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid bucket name, got %d", rec.Code)
+	}
+
+	if rec := doRequest(h, "POST", "/db/team/key", `{"value":"team"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on put into a bucket, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/key", `{"value":"default"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on put into the default bucket, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/team/key", ""); rec.Body.String() != `{"key":"key","value":"team"}` {
+		t.Errorf("Unexpected response from the bucket %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db/default/key", ""); rec.Body.String() != `{"key":"key","value":"default"}` {
+		t.Errorf("Unexpected response from the default bucket %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "POST", "/db/team/large", `{"value":"`+strings.Repeat("v", 50)+`"}`); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 over the quota, got %d", rec.Code)
+	}
+
+	rec := doRequest(h, "GET", "/db/_buckets", "")
+	expected := `[{"name":"default","keys":1,"bytes":55},{"name":"team","quota":60,"keys":1,"bytes":52}]`
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Unexpected bucket list %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db/_buckets/missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing bucket, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/a/b/c", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a nested path, got %d", rec.Code)
+	}
+
+	if rec := doRequest(h, "GET", "/db/_export?bucket=team", ""); rec.Body.String() != `{"key":"key","value":"team","version":1}`+"\n" {
+		t.Errorf("Unexpected bucket export %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "PUT", "/db/_buckets/team", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on a quota removal, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_import?bucket=team", `{"key":"imported","value":"1"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on a bucket import, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db/team/imported", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the key imported into the bucket, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/_export?bucket=missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the export of a missing bucket, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/raft"
+)
+
+// forwardedHeader marks the requests forwarded to the leader, so that they
+// are never forwarded again.
+const forwardedHeader = "X-Db-Forwarded-By"
+
+// clusterLog replicates the writes of the Db through the raft node.
+type clusterLog struct {
+	node *raft.Node
+}
+
+func (l clusterLog) Replicate(ctx context.Context, commands ...[]byte) error {
+	err := l.node.Propose(ctx, commands...)
+	switch {
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+		return fmt.Errorf("%w: %s", datastore.ErrNotLeader, err)
+	case errors.Is(err, raft.ErrStopped):
+		return fmt.Errorf("%w: %s", datastore.ErrClosed, err)
+	}
+	return err
+}
+
+// dbMachine applies the committed writes to the Db.
+type dbMachine struct {
+	db *datastore.Db
+}
+
+func (m dbMachine) Apply(index uint64, command []byte) error {
+	return m.db.ApplyCommand(context.Background(), index, command)
+}
+
+func (m dbMachine) Applied() uint64 {
+	return m.db.Position()
+}
+
+func (m dbMachine) Sync() error {
+	return m.db.Sync()
+}
+
+// WriteSnapshot writes the data of the Db. The commands applied meanwhile
+// may get into the snapshot past the returned position, the receiving node
+// applies them again and its Db skips them, see datastore.Db.ApplyCommand.
+func (m dbMachine) WriteSnapshot(w io.Writer) (uint64, error) {
+	position := m.db.Position()
+	return position, m.db.WriteSnapshot(w)
+}
+
+func (m dbMachine) RestoreSnapshot(r io.Reader) error {
+	return m.db.ApplySnapshot(context.Background(), r)
+}
+
+// openClusterNode opens the raft node configured by the flags, keeping its
+// state next to the data in dir.
+func openClusterNode(dir string) (*raft.Node, raft.Member, error) {
+	bootstrap, err := parseMembers(*clusterMembers)
+	if err != nil {
+		return nil, raft.Member{}, err
+	}
+	self := raft.Member{ID: *nodeID, Addr: strings.TrimSuffix(*advertise, "/")}
+	for _, m := range bootstrap {
+		if m.ID == self.ID && self.Addr == "" {
+			self.Addr = m.Addr
+		}
+	}
+	if *join != "" {
+		// The joining node learns the members from the leader.
+		bootstrap = nil
+		if self.Addr == "" {
+			return nil, self, errors.New("-advertise is required to join a cluster")
+		}
+	} else if len(bootstrap) == 0 {
+		return nil, self, errors.New("-cluster or -join is required in the cluster mode")
+	} else if self.Addr == "" {
+		return nil, self, fmt.Errorf("node %s is not in -cluster", self.ID)
+	}
+	node, err := raft.NewNode(raft.Config{
+		ID:        self.ID,
+		Dir:       filepath.Join(dir, "raft"),
+		Members:   bootstrap,
+		Transport: raft.HTTPTransport{Token: *clusterToken},
+
+		SnapshotThreshold: *raftSnapshot,
+	})
+	return node, self, err
+}
+
+// parseMembers parses the id=URL pairs separated by commas.
+func parseMembers(list string) ([]raft.Member, error) {
+	var members []raft.Member
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid cluster member %q, expected id=URL", pair)
+		}
+		members = append(members, raft.Member{ID: id, Addr: strings.TrimSuffix(addr, "/")})
+	}
+	return members, nil
+}
+
+// newClusterHandler serves the raft RPCs on /raft/ next to h and forwards
+// the writes and the membership changes received by the other nodes to the
+// leader. The reads are served by every node from its own data.
+func newClusterHandler(node *raft.Node, h http.Handler) http.Handler {
+	raftHandler := raft.NewHandler(node)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if needsLeader(req) && req.Header.Get(forwardedHeader) == "" && !node.IsLeader() {
+			forwardToLeader(res, req, node)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/raft/") {
+			raftHandler.ServeHTTP(res, req)
+		} else {
+			h.ServeHTTP(res, req)
+		}
+	})
+}
+
+func needsLeader(req *http.Request) bool {
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/admin/"):
+		return false
+	case strings.HasPrefix(req.URL.Path, "/raft/members"):
+		return req.Method != "GET"
+	case strings.HasPrefix(req.URL.Path, "/raft/"):
+		return false
+	}
+	return req.Method != "GET" && req.Method != "HEAD"
+}
+
+func forwardToLeader(res http.ResponseWriter, req *http.Request, node *raft.Node) {
+	leader, ok := node.Leader()
+	if !ok {
+		http.Error(res, "No leader is elected", http.StatusServiceUnavailable)
+		return
+	}
+	target, err := url.Parse(leader.Addr)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Invalid leader address %q", leader.Addr), http.StatusInternalServerError)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Header.Set(forwardedHeader, node.Status().ID)
+		},
+	}
+	proxy.ServeHTTP(res, req)
+}
+
+// joinCluster asks the member at addr to add the node to the cluster until
+// it succeeds or ctx is done. The token is sent when it is set.
+func joinCluster(ctx context.Context, addr, token string, self raft.Member) {
+	body, _ := json.Marshal(self)
+	for {
+		req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(addr, "/")+"/raft/members", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Failed to join the cluster: %s", err)
+			return
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("Joined the cluster through %s as %s", addr, self.ID)
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("Failed to join the cluster through %s: %s", addr, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/raft"
+)
+
+// clusterNode is a db service of a cluster running over loopback HTTP.
+type clusterNode struct {
+	server *httptest.Server
+	node   *raft.Node
+	db     *datastore.Db
+	dir    string
+	config raft.Config
+	tokens []*token
+
+	mu      sync.Mutex
+	handler http.Handler
+}
+
+func (c *clusterNode) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	h := c.handler
+	c.mu.Unlock()
+	h.ServeHTTP(res, req)
+}
+
+// open opens the raft node and the Db of the service in its directory.
+func (c *clusterNode) open(t *testing.T) {
+	node, err := raft.NewNode(c.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(c.dir, 1024, datastore.WithConsensus(clusterLog{node}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.node, c.db = node, db
+	handler := newClusterHandler(node, newHandler(db))
+	if c.tokens != nil {
+		handler = newAuthHandler(c.tokens, handler)
+	}
+	c.mu.Lock()
+	c.handler = handler
+	c.mu.Unlock()
+}
+
+func (c *clusterNode) stop() {
+	c.server.Close()
+	c.node.Stop()
+	c.db.Close()
+}
+
+// startCluster starts the nodes of a cluster. With the tokens the nodes
+// check them and call each other with the first one.
+func startCluster(t *testing.T, size int, threshold uint64, tokens []*token) []*clusterNode {
+	nodes := make([]*clusterNode, size)
+	var members []raft.Member
+	for i := range nodes {
+		nodes[i] = &clusterNode{handler: http.NotFoundHandler(), tokens: tokens}
+		nodes[i].server = httptest.NewServer(nodes[i])
+		members = append(members, raft.Member{ID: fmt.Sprintf("db%d", i+1), Addr: nodes[i].server.URL})
+	}
+	var transport raft.HTTPTransport
+	if len(tokens) > 0 {
+		transport.Token = tokens[0].Token
+	}
+	for i, c := range nodes {
+		c.dir = t.TempDir()
+		c.config = raft.Config{
+			ID:                members[i].ID,
+			Dir:               filepath.Join(c.dir, "raft"),
+			Members:           members,
+			Transport:         transport,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			SnapshotThreshold: threshold,
+		}
+		c.open(t)
+	}
+	for _, c := range nodes {
+		c.node.Start(dbMachine{c.db})
+	}
+	return nodes
+}
+
+func waitForLeader(t *testing.T, nodes []*clusterNode) *clusterNode {
+	t.Helper()
+	var leader *clusterNode
+	waitFor(t, "a leader", func() bool {
+		for _, c := range nodes {
+			if c.node.IsLeader() {
+				leader = c
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func clusterRequest(t *testing.T, c *clusterNode, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(response)
+}
+
+func TestCluster(t *testing.T) {
+	nodes := startCluster(t, 3, 0, nil)
+	stopped := make(map[*clusterNode]bool)
+	defer func() {
+		for _, c := range nodes {
+			if !stopped[c] {
+				c.stop()
+			}
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	var followers []*clusterNode
+	for _, c := range nodes {
+		if c != leader {
+			followers = append(followers, c)
+		}
+	}
+	waitFor(t, "the followers to know the leader", func() bool {
+		for _, c := range followers {
+			if _, ok := c.node.Leader(); !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The writes sent to a follower are forwarded to the leader and are
+	// acknowledged once a majority persisted them.
+	if code, body := clusterRequest(t, followers[0], "POST", "/db/key", `{"value":"v1"}`); code != http.StatusCreated {
+		t.Fatalf("Expected 201 on a forwarded put, got %d %s", code, body)
+	}
+	if code, _ := clusterRequest(t, followers[1], "DELETE", "/db/missing", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 on a forwarded delete of a missing key, got %d", code)
+	}
+	for _, c := range nodes {
+		waitFor(t, "the write to be applied", func() bool {
+			value, err := c.db.Get("key")
+			return err == nil && value == "v1"
+		})
+	}
+	if code, body := clusterRequest(t, followers[0], "GET", "/raft/status", ""); code != http.StatusOK || !strings.Contains(body, `"role":"follower"`) {
+		t.Errorf("Unexpected status %d %s", code, body)
+	}
+
+	// The cluster keeps accepting writes after losing the leader.
+	leader.stop()
+	stopped[leader] = true
+	newLeader := waitForLeader(t, followers)
+	for _, c := range followers {
+		if code, body := clusterRequest(t, c, "POST", "/db/"+c.node.Status().ID, `{"value":"v2"}`); code != http.StatusCreated {
+			t.Fatalf("Expected 201 on a put after the failover, got %d %s", code, body)
+		}
+	}
+	for _, c := range followers {
+		for _, other := range followers {
+			key := other.node.Status().ID
+			waitFor(t, key+" to be replicated", func() bool {
+				value, err := c.db.Get(key)
+				return err == nil && value == "v2"
+			})
+		}
+	}
+
+	// The remaining node cannot commit alone.
+	for _, c := range followers {
+		if c != newLeader {
+			c.stop()
+			stopped[c] = true
+		}
+	}
+	req, _ := http.NewRequest("POST", "/db/key", strings.NewReader(`{"value":"v3"}`))
+	rec := httptest.NewRecorder()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	newLeader.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a majority, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCluster_Snapshot(t *testing.T) {
+	nodes := startCluster(t, 3, 5, nil)
+	defer func() {
+		for _, c := range nodes {
+			c.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	var lagging *clusterNode
+	for _, c := range nodes {
+		if c != leader {
+			lagging = c
+			break
+		}
+	}
+
+	// The leader replaces the log with a snapshot while a node is down.
+	lagging.mu.Lock()
+	lagging.handler = http.NotFoundHandler()
+	lagging.mu.Unlock()
+	lagging.node.Stop()
+	lagging.db.Close()
+	for i := 0; i < 20; i++ {
+		if code, body := clusterRequest(t, leader, "POST", fmt.Sprintf("/db/key%d", i), fmt.Sprintf(`{"value":"v%d"}`, i)); code != http.StatusCreated {
+			t.Fatalf("Expected 201 on put, got %d %s", code, body)
+		}
+	}
+	waitFor(t, "the leader to compact its log", func() bool {
+		return leader.node.Status().SnapshotIndex > 0
+	})
+
+	// The node gets the compacted entries with the snapshot of the Db.
+	lagging.open(t)
+	lagging.node.Start(dbMachine{lagging.db})
+	waitFor(t, "the snapshot to be installed", func() bool {
+		value, err := lagging.db.Get("key19")
+		return err == nil && value == "v19" && lagging.node.Status().SnapshotIndex > 0
+	})
+	for i := 0; i < 20; i++ {
+		if value, err := lagging.db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("v%d", i) {
+			t.Errorf("Unexpected value of key%d: %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestCluster_Auth(t *testing.T) {
+	tokens, err := loadTokens(writeTokens(t, `[
+		{"name":"cluster","token":"cluster-secret","scopes":["admin"]},
+		{"name":"writer","token":"write-secret","scopes":["read","write"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := startCluster(t, 3, 0, tokens)
+	defer func() {
+		for _, c := range nodes {
+			c.stop()
+		}
+	}()
+	// The members elect the leader with the cluster token.
+	leader := waitForLeader(t, nodes)
+	var follower *clusterNode
+	for _, c := range nodes {
+		if c != leader {
+			follower = c
+			break
+		}
+	}
+	waitFor(t, "the follower to know the leader", func() bool {
+		_, ok := follower.node.Leader()
+		return ok
+	})
+
+	request := func(secret, method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, follower.server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The writes are checked before they are forwarded to the leader.
+	if code := request("", "POST", "/db/key", `{"value":"v1"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on a put without a token, got %d", code)
+	}
+	if code := request("write-secret", "POST", "/db/key", `{"value":"v1"}`); code != http.StatusCreated {
+		t.Errorf("Expected 201 on a forwarded put with a token, got %d", code)
+	}
+	// The raft endpoints need the admin scope.
+	for _, path := range []string{"/raft/members", "/raft/vote", "/raft/append", "/raft/snapshot"} {
+		if code := request("", "POST", path, `{}`); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 on %s without a token, got %d", path, code)
+		}
+		if code := request("write-secret", "POST", path, `{}`); code != http.StatusForbidden {
+			t.Errorf("Expected 403 on %s with a write token, got %d", path, code)
+		}
+	}
+	if members := leader.node.Status().Members; len(members) != 3 {
+		t.Errorf("Unexpected members %v", members)
+	}
+}
+
+func TestParseMembers(t *testing.T) {
+	members, err := parseMembers("db1=http://db1:8083/, db2=http://db2:8083")
+	if err != nil || len(members) != 2 || members[0] != (raft.Member{ID: "db1", Addr: "http://db1:8083"}) {
+		t.Errorf("Unexpected members %v, %v", members, err)
+	}
+	if _, err := parseMembers("db1"); err == nil {
+		t.Error("Expected an error for a member without an address")
+	}
+}
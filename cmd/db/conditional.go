@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// itemStore is implemented by the stores telling the time of the latest
+// write of the keys, see datastore.Db.GetItem.
+type itemStore interface {
+	GetItem(ctx context.Context, key string) (datastore.Item, error)
+}
+
+func getItem(ctx context.Context, store datastore.Store, key string) (datastore.Item, error) {
+	if items, ok := store.(itemStore); ok {
+		return items.GetItem(ctx, key)
+	}
+	value, err := store.GetContext(ctx, key)
+	return datastore.Item{Value: value}, err
+}
+
+// serveValue responds to GET and HEAD /db/[<bucket>/]<key> with the JSON
+// document of the key or, with the raw parameter, with the bare value. The
+// responses carry an ETag made of the value and, if the store keeps the
+// time of the writes, Last-Modified, and are 304 when If-None-Match or
+// If-Modified-Since say the client has them already. The raw values are
+// served in pieces for the Range requests.
+func serveValue(res http.ResponseWriter, req *http.Request, store datastore.Store, key string) {
+	item, err := getItem(req.Context(), store, key)
+	if err == datastore.ErrNotFound {
+		http.NotFound(res, req)
+		return
+	} else if err != nil {
+		writeStoreError(res, err, err.Error())
+		return
+	}
+
+	header := res.Header()
+	header.Set("Cache-Control", "no-cache")
+	tag := valueETag(item.Value)
+	if req.URL.Query().Has("raw") {
+		header.Set("ETag", `"`+tag+`.raw"`)
+		header.Set("Content-Type", "application/octet-stream")
+		http.ServeContent(res, req, "", item.Modified, strings.NewReader(item.Value))
+		return
+	}
+
+	header.Set("ETag", `"`+tag+`"`)
+	if !item.Modified.IsZero() {
+		header.Set("Last-Modified", item.Modified.Format(http.TimeFormat))
+	}
+	if notModified(req, header.Get("ETag"), item.Modified) {
+		res.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response, _ := json.Marshal(map[string]string{"key": key, "value": item.Value})
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(response)))
+	if req.Method == "HEAD" {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+	res.Write(response)
+}
+
+// valueETag is the hex of the first half of the SHA-256 of the value.
+func valueETag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// notModified evaluates If-None-Match or, without it, If-Modified-Since.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
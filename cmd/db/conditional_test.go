@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_Conditional(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("key", "0123456789")
+	h := newHandler(db)
+
+	request := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("GET", "/db/key")
+	etag, modified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusOK || etag == "" || modified == "" || rec.Body.String() != `{"key":"key","value":"0123456789"}` {
+		t.Fatalf("Unexpected response %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if rec := request("GET", "/db/key", "If-None-Match", `"other", `+etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching ETag, got %d", rec.Code)
+	}
+	if rec := request("GET", "/db/key", "If-None-Match", `"other"`, "If-Modified-Since", modified); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a different ETag, got %d", rec.Code)
+	}
+	if rec := request("GET", "/db/key", "If-Modified-Since", modified); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unmodified key, got %d", rec.Code)
+	}
+	earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if rec := request("GET", "/db/key", "If-Modified-Since", earlier); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a modified key, got %d", rec.Code)
+	}
+
+	rec = request("HEAD", "/db/key")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "34" || rec.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected HEAD response %d %v", rec.Code, rec.Header())
+	}
+	if rec := request("HEAD", "/db/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", rec.Code)
+	}
+
+	rec = request("GET", "/db/key?raw", "Range", "bytes=2-5")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" || rec.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("Unexpected range response %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	rec = request("GET", "/db/key?raw")
+	rawETag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" || rawETag == etag || rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Unexpected raw response %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if rec := request("GET", "/db/key?raw", "If-None-Match", rawETag); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a raw value, got %d", rec.Code)
+	}
+	if rec := request("GET", "/db/key?raw", "Range", "bytes=20-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the value, got %d", rec.Code)
+	}
+	if rec := request("GET", "/db/key", "Range", "bytes=2-5"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the range ignored for a JSON document, got %d", rec.Code)
+	}
+
+	db.Put("key", "changed")
+	if rec := request("GET", "/db/key", "If-None-Match", etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag after a write, got %d %s", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	// A store without the write times has no Last-Modified.
+	store := datastore.NewMemoryStore()
+	store.Put("key", "value")
+	rec = doRequest(newHandler(store), "GET", "/db/key", "")
+	if rec.Header().Get("ETag") == "" || rec.Header().Get("Last-Modified") != "" {
+		t.Errorf("Unexpected validators %v", rec.Header())
+	}
+	if !strings.Contains(rec.Header().Get("Cache-Control"), "no-cache") {
+		t.Errorf("Expected the responses revalidated, got %v", rec.Header())
+	}
+}
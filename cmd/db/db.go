@@ -1,96 +1,505 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/datastore"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/raft"
 	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
-var db *datastore.Db
+var (
+	port       = flag.Int("port", 8083, "server port")
+	respPort   = flag.Int("resp-port", 0, "port of the Redis protocol listener, 0 to disable it")
+	binaryPort = flag.Int("binary-port", 0, "port of the binary protocol listener, 0 to disable it")
+
+	dir         = flag.String("dir", envString("DB_DIR", "data"), "directory of the datastore files, $DB_DIR by default")
+	segmentSize = flag.Int64("segment-size", envInt64("DB_SEGMENT_SIZE", 10<<20), "size of a segment file in bytes, $DB_SEGMENT_SIZE by default")
+	maxSize     = flag.Int64("max-size", envInt64("DB_MAX_SIZE", 0), "maximum size of the datastore in bytes, 0 for no limit, $DB_MAX_SIZE by default")
+
+	maxKeySize   = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "maximum size of a key in bytes")
+	maxValueSize = flag.Int("max-value-size", datastore.DefaultMaxValueSize, "maximum size of a value in bytes")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", envDuration("DB_SHUTDOWN_TIMEOUT", 10*time.Second), "time the requests in progress get to finish on shutdown, $DB_SHUTDOWN_TIMEOUT by default")
+
+	historyVersions  = flag.Int("history-versions", 0, "number of the latest versions of every key kept by merges")
+	historyRetention = flag.Duration("history-retention", 0, "period the versions of the keys are kept for by merges")
+
+	leader      = flag.String("leader", "", "URL of the leader db service to follow, e.g. http://db:8083")
+	leaderToken = flag.String("leader-token", os.Getenv("DB_LEADER_TOKEN"), "admin token of the leader, $DB_LEADER_TOKEN by default")
+
+	tokensFile = flag.String("tokens", "", "JSON file of the bearer tokens of the HTTP API, the API is open without it")
+
+	adminAddr       = flag.String("admin-addr", "localhost:8086", "address of the admin listener, empty to disable it")
+	adminOnDataPort = flag.Bool("admin-on-data-port", false, "serve /admin/ and /metrics on the data port as well, with the admin token if the tokens are set")
+
+	nodeID         = flag.String("node-id", "", "ID of the node in a replicated cluster, enables the cluster mode")
+	clusterMembers = flag.String("cluster", "", "members bootstrapping the cluster as id=URL pairs separated by commas")
+	join           = flag.String("join", "", "URL of a cluster member to join the running cluster through")
+	advertise      = flag.String("advertise", "", "URL of the node for the other members, its -cluster entry by default")
+	clusterToken   = flag.String("cluster-token", os.Getenv("DB_CLUSTER_TOKEN"), "admin token the members send each other with -tokens, $DB_CLUSTER_TOKEN by default")
+	raftSnapshot   = flag.Uint64("raft-snapshot-threshold", raft.DefaultSnapshotThreshold, "number of the applied raft log entries replaced by a snapshot of the data")
+)
 
 func main() {
 	flag.Parse()
+	if *tokensFile != "" && (*respPort != 0 || *binaryPort != 0) {
+		log.Fatal("The RESP and binary protocol listeners do not check the tokens, -resp-port and -binary-port cannot be used with -tokens")
+	}
+	if *tokensFile != "" && *nodeID != "" && *clusterToken == "" {
+		log.Fatal("-cluster-token is required in the cluster mode with -tokens")
+	}
 
-	var err error
 	// Initialize the database
 
-	tempDir, err := os.MkdirTemp("", "temporaryDir")
-	if err != nil {
-		log.Fatalf("Failed to create temporary directory: %v", err)
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Failed to create the data directory: %v", err)
 	}
-	defer os.RemoveAll(tempDir)
 
-	db, err = datastore.NewDb(tempDir, 250)
+	m := newMetrics()
+	opts := []datastore.Option{
+		datastore.WithMergeObserver(m.observeMerge),
+		datastore.WithMaxSize(*maxSize),
+		datastore.WithLimits(*maxKeySize, *maxValueSize),
+		datastore.WithHistory(*historyVersions, *historyRetention),
+	}
+	if *leader != "" {
+		opts = append(opts, datastore.Follower())
+	}
+	var node *raft.Node
+	var self raft.Member
+	var err error
+	if *nodeID != "" {
+		if *leader != "" {
+			log.Fatal("A cluster node cannot follow a leader")
+		}
+		node, self, err = openClusterNode(*dir)
+		if err != nil {
+			log.Fatalf("Failed to initialize the cluster node: %v", err)
+		}
+		opts = append(opts, datastore.WithConsensus(clusterLog{node}))
+	}
+	db, err := datastore.NewDb(*dir, *segmentSize, opts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize the database: %v", err)
 	}
 
-	h := http.NewServeMux()
+	ctx, stopFollowing := context.WithCancel(context.Background())
+	following := make(chan struct{})
+	if *leader != "" {
+		go func() {
+			defer close(following)
+			f := newFollower(db, *leader)
+			f.token = *leaderToken
+			f.run(ctx)
+		}()
+		log.Printf("Following %s", *leader)
+	} else {
+		close(following)
+	}
 
-	h.HandleFunc("/db", dbHandler)
-	h.HandleFunc("/db/", dbHandler)
+	admin := newAdminServer(db, *dir, flag.CommandLine, m)
+	handler := newHandler(db)
+	if *adminOnDataPort {
+		mux := http.NewServeMux()
+		mux.Handle("/admin/", admin.handler())
+		mux.Handle("/metrics", admin.handler())
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	if node != nil {
+		admin.readyCheck = func() error {
+			if _, ok := node.Leader(); !ok {
+				return errNoLeader
+			}
+			return nil
+		}
+		node.Start(dbMachine{db})
+		handler = newClusterHandler(node, handler)
+		if *join != "" {
+			go joinCluster(ctx, *join, *clusterToken, self)
+		}
+		log.Printf("Running as the cluster node %s at %s", self.ID, self.Addr)
+	}
+	if *tokensFile != "" {
+		// The requests are checked before they are forwarded to the leader,
+		// the raft endpoints need the admin scope of the cluster token.
+		tokens, err := loadTokens(*tokensFile)
+		if err != nil {
+			log.Fatalf("Failed to load the tokens: %v", err)
+		}
+		handler = newAuthHandler(tokens, handler)
+		log.Printf("Loaded %d tokens", len(tokens))
+	}
 
-	server := httptools.CreateServer(*port, h)
+	streams, endStreams := context.WithCancel(context.Background())
+	server := httptools.CreateServer(*port, m.instrument(stoppableStreams(streams, handler)))
 	go server.Start()
 	log.Printf("Server started on port %d", *port)
 
+	var resp *respServer
+	if *respPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *respPort))
+		if err != nil {
+			log.Fatalf("Failed to start the RESP listener: %v", err)
+		}
+		resp = newRESPServer(db)
+		go func() {
+			if err := resp.Serve(l); err != nil {
+				log.Fatalf("RESP listener finished: %s", err)
+			}
+		}()
+		log.Printf("RESP listener started on port %d", *respPort)
+	}
+
+	var binary *binaryServer
+	if *binaryPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *binaryPort))
+		if err != nil {
+			log.Fatalf("Failed to start the binary protocol listener: %v", err)
+		}
+		binary = newBinaryServer(db)
+		go func() {
+			if err := binary.Serve(l); err != nil {
+				log.Fatalf("Binary protocol listener finished: %s", err)
+			}
+		}()
+		log.Printf("Binary protocol listener started on port %d", *binaryPort)
+	}
+
+	var adminHTTP *http.Server
+	if *adminAddr != "" {
+		l, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatalf("Failed to start the admin listener: %v", err)
+		}
+		adminHTTP = &http.Server{Handler: admin.handler(), ReadTimeout: 10 * time.Second}
+		go func() {
+			if err := adminHTTP.Serve(l); err != http.ErrServerClosed {
+				log.Fatalf("Admin listener finished: %s", err)
+			}
+		}()
+		log.Printf("Admin listener started on %s", l.Addr())
+	}
+	admin.ready.Store(true)
+
 	signal.WaitForTerminationSignal()
-	db.Close()
+	admin.ready.Store(false)
+
+	// The HTTP server stops taking requests and waits for the ones in
+	// progress, so that the writes are not cut off by closing the Db. The
+	// replication streams would never finish on their own.
+	endStreams()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish the requests in progress: %s", err)
+	}
+	cancel()
+	if adminHTTP != nil {
+		adminHTTP.Close()
+	}
+	if resp != nil {
+		resp.Close()
+	}
+	if binary != nil {
+		binary.Close()
+	}
+	stopFollowing()
+	<-following
+	if node != nil {
+		node.Stop()
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close the database: %s", err)
+	}
+	log.Print("Database closed")
+}
+
+func envString(name, value string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return value
 }
 
-func dbHandler(res http.ResponseWriter, req *http.Request) {
-	key := path.Base(req.URL.Path)
-	if key == "/" || key == "" {
-		http.Error(res, "Key is missing", http.StatusBadRequest)
-		return
+func envInt64(name string, value int64) int64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return value
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid $%s: %s", name, err)
 	}
+	return n
+}
 
-	switch req.Method {
-	case "GET":
-		value, err := db.Get(key)
-		if err == datastore.ErrNotFound {
-			http.NotFound(res, req)
+func envDuration(name string, value time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return value
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid $%s: %s", name, err)
+	}
+	return d
+}
+
+func newHandler(store datastore.Store) http.Handler {
+	h := http.NewServeMux()
+
+	h.HandleFunc("/db", listHandler(store))
+	h.HandleFunc("/db/", dbHandler(store))
+	h.HandleFunc("/db/_export", exportHandler(store))
+	h.HandleFunc("/db/_import", importHandler(store))
+	h.HandleFunc("/db/_batch", batchHandler(store))
+	h.HandleFunc("/db/_mget", mgetHandler(store))
+	h.HandleFunc("/db/_mset", msetHandler(store))
+	h.HandleFunc("/db/_buckets", bucketsHandler(store))
+	h.HandleFunc("/db/_buckets/", bucketsHandler(store))
+	h.HandleFunc("/db/_stats", statsHandler(store))
+	h.HandleFunc("/db/_replication", replicationHandler(store))
+	h.HandleFunc("/db/_replication/snapshot", snapshotHandler(store))
+	h.HandleFunc("/db/_promote", promoteHandler(store))
+
+	return h
+}
+
+// dbHandler serves /db/<key> from the default bucket and /db/<bucket>/<key>
+// from the named one. Either path followed by /history lists the versions
+// of the key.
+func dbHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		path, err := requestKey(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
-		} else if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+		key := path.key
+		store := defaultStore
+		if path.bucket != "" {
+			if store, err = findBucket(defaultStore, path.bucket); err != nil {
+				writeStoreError(res, err, err.Error())
+				return
+			}
+		}
+		if path.history {
+			if req.Method != "GET" {
+				http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			serveHistory(res, req, store, key)
 			return
 		}
-		response, _ := json.Marshal(map[string]string{"key": key, "value": value})
-		res.Header().Set("Content-Type", "application/json")
-		res.Write(response)
 
-	case "POST":
-		var data struct {
-			Value string `json:"value"`
+		switch {
+		case req.Method == "GET" && req.URL.Query().Has("version"):
+			serveVersion(res, req, store, key)
+
+		case req.Method == "GET" || req.Method == "HEAD":
+			serveValue(res, req, store, key)
+
+		case req.Method == "POST":
+			var data struct {
+				Value string `json:"value"`
+			}
+			body, ok := readBody(res, req, maxValueBody())
+			if !ok {
+				return
+			}
+			if err := json.Unmarshal(body, &data); err != nil {
+				http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+				return
+			}
+
+			if err := store.PutContext(req.Context(), key, data.Value); err != nil {
+				writeStoreError(res, err, "Failed to store the data")
+				return
+			}
+			res.WriteHeader(http.StatusCreated)
+
+		case req.Method == "PATCH":
+			serveMerge(res, req, store, key)
+
+		case req.Method == "DELETE":
+			err := store.DeleteContext(req.Context(), key)
+			if err == datastore.ErrNotFound {
+				http.NotFound(res, req)
+				return
+			} else if err != nil {
+				writeStoreError(res, err, "Failed to delete the data")
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-		body, err := io.ReadAll(req.Body)
+	}
+}
+
+// keyPath is a parsed /db/[<bucket>/]<key>[/history] path.
+type keyPath struct {
+	bucket, key string
+	history     bool
+}
+
+// requestKey extracts the bucket and the key from the /db/<key> and
+// /db/<bucket>/<key> paths, the bucket is empty in the first case. Keys
+// containing slashes or other reserved characters must be URL-escaped.
+// A trailing history segment selects the history of the key, a key named
+// history is reached by escaping any of its letters, e.g. %68istory. The
+// keys cannot start with an underscore, the /db/_<name> paths are the
+// control endpoints, see datastore.ReservedKeyPrefix.
+func requestKey(req *http.Request) (keyPath, error) {
+	var path keyPath
+	escaped := strings.TrimPrefix(strings.TrimPrefix(req.URL.EscapedPath(), "/db"), "/")
+	segments := strings.Split(escaped, "/")
+	if len(segments) > 1 && segments[len(segments)-1] == "history" {
+		path.history = true
+		segments = segments[:len(segments)-1]
+	}
+	if len(segments) > 2 {
+		return path, errors.New("Key must be a single URL-escaped path segment")
+	}
+	if segments[len(segments)-1] == "" {
+		return path, errors.New("Key is missing")
+	}
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
 		if err != nil {
-			http.Error(res, "Invalid request", http.StatusBadRequest)
+			return path, errors.New("Key is not properly escaped")
+		}
+		segments[i] = unescaped
+	}
+	if len(segments) == 1 {
+		path.key = segments[0]
+	} else {
+		path.bucket, path.key = segments[0], segments[1]
+	}
+	return path, nil
+}
+
+// maxValueBody limits the bodies carrying a value: a JSON string takes up
+// to 6 bytes for a byte of the value, and the object around it is small.
+func maxValueBody() int64 {
+	return 6*int64(*maxValueSize) + 4<<10
+}
+
+// readBody reads the request body of at most limit bytes. It responds with
+// 413 or 400 and returns false if the body is rejected.
+func readBody(res http.ResponseWriter, req *http.Request, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(res, fmt.Sprintf("Request is over %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(res, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// writeStoreError maps the store errors to the response status: 400 and 413
+// for the rejected keys, values and merge operands, 404 for missing buckets,
+// 409 for the merges the value does not take, 421 for the writes to
+// a follower, 501 when the history is not kept, 507 for exceeded quotas, 503
+// when the store is closing or the request ran out of time and 500 for the
+// other errors.
+func writeStoreError(res http.ResponseWriter, err error, message string) {
+	status, message := storeError(err, message)
+	http.Error(res, message, status)
+}
+
+// storeError returns the status and the message of the response to err,
+// message is used for the unexpected errors.
+func storeError(err error, message string) (int, string) {
+	switch {
+	case errors.Is(err, datastore.ErrHistoryDisabled):
+		return http.StatusNotImplemented, err.Error()
+	case errors.Is(err, datastore.ErrBucketNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, err.Error()
+	case errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrInvalidBucket),
+		errors.Is(err, datastore.ErrUnknownOperator), errors.Is(err, datastore.ErrInvalidOperand):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, err.Error()
+	case errors.Is(err, datastore.ErrMergeConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, datastore.ErrNotLeader):
+		return http.StatusMisdirectedRequest, err.Error()
+	case errors.Is(err, datastore.ErrClosed):
+		return http.StatusServiceUnavailable, "Database is shutting down"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, "Request timed out"
+	}
+	return http.StatusInternalServerError, message
+}
+
+// exportHandler writes the keys of the default bucket, or of the one named
+// by the bucket parameter, as JSON lines.
+func exportHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		err = json.Unmarshal(body, &data)
+		store, err := requestBucket(defaultStore, req)
 		if err != nil {
-			http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+			writeStoreError(res, err, err.Error())
 			return
 		}
+		res.Header().Set("Content-Type", "application/x-ndjson")
+		if err := store.Export(res); err != nil {
+			// The status is already sent, the client sees a truncated stream.
+			log.Printf("Export failed: %s", err)
+		}
+	}
+}
 
-		err = db.Put(key, data.Value)
+// importHandler stores the JSON lines in the default bucket or in the one
+// named by the bucket parameter.
+func importHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		store, err := requestBucket(defaultStore, req)
 		if err != nil {
-			http.Error(res, "Failed to store the data", http.StatusInternalServerError)
+			writeStoreError(res, err, err.Error())
 			return
 		}
-		res.WriteHeader(http.StatusCreated)
-
-	default:
-		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		imported, err := store.Import(req.Body)
+		if errors.Is(err, datastore.ErrInvalidImport) {
+			http.Error(res, fmt.Sprintf("Imported %d records: %s", imported, err), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Import failed after %d records: %s", imported, err)
+			writeStoreError(res, err, fmt.Sprintf("Imported %d records: failed to store the data", imported))
+			return
+		}
+		response, _ := json.Marshal(map[string]int{"imported": imported})
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(response)
 	}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+)
+
+func doRequest(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestDbHandler(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	h := newHandler(store)
+
+	if rec := doRequest(h, "GET", "/db/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", rec.Code)
+	}
+
+	if rec := doRequest(h, "POST", "/db/key", `{"value":"v1"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on put, got %d", rec.Code)
+	}
+	if value, _ := store.Get("key"); value != "v1" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+
+	rec := doRequest(h, "GET", "/db/key", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on get, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != `{"key":"key","value":"v1"}` {
+		t.Errorf("Unexpected response %s", body)
+	}
+
+	if rec := doRequest(h, "POST", "/db/key", `not json`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+
+	if rec := doRequest(h, "DELETE", "/db/key", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on delete, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "DELETE", "/db/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 on second delete, got %d", rec.Code)
+	}
+
+	if rec := doRequest(h, "GET", "/db/", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a key, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PUT", "/db/key", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestDbHandler_ExportImport(t *testing.T) {
+	source := datastore.NewMemoryStore()
+	source.Put("key1", "value1")
+	source.Put("key2", "value2")
+
+	rec := doRequest(newHandler(source), "GET", "/db/_export", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected export response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	exported := rec.Body.String()
+	if strings.Count(exported, "\n") != 2 {
+		t.Errorf("Expected 2 exported lines, got %q", exported)
+	}
+
+	target := datastore.NewMemoryStore()
+	h := newHandler(target)
+	rec = doRequest(h, "POST", "/db/_import", exported)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"imported":2}` {
+		t.Fatalf("Unexpected import response %d %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := target.Get("key2"); value != "value2" {
+		t.Errorf("Unexpected imported value %q", value)
+	}
+
+	if rec := doRequest(h, "POST", "/db/_import", `{"key":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed import, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_export", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestDbHandler_Unavailable(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	h := newHandler(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/db/key", nil).WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a cancelled request, got %d", rec.Code)
+	}
+
+	store.Close()
+	if rec := doRequest(h, "POST", "/db/key", `{"value":"v1"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from a closed store, got %d", rec.Code)
+	}
+}
+
+func TestDbHandler_Keys(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	h := newHandler(store)
+
+	if rec := doRequest(h, "POST", "/db/a%2Fb%20c", `{"value":"v1"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for an escaped key, got %d", rec.Code)
+	}
+	if value, _ := store.Get("a/b c"); value != "v1" {
+		t.Errorf("Unexpected value of the unescaped key %q", value)
+	}
+	if rec := doRequest(h, "GET", "/db/a%2Fb%20c", ""); rec.Body.String() != `{"key":"a/b c","value":"v1"}` {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(h, "GET", "/db/a/b/c", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unescaped slashes, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/a/b", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a bucket path on a store without buckets, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/%ff", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid key, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_key", `{"value":"v1"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a key taking the prefix of the control endpoints, got %d", rec.Code)
+	}
+	longKey := strings.Repeat("k", datastore.DefaultMaxKeySize+1)
+	if rec := doRequest(h, "GET", "/db/"+longKey, ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a long key, got %d", rec.Code)
+	}
+	largeValue := `{"value":"` + strings.Repeat("v", datastore.DefaultMaxValueSize+1) + `"}`
+	if rec := doRequest(h, "POST", "/db/key", largeValue); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large value, got %d", rec.Code)
+	}
+	// The bodies over the limit are not read to the end.
+	hugeValue := `{"value":"` + strings.Repeat("v", int(maxValueBody())) + `"}`
+	if rec := doRequest(h, "POST", "/db/key", hugeValue); rec.Code != http.StatusRequestEntityTooLarge || !strings.HasPrefix(rec.Body.String(), "Request is over") {
+		t.Errorf("Expected 413 for a body over the limit, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.CreateBucket("team", 0); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newHandler(db))
+	defer server.Close()
+	c := dbclient.NewHTTP(server.URL)
+	ctx := context.Background()
+
+	for _, key := range []string{"key", "history", "a/b c"} {
+		if err := c.Put(ctx, key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := c.Get(ctx, key); err != nil || value != "value of "+key {
+			t.Errorf("Unexpected value %q of %q, %v", value, key, err)
+		}
+	}
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	team := c.Bucket("team")
+	errs, err := team.Batch(ctx, []dbclient.Operation{
+		{Key: "k1", Value: "v1"},
+		{Key: "k2", Value: "v2"},
+		{Key: "k3", Delete: true},
+	})
+	if err != nil || len(errs) != 3 || errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], dbclient.ErrNotFound) {
+		t.Errorf("Unexpected batch results %v, %v", errs, err)
+	}
+	list, err := team.List(ctx, "k")
+	if err != nil || fmt.Sprint(list) != "[{k1 v1} {k2 v2}]" {
+		t.Errorf("Unexpected list %v, %v", list, err)
+	}
+	errs, err = team.MSet(ctx, []dbclient.KeyValue{{Key: "k3", Value: "v3"}, {Key: "", Value: "v4"}})
+	if err != nil || len(errs) != 2 || errs[0] != nil || !errors.Is(errs[1], dbclient.ErrInvalid) {
+		t.Errorf("Unexpected multi-put results %v, %v", errs, err)
+	}
+	values, err := team.MGet(ctx, []string{"k1", "k3", "missing"})
+	if err != nil || fmt.Sprint(values) != "map[k1:v1 k3:v3]" {
+		t.Errorf("Unexpected values %v, %v", values, err)
+	}
+	if _, err := c.Bucket("missing").Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing bucket, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// historyStore is implemented by the stores keeping the previous values of
+// the keys, see datastore.WithHistory.
+type historyStore interface {
+	History(key string) ([]datastore.Version, error)
+	GetAt(key string, version uint64) (string, error)
+}
+
+var errNoHistory = fmt.Errorf("%w by the store", datastore.ErrHistoryDisabled)
+
+// serveHistory responds to GET /db/[<bucket>/]<key>/history with the kept
+// versions of the key from the oldest one.
+func serveHistory(res http.ResponseWriter, req *http.Request, store datastore.Store, key string) {
+	history, ok := store.(historyStore)
+	if !ok {
+		writeStoreError(res, errNoHistory, errNoHistory.Error())
+		return
+	}
+	versions, err := history.History(key)
+	if err == datastore.ErrNotFound {
+		http.NotFound(res, req)
+		return
+	} else if err != nil {
+		writeStoreError(res, err, "Failed to read the history")
+		return
+	}
+	writeJSON(res, http.StatusOK, struct {
+		Key      string              `json:"key"`
+		Versions []datastore.Version `json:"versions"`
+	}{key, versions})
+}
+
+// serveVersion responds to GET /db/[<bucket>/]<key>?version=<n> with the
+// value the key had at the version.
+func serveVersion(res http.ResponseWriter, req *http.Request, store datastore.Store, key string) {
+	version, err := strconv.ParseUint(req.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		http.Error(res, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	history, ok := store.(historyStore)
+	if !ok {
+		writeStoreError(res, errNoHistory, errNoHistory.Error())
+		return
+	}
+	value, err := history.GetAt(key, version)
+	if err == datastore.ErrNotFound {
+		http.NotFound(res, req)
+		return
+	} else if err != nil {
+		writeStoreError(res, err, "Failed to read the data")
+		return
+	}
+	writeJSON(res, http.StatusOK, struct {
+		Key     string `json:"key"`
+		Value   string `json:"value"`
+		Version uint64 `json:"version"`
+	}{key, value, version})
+}
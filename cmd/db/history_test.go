@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_History(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024, datastore.WithHistory(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newHandler(db)
+
+	for _, value := range []string{"v1", "v2"} {
+		if rec := doRequest(h, "POST", "/db/key", `{"value":"`+value+`"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 on put, got %d", rec.Code)
+		}
+	}
+	if rec := doRequest(h, "DELETE", "/db/key", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on delete, got %d", rec.Code)
+	}
+
+	rec := doRequest(h, "GET", "/db/key/history", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on history, got %d %s", rec.Code, rec.Body.String())
+	}
+	var history struct {
+		Key      string              `json:"key"`
+		Versions []datastore.Version `json:"versions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if history.Key != "key" || len(history.Versions) != 3 || history.Versions[1].Value != "v2" || !history.Versions[2].Deleted {
+		t.Errorf("Unexpected history %s", rec.Body.String())
+	}
+
+	if rec := doRequest(h, "GET", "/db/key?version=1", ""); rec.Body.String() != `{"key":"key","value":"v1","version":1}` {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db/key?version=3", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted version, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/key?version=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid version, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/missing/history", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/key/history", `{"value":"v"}`); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a write to the history, got %d", rec.Code)
+	}
+
+	if _, err := db.CreateBucket("team", 0); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(h, "POST", "/db/team/%68istory", `{"value":"v"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for an escaped history key, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/team/history/history", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on the history of a bucket key, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(newHandler(datastore.NewMemoryStore()), "GET", "/db/key/history", ""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from a store without history, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listPage is the response of GET /db, next is the after parameter of the
+// next page and is empty on the last page.
+type listPage struct {
+	Items []datastore.ExportRecord `json:"items"`
+	Next  string                   `json:"next,omitempty"`
+}
+
+// listHandler lists the keys of the default bucket, or of the one named by
+// the bucket parameter, in key order on GET /db. The prefix parameter
+// selects the keys, after skips the keys up to the given one and limit sets
+// the size of the page, 100 by default and 1000 at most.
+func listHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		limit := defaultListLimit
+		if query.Has("limit") {
+			var err error
+			if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > maxListLimit {
+				http.Error(res, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		store, err := requestBucket(defaultStore, req)
+		if err != nil {
+			writeStoreError(res, err, err.Error())
+			return
+		}
+
+		page := listPage{Items: []datastore.ExportRecord{}}
+		err = store.ScanAfter(query.Get("prefix"), query.Get("after"), func(key, value string) error {
+			if len(page.Items) == limit {
+				page.Next = page.Items[limit-1].Key
+				return errScanPage
+			}
+			page.Items = append(page.Items, datastore.ExportRecord{Key: key, Value: value})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errScanPage) {
+			writeStoreError(res, err, "Failed to list the keys")
+			return
+		}
+		writeJSON(res, http.StatusOK, page)
+	}
+}
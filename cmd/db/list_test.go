@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_List(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	for _, key := range []string{"a1", "a2", "a3", "b1"} {
+		store.Put(key, "value-"+key)
+	}
+	h := newHandler(store)
+
+	rec := doRequest(h, "GET", "/db?prefix=a&limit=2", "")
+	want := `{"items":[{"key":"a1","value":"value-a1"},{"key":"a2","value":"value-a2"}],"next":"a2"}`
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("Unexpected first page %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(h, "GET", "/db?prefix=a&limit=2&after=a2", "")
+	if want := `{"items":[{"key":"a3","value":"value-a3"}]}`; rec.Body.String() != want {
+		t.Errorf("Unexpected last page %s", rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db?prefix=c", ""); rec.Body.String() != `{"items":[]}` {
+		t.Errorf("Unexpected empty page %s", rec.Body.String())
+	}
+
+	for _, limit := range []string{"0", "1001", "x"} {
+		if rec := doRequest(h, "GET", "/db?limit="+limit, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for the limit %s, got %d", limit, rec.Code)
+		}
+	}
+	if rec := doRequest(h, "POST", "/db", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db?bucket=team", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a bucket on a store without buckets, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// mergeStore is implemented by the stores with merge operators, see
+// datastore.Db.Merge.
+type mergeStore interface {
+	MergeContext(ctx context.Context, key, operator, operand string) error
+}
+
+var errNoMerge = errors.New("merge operators are not supported by the store")
+
+// serveMerge handles PATCH /db/[<bucket>/]<key>. The body is either
+// {"operator": <name>, "operand": <string>} or, with the
+// application/merge-patch+json content type, a JSON merge patch.
+func serveMerge(res http.ResponseWriter, req *http.Request, store datastore.Store, key string) {
+	merger, ok := store.(mergeStore)
+	if !ok {
+		http.Error(res, errNoMerge.Error(), http.StatusNotImplemented)
+		return
+	}
+	body, ok := readBody(res, req, maxValueBody())
+	if !ok {
+		return
+	}
+
+	var data struct {
+		Operator string `json:"operator"`
+		Operand  string `json:"operand"`
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/merge-patch+json" {
+		data.Operator, data.Operand = datastore.MergePatchOperator, string(body)
+	} else if err := json.Unmarshal(body, &data); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if err := merger.MergeContext(req.Context(), key, data.Operator, data.Operand); err != nil {
+		writeStoreError(res, err, "Failed to merge the data")
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_Merge(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newHandler(db)
+
+	for _, operand := range []string{"2", "40"} {
+		if rec := doRequest(h, "PATCH", "/db/counter", `{"operator":"add","operand":"`+operand+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 on merge, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if rec := doRequest(h, "GET", "/db/counter", ""); rec.Body.String() != `{"key":"counter","value":"42"}` {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(h, "POST", "/db/doc", `{"value":"{\"a\":1,\"b\":2}"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on put, got %d", rec.Code)
+	}
+	req := httptest.NewRequest("PATCH", "/db/doc", strings.NewReader(`{"a":null,"c":3}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on a merge patch, got %d %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := db.Get("doc"); value != `{"b":2,"c":3}` {
+		t.Errorf("Unexpected patched value %s", value)
+	}
+
+	if rec := doRequest(h, "PATCH", "/db/counter", `{"operator":"unknown","operand":"1"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown operator, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PATCH", "/db/counter", `{"operator":"add","operand":"one"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid operand, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PATCH", "/db/doc", `{"operator":"add","operand":"1"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for add to a JSON value, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/db/doc", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the rejected merge to keep the key readable, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "PATCH", "/db/counter", `{`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "PATCH", "/db/counter", strings.Repeat(" ", int(maxValueBody())+1)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the limit, got %d", rec.Code)
+	}
+	if rec := doRequest(newHandler(datastore.NewMemoryStore()), "PATCH", "/db/key", `{"operator":"append","operand":"x"}`); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from a store without merges, got %d", rec.Code)
+	}
+}
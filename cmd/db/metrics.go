@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// The upper bounds of the histogram buckets in seconds.
+var (
+	requestBuckets    = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	compactionBuckets = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+)
+
+// histogram counts the observations falling into every bucket, the last
+// count is of the ones over all the bounds.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(value float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.sum += value
+	h.count++
+}
+
+// write writes the histogram series of the metric with the labels, which
+// are either empty or a list of name="value" pairs.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// requestLabels identify the series of the HTTP requests.
+type requestLabels struct {
+	method string
+	status int
+}
+
+// metrics collects the metrics of the db service and writes them in the
+// Prometheus text exposition format together with the datastore gauges.
+type metrics struct {
+	mu          sync.Mutex
+	requests    map[requestLabels]*histogram
+	compactions map[string]uint64
+	compaction  *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:    make(map[requestLabels]*histogram),
+		compactions: map[string]uint64{"ok": 0, "error": 0},
+		compaction:  newHistogram(compactionBuckets),
+	}
+}
+
+// observeRequest records a served HTTP request.
+func (m *metrics) observeRequest(method string, status int, duration time.Duration) {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "OTHER"
+	}
+	labels := requestLabels{method, status}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.requests[labels]
+	if h == nil {
+		h = newHistogram(requestBuckets)
+		m.requests[labels] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// observeMerge records a merge of the segments, it is the merge observer of
+// the Db, see datastore.WithMergeObserver.
+func (m *metrics) observeMerge(duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.compactions["error"]++
+		return
+	}
+	m.compactions["ok"]++
+	m.compaction.observe(duration.Seconds())
+}
+
+// instrument records the requests served by h.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		defer func() {
+			m.observeRequest(req.Method, recorder.status, time.Since(start))
+		}()
+		h.ServeHTTP(recorder, req)
+	})
+}
+
+// statusRecorder remembers the status of the response. It passes the
+// flushes through, the replication streams rely on them.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	r.wroteHeader = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// handler serves the metrics on GET /metrics.
+func (m *metrics) handler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(res, store.Stats())
+	}
+}
+
+func (m *metrics) write(w io.Writer, stats datastore.Stats) {
+	var b strings.Builder
+	m.mu.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].status < labels[j].status
+	})
+
+	b.WriteString("# HELP db_http_requests_total HTTP requests served by method and status.\n")
+	b.WriteString("# TYPE db_http_requests_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(&b, "db_http_requests_total{method=%q,status=\"%d\"} %d\n", l.method, l.status, m.requests[l].count)
+	}
+	b.WriteString("# HELP db_http_request_duration_seconds Time spent serving the HTTP requests by method and status.\n")
+	b.WriteString("# TYPE db_http_request_duration_seconds histogram\n")
+	for _, l := range labels {
+		m.requests[l].write(&b, "db_http_request_duration_seconds", fmt.Sprintf("method=%q,status=\"%d\"", l.method, l.status))
+	}
+
+	b.WriteString("# HELP db_compactions_total Merges of the segments by result.\n")
+	b.WriteString("# TYPE db_compactions_total counter\n")
+	fmt.Fprintf(&b, "db_compactions_total{result=\"error\"} %d\n", m.compactions["error"])
+	fmt.Fprintf(&b, "db_compactions_total{result=\"ok\"} %d\n", m.compactions["ok"])
+	b.WriteString("# HELP db_compaction_duration_seconds Time spent merging the segments.\n")
+	b.WriteString("# TYPE db_compaction_duration_seconds histogram\n")
+	m.compaction.write(&b, "db_compaction_duration_seconds", "")
+	m.mu.Unlock()
+
+	for _, g := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"db_keys", "Live keys in all the buckets.", int64(stats.Keys)},
+		{"db_segments", "Segment files.", int64(stats.Segments)},
+		{"db_bytes", "Size of the segment files in bytes.", stats.Bytes},
+		{"db_dead_bytes", "Bytes of the overwritten and deleted entries a merge would drop.", stats.DeadBytes},
+		{"db_write_queue_depth", "Writes waiting for the put routine.", int64(stats.WriteQueue)},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestMetrics(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	m := newMetrics()
+	h := m.instrument(newHandler(store))
+
+	doRequest(h, "POST", "/db/key", `{"value":"v1"}`)
+	doRequest(h, "GET", "/db/key", "")
+	doRequest(h, "GET", "/db/key", "")
+	doRequest(h, "GET", "/db/missing", "")
+	doRequest(h, "BREW", "/db/key", "")
+	m.observeMerge(30*time.Millisecond, nil)
+	m.observeMerge(time.Second, errors.New("disk full"))
+
+	rec := doRequest(m.handler(store), "GET", "/metrics", "")
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE db_http_requests_total counter",
+		`db_http_requests_total{method="GET",status="200"} 2`,
+		`db_http_requests_total{method="GET",status="404"} 1`,
+		`db_http_requests_total{method="POST",status="201"} 1`,
+		`db_http_requests_total{method="OTHER",status="405"} 1`,
+		"# TYPE db_http_request_duration_seconds histogram",
+		`db_http_request_duration_seconds_bucket{method="GET",status="200",le="10"} 2`,
+		`db_http_request_duration_seconds_bucket{method="GET",status="200",le="+Inf"} 2`,
+		`db_http_request_duration_seconds_count{method="GET",status="200"} 2`,
+		`db_compactions_total{result="error"} 1`,
+		`db_compactions_total{result="ok"} 1`,
+		`db_compaction_duration_seconds_bucket{le="0.01"} 0`,
+		`db_compaction_duration_seconds_bucket{le="0.05"} 1`,
+		`db_compaction_duration_seconds_sum 0.03`,
+		`db_compaction_duration_seconds_count 1`,
+		"# TYPE db_keys gauge\ndb_keys 1",
+		"db_dead_bytes 0",
+		"db_write_queue_depth 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected the line %q in the metrics:\n%s", line, body)
+		}
+	}
+	if rec := doRequest(m.handler(store), "POST", "/metrics", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	// maxMultiKeys limits the keys of a multi-get or a multi-put.
+	maxMultiKeys = 1000
+	// maxMultiRequestSize limits the body of a multi-get, a multi-put or a
+	// batch.
+	maxMultiRequestSize = 32 << 20
+)
+
+// mgetRequest is the body of POST /db/_mget.
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// msetResult is the outcome of a put of POST /db/_mset, status is the
+// status of the response to the same put on /db/<key>.
+type msetResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// mgetHandler returns the values of the listed keys of the default bucket,
+// or of the one named by the bucket parameter, on POST /db/_mget:
+//
+//	{"keys":["k1","k2"]} -> {"values":{"k1":"v1"},"missing":["k2"]}
+//
+// The keys the store cannot hold, e.g. the empty one, are missing. A key the
+// token of the request does not reach fails the whole request with 403. The
+// values are written as they are read, so a failure of the store after the
+// first one aborts the response.
+func mgetHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var request mgetRequest
+		if !readMultiRequest(res, req, &request) {
+			return
+		}
+		if len(request.Keys) > maxMultiKeys {
+			http.Error(res, fmt.Sprintf("Request has over %d keys", maxMultiKeys), http.StatusRequestEntityTooLarge)
+			return
+		}
+		for _, key := range request.Keys {
+			if !allowedKey(req, key) {
+				auditDenied(req, http.StatusForbidden, fmt.Sprintf("token does not reach %q", key))
+				http.Error(res, fmt.Sprintf("Forbidden: token does not reach %q", key), http.StatusForbidden)
+				return
+			}
+		}
+		store, err := requestBucket(defaultStore, req)
+		if err != nil {
+			writeStoreError(res, err, err.Error())
+			return
+		}
+
+		out := newJSONStream(res)
+		missing := []string{}
+		seen := make(map[string]bool, len(request.Keys))
+		for _, key := range request.Keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			value, err := store.GetContext(req.Context(), key)
+			switch {
+			case errors.Is(err, datastore.ErrNotFound), errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrKeyTooLarge):
+				missing = append(missing, key)
+				continue
+			case err != nil && !out.started:
+				writeStoreError(res, err, "Failed to read the data")
+				return
+			case err != nil:
+				panic(http.ErrAbortHandler)
+			}
+			if !out.started {
+				out.write(`{"values":{`)
+			} else {
+				out.write(",")
+			}
+			out.encode(key)
+			out.write(":")
+			out.encode(value)
+		}
+		if !out.started {
+			out.write(`{"values":{`)
+		}
+		out.write(`},"missing":`)
+		out.encode(missing)
+		out.write("}")
+		out.flush()
+	}
+}
+
+// msetHandler stores a JSON array of the keys with their values in the
+// default bucket, or in the one named by the bucket parameter, on POST
+// /db/_mset:
+//
+//	[{"key":"k1","value":"v1"}] -> {"results":[{"key":"k1","status":201}]}
+//
+// The puts run in order and each of them succeeds or fails on its own, the
+// results are written as the puts complete. The keys the token of the
+// request does not reach fail with 403.
+func msetHandler(defaultStore datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var records []datastore.ExportRecord
+		if !readMultiRequest(res, req, &records) {
+			return
+		}
+		if len(records) > maxMultiKeys {
+			http.Error(res, fmt.Sprintf("Request has over %d keys", maxMultiKeys), http.StatusRequestEntityTooLarge)
+			return
+		}
+		store, err := requestBucket(defaultStore, req)
+		if err != nil {
+			writeStoreError(res, err, err.Error())
+			return
+		}
+
+		out := newJSONStream(res)
+		out.write(`{"results":[`)
+		for i, record := range records {
+			result := msetResult{Key: record.Key, Status: http.StatusCreated}
+			if !allowedKey(req, record.Key) {
+				result.Status, result.Error = http.StatusForbidden, "token does not reach the key"
+				auditDenied(req, result.Status, fmt.Sprintf("token does not reach %q", record.Key))
+			} else if err := store.PutContext(req.Context(), record.Key, record.Value); err != nil {
+				result.Status, result.Error = storeError(err, "Failed to store the data")
+			}
+			if i > 0 {
+				out.write(",")
+			}
+			out.encode(result)
+		}
+		out.write("]}")
+		out.flush()
+	}
+}
+
+// readMultiRequest decodes the JSON body of a POST request limited to
+// maxMultiRequestSize. It responds with an error and returns false if the
+// request is rejected.
+func readMultiRequest(res http.ResponseWriter, req *http.Request, value any) bool {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	body, ok := readBody(res, req, maxMultiRequestSize)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(body, value); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// jsonStream writes a JSON response piece by piece through a buffer, the
+// status 200 is sent with the first piece.
+type jsonStream struct {
+	res     http.ResponseWriter
+	w       *bufio.Writer
+	started bool
+}
+
+func newJSONStream(res http.ResponseWriter) *jsonStream {
+	return &jsonStream{res: res, w: bufio.NewWriterSize(res, 32*1024)}
+}
+
+func (s *jsonStream) start() {
+	if !s.started {
+		s.started = true
+		s.res.Header().Set("Content-Type", "application/json")
+		s.res.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *jsonStream) write(raw string) {
+	s.start()
+	s.w.WriteString(raw)
+}
+
+func (s *jsonStream) encode(value any) {
+	s.start()
+	data, _ := json.Marshal(value)
+	s.w.Write(data)
+}
+
+func (s *jsonStream) flush() {
+	s.start()
+	s.w.Flush()
+}
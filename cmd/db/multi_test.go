@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestDbHandler_MGet(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	store.Put("k1", "v1")
+	store.Put("k2", `"quoted"`)
+	h := newHandler(store)
+
+	rec := doRequest(h, "POST", "/db/_mget", `{"keys":["k1","missing","k2","k1",""]}`)
+	want := `{"values":{"k1":"v1","k2":"\"quoted\""},"missing":["missing",""]}`
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(h, "POST", "/db/_mget", `{"keys":["missing"]}`)
+	if want := `{"values":{},"missing":["missing"]}`; rec.Body.String() != want {
+		t.Errorf("Unexpected response %s", rec.Body.String())
+	}
+	if rec := doRequest(h, "POST", "/db/_mget", `{"keys":[]}`); rec.Body.String() != `{"values":{},"missing":[]}` {
+		t.Errorf("Unexpected response %s", rec.Body.String())
+	}
+
+	keys := `"k"` + strings.Repeat(`,"k"`, maxMultiKeys)
+	if rec := doRequest(h, "POST", "/db/_mget", `{"keys":[`+keys+`]}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for too many keys, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_mget", `["k1"]`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/db/_mget", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_mget?bucket=team", `{"keys":["k1"]}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a bucket on a store without buckets, got %d", rec.Code)
+	}
+
+	store.Close()
+	if rec := doRequest(h, "POST", "/db/_mget", `{"keys":["k1"]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from a closed store, got %d", rec.Code)
+	}
+}
+
+func TestDbHandler_MSet(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	h := newHandler(store)
+
+	rec := doRequest(h, "POST", "/db/_mset", `[{"key":"k1","value":"v1"},{"key":"","value":"v2"},{"key":"k1","value":"v3"}]`)
+	want := `{"results":[{"key":"k1","status":201},{"key":"","status":400,"error":"invalid key"},{"key":"k1","status":201}]}`
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := store.Get("k1"); value != "v3" {
+		t.Errorf("Expected the puts in order, got %q", value)
+	}
+	if rec := doRequest(h, "POST", "/db/_mset", `[]`); rec.Body.String() != `{"results":[]}` {
+		t.Errorf("Unexpected response %s", rec.Body.String())
+	}
+
+	large := fmt.Sprintf(`[{"key":"k","value":"%s"}]`, strings.Repeat("v", maxMultiRequestSize))
+	if rec := doRequest(h, "POST", "/db/_mset", large); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large request, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/db/_mset", `{"k":"v"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// replicatedStore is implemented by the stores streaming their log to the
+// followers, see datastore.Db.
+type replicatedStore interface {
+	WriteLog(ctx context.Context, w io.Writer, from uint64, heartbeat time.Duration) error
+	WriteSnapshot(w io.Writer) error
+	Promote()
+}
+
+// heartbeatInterval is the period the leader reports its log position to
+// the followers without writes.
+const heartbeatInterval = time.Second
+
+var errNoReplication = errors.New("replication is not supported by the store")
+
+// statsHandler responds to GET /db/_stats with the store usage and the
+// replication state.
+func statsHandler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(res, http.StatusOK, store.Stats())
+	}
+}
+
+// replicationHandler streams the log entries following the position given
+// by the from parameter on GET /db/_replication?from=<n> until the client
+// disconnects. It responds with 409 when the entries after the position
+// were compacted and the follower needs a snapshot.
+func replicationHandler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		replicated, ok := store.(replicatedStore)
+		if !ok {
+			http.Error(res, errNoReplication.Error(), http.StatusNotImplemented)
+			return
+		}
+		from, err := strconv.ParseUint(req.URL.Query().Get("from"), 10, 64)
+		if err != nil {
+			http.Error(res, "Invalid log position", http.StatusBadRequest)
+			return
+		}
+		out := &lazyResponse{res: res}
+		err = replicated.WriteLog(req.Context(), out, from, heartbeatInterval)
+		switch {
+		case out.started:
+			// The status is already sent, the follower reconnects.
+			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, datastore.ErrClosed) {
+				log.Printf("Replication stream failed: %s", err)
+			}
+		case errors.Is(err, datastore.ErrLogCompacted):
+			http.Error(res, err.Error(), http.StatusConflict)
+		case err != nil:
+			writeStoreError(res, err, "Failed to read the log")
+		}
+	}
+}
+
+// stoppableStreams ends the replication streams served by h once stop is
+// done, so that a graceful shutdown of the server does not wait for the
+// followers to disconnect.
+func stoppableStreams(stop context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/db/_replication" {
+			ctx, cancel := context.WithCancel(req.Context())
+			defer context.AfterFunc(stop, cancel)()
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		h.ServeHTTP(res, req)
+	})
+}
+
+// lazyResponse sends the headers of the replication stream with its first
+// frame, so that the errors found before still get their status.
+type lazyResponse struct {
+	res     http.ResponseWriter
+	started bool
+}
+
+func (r *lazyResponse) Write(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.res.Header().Set("Content-Type", "application/octet-stream")
+		r.res.WriteHeader(http.StatusOK)
+	}
+	return r.res.Write(p)
+}
+
+func (r *lazyResponse) Flush() {
+	if flusher, ok := r.res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// snapshotHandler responds to GET /db/_replication/snapshot with the live
+// data of the store for the followers behind the compacted log.
+func snapshotHandler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		replicated, ok := store.(replicatedStore)
+		if !ok {
+			http.Error(res, errNoReplication.Error(), http.StatusNotImplemented)
+			return
+		}
+		res.Header().Set("Content-Type", "application/octet-stream")
+		if err := replicated.WriteSnapshot(res); err != nil {
+			log.Printf("Snapshot failed: %s", err)
+		}
+	}
+}
+
+// promoteHandler turns a follower into a leader on POST /db/_promote.
+func promoteHandler(store datastore.Store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		replicated, ok := store.(replicatedStore)
+		if !ok {
+			http.Error(res, errNoReplication.Error(), http.StatusNotImplemented)
+			return
+		}
+		replicated.Promote()
+		log.Printf("Promoted to the leader")
+		writeJSON(res, http.StatusOK, store.Stats().Replication)
+	}
+}
+
+// follower copies the log of the leader into a follower Db until it is
+// promoted.
+type follower struct {
+	db     *datastore.Db
+	leader string
+	client *http.Client
+	// token is the bearer token of the requests to the leader, if any.
+	token string
+	// retry is the delay before reconnecting to the leader.
+	retry time.Duration
+}
+
+func newFollower(db *datastore.Db, leader string) *follower {
+	return &follower{
+		db:     db,
+		leader: strings.TrimSuffix(leader, "/"),
+		client: http.DefaultClient,
+		retry:  time.Second,
+	}
+}
+
+// run follows the leader until ctx is done or the Db is promoted,
+// reconnecting after the failures.
+func (f *follower) run(ctx context.Context) {
+	for f.db.IsFollower() && ctx.Err() == nil {
+		err := f.follow(ctx)
+		if ctx.Err() != nil || errors.Is(err, datastore.ErrNotFollower) || errors.Is(err, datastore.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Replication from %s failed: %s", f.leader, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(f.retry):
+		}
+	}
+}
+
+// follow applies one replication stream of the leader, fetching a snapshot
+// first if the leader has no log after the position of the follower.
+func (f *follower) follow(ctx context.Context) error {
+	url := fmt.Sprintf("%s/db/_replication?from=%d", f.leader, f.db.Position())
+	body, err := f.get(ctx, url)
+	if errors.Is(err, errCompacted) {
+		snapshot, err := f.get(ctx, f.leader+"/db/_replication/snapshot")
+		if err != nil {
+			return err
+		}
+		defer snapshot.Close()
+		if err := f.db.ApplySnapshot(ctx, snapshot); err != nil {
+			return fmt.Errorf("applying the snapshot: %w", err)
+		}
+		log.Printf("Applied the snapshot of %s at %d", f.leader, f.db.Position())
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer body.Close()
+	return f.db.ApplyLog(ctx, body)
+}
+
+var errCompacted = errors.New("leader log is compacted")
+
+func (f *follower) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("%w: %s", errCompacted, strings.TrimSpace(string(message)))
+	}
+	return nil, fmt.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(message)))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestReplication(t *testing.T) {
+	leaderDb, err := datastore.NewDb(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaderDb.Close()
+	leader := httptest.NewServer(newHandler(leaderDb))
+	defer leader.Close()
+	lh := leader.Config.Handler
+
+	// The compacted log makes the follower start from a snapshot.
+	for _, key := range []string{"a", "b", "c"} {
+		if rec := doRequest(lh, "POST", "/db/"+key, `{"value":"`+key+`1"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 on put, got %d", rec.Code)
+		}
+	}
+	if rec := doRequest(lh, "DELETE", "/db/b", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on delete, got %d", rec.Code)
+	}
+	if err := leaderDb.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(lh, "GET", "/db/_replication?from=0", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a compacted position, got %d", rec.Code)
+	}
+
+	followerDb, err := datastore.NewDb(t.TempDir(), 256, datastore.Follower())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followerDb.Close()
+	fh := newHandler(followerDb)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	f := newFollower(followerDb, leader.URL)
+	f.retry = 10 * time.Millisecond
+	go func() {
+		defer close(done)
+		f.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if rec := doRequest(lh, "PUT", "/db/_buckets/team", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on bucket creation, got %d", rec.Code)
+	}
+	if rec := doRequest(lh, "POST", "/db/team/d", `{"value":"d1"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on put, got %d", rec.Code)
+	}
+	if rec := doRequest(lh, "PATCH", "/db/a", `{"operator":"append","operand":"+"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on merge, got %d", rec.Code)
+	}
+	if rec := doRequest(lh, "DELETE", "/db/c", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on delete, got %d", rec.Code)
+	}
+
+	waitFor(t, "the follower to catch up", func() bool {
+		return followerDb.Position() == leaderDb.Position()
+	})
+	expected := map[string]int{
+		"/db/a":      http.StatusOK,
+		"/db/b":      http.StatusNotFound,
+		"/db/c":      http.StatusNotFound,
+		"/db/team/d": http.StatusOK,
+	}
+	for path, status := range expected {
+		leaderRec, followerRec := doRequest(lh, "GET", path, ""), doRequest(fh, "GET", path, "")
+		if followerRec.Code != status || followerRec.Body.String() != leaderRec.Body.String() {
+			t.Errorf("%s: follower responded %d %s, leader %d %s", path,
+				followerRec.Code, followerRec.Body.String(), leaderRec.Code, leaderRec.Body.String())
+		}
+	}
+
+	if rec := doRequest(fh, "POST", "/db/e", `{"value":"e1"}`); rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected 421 on a follower write, got %d", rec.Code)
+	}
+	waitFor(t, "the lag to be reported", func() bool {
+		stats := replicationStats(t, fh)
+		return stats.Role == "follower" && stats.LeaderPosition == leaderDb.Position() && stats.Lag == 0
+	})
+
+	if rec := doRequest(fh, "POST", "/db/_promote", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on promotion, got %d", rec.Code)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The follower kept following after the promotion")
+	}
+	if rec := doRequest(fh, "POST", "/db/e", `{"value":"e1"}`); rec.Code != http.StatusCreated {
+		t.Errorf("Expected 201 on a promoted follower write, got %d", rec.Code)
+	}
+	if stats := replicationStats(t, fh); stats.Role != "leader" {
+		t.Errorf("Expected the leader role after the promotion, got %+v", stats)
+	}
+}
+
+func replicationStats(t *testing.T, h http.Handler) datastore.ReplicationStats {
+	t.Helper()
+	rec := doRequest(h, "GET", "/db/_stats", "")
+	var stats datastore.Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.Replication == nil {
+		t.Fatalf("Unexpected stats %d %s", rec.Code, rec.Body.String())
+	}
+	return *stats.Replication
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoppableStreams(t *testing.T) {
+	stop, cancel := context.WithCancel(context.Background())
+	done := make(chan string, 2)
+	h := stoppableStreams(stop, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		done <- req.URL.Path
+	}))
+
+	streamCtx, endStream := context.WithCancel(context.Background())
+	defer endStream()
+	otherCtx, endOther := context.WithCancel(context.Background())
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/db/_replication", nil).WithContext(streamCtx))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/db/key", nil).WithContext(otherCtx))
+
+	cancel()
+	select {
+	case path := <-done:
+		if path != "/db/_replication" {
+			t.Errorf("Expected only the replication stream to end, %s ended", path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The replication stream kept going after the stop")
+	}
+	endOther()
+	if path := <-done; path != "/db/key" {
+		t.Errorf("Unexpected request ended: %s", path)
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	// respMaxLine limits the inline commands and the headers of the requests.
+	respMaxLine = 64 << 10
+	// respMaxBulk limits a single argument of a command.
+	respMaxBulk = 64 << 20
+	// respMaxArgs limits the number of the arguments of a command.
+	respMaxArgs = 1 << 20
+	// respMaxCursors limits the unfinished scans of a connection.
+	respMaxCursors = 64
+)
+
+// respError is an error reply sent to the client.
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+var (
+	errRESPSyntax    = respError("ERR syntax error")
+	errRESPNotInt    = respError("ERR value is not an integer or out of range")
+	errRESPOverflow  = respError("ERR increment or decrement would overflow")
+	errRESPBadExpire = respError("ERR invalid expire time in 'set' command")
+	errRESPReadOnly  = respError("READONLY You can't write against a read only replica.")
+)
+
+// errProtocol is returned for the malformed requests, the connection is
+// closed after the error reply.
+var errProtocol = errors.New("Protocol error")
+
+// respServer serves a subset of the Redis RESP2 protocol over the default
+// bucket of the store: GET, SET with EX and PX, DEL, EXISTS, INCRBY, SCAN,
+// PING, INFO and QUIT. The requests of a connection are served in order and
+// the replies are flushed once the pipelined requests are read. The expiry
+// times set by SET are stored with the values, see expiringStore.
+type respServer struct {
+	tcp     tcpServer
+	store   datastore.Store
+	started time.Time
+
+	commands atomic.Int64
+}
+
+func newRESPServer(store datastore.Store) *respServer {
+	return &respServer{store: store, started: time.Now()}
+}
+
+// expiringStore is implemented by the stores keeping the expiry times of
+// the keys, see datastore.Db.PutExpiring.
+type expiringStore interface {
+	PutExpiringContext(ctx context.Context, key, value string, expires time.Time) error
+}
+
+var errNoExpiry = errors.New("expiry times are not supported by the store")
+
+// Serve accepts the connections until the server is closed.
+func (s *respServer) Serve(l net.Listener) error {
+	return s.tcp.serve(l, s.serveConn)
+}
+
+// Close stops accepting the connections, closes the open ones and waits
+// for their commands to finish.
+func (s *respServer) Close() error {
+	return s.tcp.close()
+}
+
+// respConn is the state of a client connection.
+type respConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+
+	// cursors maps the SCAN cursors given to the client to the last keys
+	// returned.
+	cursors    map[uint64]string
+	nextCursor uint64
+	quit       bool
+}
+
+func (s *respServer) serveConn(conn net.Conn) {
+	c := &respConn{
+		r:       bufio.NewReaderSize(conn, respMaxLine),
+		w:       bufio.NewWriter(conn),
+		cursors: make(map[uint64]string),
+	}
+	for !c.quit {
+		args, err := readCommand(c.r)
+		if errors.Is(err, errProtocol) {
+			writeError(c.w, fmt.Sprintf("ERR %s", err))
+			c.w.Flush()
+			return
+		} else if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("RESP connection from %s failed: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.commands.Add(1)
+		s.execute(c, args)
+		// The replies of the pipelined commands are sent together.
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings or an inline command. It
+// returns no arguments for an empty line.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: too big request line", errProtocol)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func (s *respServer) execute(c *respConn, args []string) {
+	name := strings.ToLower(args[0])
+	command, ok := respCommands[name]
+	if !ok {
+		writeError(c.w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < command.minArgs || (command.maxArgs > 0 && len(args) > command.maxArgs) {
+		writeError(c.w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	if err := command.run(s, c, args[1:]); err != nil {
+		writeError(c.w, respErrorMessage(err))
+	}
+}
+
+// respErrorMessage maps the store errors to the error replies.
+func respErrorMessage(err error) string {
+	var reply respError
+	switch {
+	case errors.As(err, &reply):
+		return reply.Error()
+	case errors.Is(err, datastore.ErrNotLeader):
+		return errRESPReadOnly.Error()
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return "OOM " + err.Error()
+	case errors.Is(err, datastore.ErrClosed):
+		return "ERR database is shutting down"
+	}
+	return "ERR " + err.Error()
+}
+
+// respCommand describes a command, the argument counts include the name of
+// the command, maxArgs is 0 for no limit.
+type respCommand struct {
+	minArgs, maxArgs int
+	run              func(s *respServer, c *respConn, args []string) error
+}
+
+var respCommands = map[string]respCommand{
+	"ping":   {1, 2, (*respServer).ping},
+	"quit":   {1, 1, (*respServer).quit},
+	"get":    {2, 2, (*respServer).get},
+	"set":    {3, 0, (*respServer).set},
+	"del":    {2, 0, (*respServer).del},
+	"exists": {2, 0, (*respServer).exists},
+	"incrby": {3, 3, (*respServer).incrBy},
+	"scan":   {2, 0, (*respServer).scan},
+	"info":   {1, 2, (*respServer).info},
+}
+
+func (s *respServer) ping(c *respConn, args []string) error {
+	if len(args) == 1 {
+		writeBulk(c.w, args[0])
+	} else {
+		writeSimple(c.w, "PONG")
+	}
+	return nil
+}
+
+func (s *respServer) quit(c *respConn, _ []string) error {
+	writeSimple(c.w, "OK")
+	c.quit = true
+	return nil
+}
+
+func (s *respServer) get(c *respConn, args []string) error {
+	value, err := s.store.Get(args[0])
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeNull(c.w)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	writeBulk(c.w, value)
+	return nil
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func (s *respServer) set(c *respConn, args []string) error {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for i := 2; i < len(args); i += 2 {
+		unit := time.Second
+		switch strings.ToLower(args[i]) {
+		case "ex":
+		case "px":
+			unit = time.Millisecond
+		default:
+			return errRESPSyntax
+		}
+		if ttl != 0 || i+1 == len(args) {
+			return errRESPSyntax
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return errRESPNotInt
+		}
+		if n <= 0 || n > math.MaxInt64/int64(unit) {
+			return errRESPBadExpire
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	if ttl != 0 {
+		expiring, ok := s.store.(expiringStore)
+		if !ok {
+			return errNoExpiry
+		}
+		if err := expiring.PutExpiringContext(context.Background(), key, value, time.Now().Add(ttl)); err != nil {
+			return err
+		}
+	} else if err := s.store.Put(key, value); err != nil {
+		return err
+	}
+	writeSimple(c.w, "OK")
+	return nil
+}
+
+func (s *respServer) del(c *respConn, args []string) error {
+	deleted := 0
+	for _, key := range args {
+		err := s.store.Delete(key)
+		if err == nil {
+			deleted++
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+	writeInt(c.w, int64(deleted))
+	return nil
+}
+
+func (s *respServer) exists(c *respConn, args []string) error {
+	found := 0
+	for _, key := range args {
+		_, err := s.store.Get(key)
+		if err == nil {
+			found++
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+	writeInt(c.w, int64(found))
+	return nil
+}
+
+// incrBy adds the increment with the add merge operator after checking the
+// current value for the overflow. The store rejects the merges into the
+// values other than numbers, so a failed increment leaves the key readable.
+// The reply is the value read after the merge.
+func (s *respServer) incrBy(c *respConn, args []string) error {
+	key := args[0]
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errRESPNotInt
+	}
+	merger, ok := s.store.(mergeStore)
+	if !ok {
+		return errNoMerge
+	}
+	value, err := s.store.Get(key)
+	var current int64
+	if err == nil {
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return errRESPNotInt
+		}
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return err
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return errRESPOverflow
+	}
+	err = merger.MergeContext(context.Background(), key, datastore.AddOperator, args[1])
+	if errors.Is(err, datastore.ErrMergeConflict) {
+		return errRESPNotInt
+	} else if err != nil {
+		return err
+	}
+	if value, err = s.store.Get(key); err != nil {
+		return err
+	}
+	result, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return errRESPNotInt
+	}
+	writeInt(c.w, result)
+	return nil
+}
+
+// errScanPage stops the scan once a page of keys is collected.
+var errScanPage = errors.New("page is full")
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. A call looks at
+// count keys at most and returns the matching ones. The cursors are valid on
+// the connection they are returned on, every key present during the whole
+// scan is returned once.
+func (s *respServer) scan(c *respConn, args []string) error {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRESPSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil {
+				return errRESPNotInt
+			}
+			if count < 1 {
+				return errRESPSyntax
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+	after, ok := "", true
+	if cursor != 0 {
+		if after, ok = c.cursors[cursor]; !ok {
+			return respError("ERR invalid cursor")
+		}
+		delete(c.cursors, cursor)
+	}
+
+	var keys []string
+	last, seen, more := "", 0, false
+	err = s.store.Scan(globPrefix(pattern), func(key, _ string) error {
+		if cursor != 0 && key <= after {
+			return nil
+		}
+		if seen == count {
+			more = true
+			return errScanPage
+		}
+		last, seen = key, seen+1
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errScanPage) {
+		return err
+	}
+
+	next := uint64(0)
+	if more {
+		if len(c.cursors) >= respMaxCursors {
+			clear(c.cursors)
+		}
+		c.nextCursor++
+		next = c.nextCursor
+		c.cursors[next] = last
+	}
+	writeArray(c.w, 2)
+	writeBulk(c.w, strconv.FormatUint(next, 10))
+	writeArray(c.w, len(keys))
+	for _, key := range keys {
+		writeBulk(c.w, key)
+	}
+	return nil
+}
+
+// info handles INFO [section].
+func (s *respServer) info(c *respConn, args []string) error {
+	stats := s.store.Stats()
+	clients, port := s.tcp.clients()
+	sections := []struct {
+		name   string
+		fields [][2]string
+	}{
+		{"Server", [][2]string{
+			{"redis_mode", "standalone"},
+			{"process_id", strconv.Itoa(os.Getpid())},
+			{"tcp_port", strconv.Itoa(port)},
+			{"uptime_in_seconds", strconv.Itoa(int(time.Since(s.started).Seconds()))},
+		}},
+		{"Clients", [][2]string{
+			{"connected_clients", strconv.Itoa(clients)},
+		}},
+		{"Stats", [][2]string{
+			{"total_connections_received", strconv.FormatInt(s.tcp.connections.Load(), 10)},
+			{"total_commands_processed", strconv.FormatInt(s.commands.Load(), 10)},
+		}},
+		{"Datastore", [][2]string{
+			{"segments", strconv.Itoa(stats.Segments)},
+			{"bytes", strconv.FormatInt(stats.Bytes, 10)},
+		}},
+		{"Keyspace", [][2]string{
+			{"db0", fmt.Sprintf("keys=%d,expires=%d", stats.Keys, stats.Expiring)},
+		}},
+	}
+
+	all := len(args) == 0 || strings.EqualFold(args[0], "all") || strings.EqualFold(args[0], "default")
+	var b strings.Builder
+	for _, section := range sections {
+		if !all && !strings.EqualFold(args[0], section.name) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", section.name)
+		for _, field := range section.fields {
+			fmt.Fprintf(&b, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+	writeBulk(c.w, b.String())
+	return nil
+}
+
+// globPrefix returns the literal prefix of the glob pattern.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches the string against the Redis glob pattern with the *,
+// ? and [...] wildcards and the \ escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// An unterminated class matches the bracket itself.
+				if s[0] != '[' {
+					return false
+				}
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+			class := pattern[1 : end+1]
+			if !matchClass(class, s[0]) {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches the byte against a [...] class like abc, ^abc or a-z.
+func matchClass(class string, b byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (b >= lo && b <= hi)
+			i += 2
+			continue
+		}
+		matched = matched || class[i] == b
+	}
+	return matched != negate
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, message string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
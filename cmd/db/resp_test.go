@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// respClient talks to the RESP listener over a raw TCP connection.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startRESP(t *testing.T, store datastore.Store) *respClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newRESPServer(store)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return dialRESP(t, l.Addr().String())
+}
+
+func dialRESP(t *testing.T, addr string) *respClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// command encodes the arguments as an array of bulk strings.
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// send writes the raw request and checks the raw replies.
+func (c *respClient) send(request, want string) {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, request); err != nil {
+		c.t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c.r, got); err != nil {
+		c.t.Fatalf("Failed to read %q: %s, got %q", want, err, got)
+	}
+	if string(got) != want {
+		c.t.Errorf("Expected %q in reply to %q, got %q", want, request, got)
+	}
+}
+
+func TestRESP(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := startRESP(t, db)
+
+	c.send(command("PING"), "+PONG\r\n")
+	c.send("PING hello\r\n", "$5\r\nhello\r\n")
+	c.send(command("GET", "key"), "$-1\r\n")
+	c.send(command("SET", "key", "v\r\n1"), "+OK\r\n")
+	c.send(command("get", "key"), "$4\r\nv\r\n1\r\n")
+	if value, _ := db.Get("key"); value != "v\r\n1" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+	c.send(command("EXISTS", "key", "missing", "key"), ":2\r\n")
+	c.send(command("DEL", "key", "missing"), ":1\r\n")
+	c.send(command("EXISTS", "key"), ":0\r\n")
+
+	c.send(command("INCRBY", "counter", "5"), ":5\r\n")
+	c.send(command("INCRBY", "counter", "-7"), ":-2\r\n")
+	c.send(command("SET", "text", "abc"), "+OK\r\n")
+	c.send(command("INCRBY", "text", "1"), "-ERR value is not an integer or out of range\r\n")
+	c.send(command("INCRBY", "counter", "x"), "-ERR value is not an integer or out of range\r\n")
+	c.send(command("GET", "text"), "$3\r\nabc\r\n")
+
+	c.send(command("GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+	c.send(command("SET", "key", "v", "NX"), "-ERR syntax error\r\n")
+	c.send(command("FLUSHALL"), "-ERR unknown command 'FLUSHALL'\r\n")
+
+	// Pipelined commands are answered in order.
+	c.send(command("SET", "a", "1")+command("INCRBY", "a", "2")+command("GET", "a")+command("DEL", "a")+command("GET", "a"),
+		"+OK\r\n:3\r\n$1\r\n3\r\n:1\r\n$-1\r\n")
+	var pipeline, replies strings.Builder
+	for i := 0; i < 500; i++ {
+		pipeline.WriteString(command("SET", fmt.Sprintf("p%03d", i), "v"))
+		replies.WriteString("+OK\r\n")
+	}
+	c.send(pipeline.String(), replies.String())
+
+	// SCAN returns every key once, COUNT keys are looked at per call.
+	seen := make(map[string]int)
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 200 {
+			t.Fatal("SCAN does not finish")
+		}
+		c.conn.Write([]byte(command("SCAN", cursor, "MATCH", "p*", "COUNT", "7")))
+		reply := readReply(t, c.r).([]any)
+		cursor = reply[0].(string)
+		keys := reply[1].([]any)
+		if len(keys) > 7 {
+			t.Errorf("Expected at most 7 keys, got %d", len(keys))
+		}
+		for _, key := range keys {
+			seen[key.(string)]++
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 500 {
+		t.Errorf("Expected 500 keys scanned, got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("Key %s scanned %d times", key, n)
+		}
+	}
+	c.send(command("SCAN", "0", "MATCH", "p01[0-2]", "COUNT", "1000"), "*2\r\n$1\r\n0\r\n*3\r\n$4\r\np010\r\n$4\r\np011\r\n$4\r\np012\r\n")
+	c.send(command("SCAN", "12345"), "-ERR invalid cursor\r\n")
+
+	c.conn.Write([]byte(command("INFO", "keyspace")))
+	if info := readReply(t, c.r).(string); !strings.Contains(info, "# Keyspace\r\ndb0:keys=502,expires=0\r\n") || strings.Contains(info, "# Server") {
+		t.Errorf("Unexpected info %q", info)
+	}
+
+	c.send(command("QUIT"), "+OK\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection closed after QUIT, got %v", err)
+	}
+}
+
+func TestRESP_Expiry(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := startRESP(t, db)
+
+	c.send(command("SET", "short", "v", "PX", "50"), "+OK\r\n")
+	c.send(command("SET", "long", "v", "EX", "100"), "+OK\r\n")
+	c.send(command("SET", "reset", "v", "PX", "50")+command("SET", "reset", "kept"), "+OK\r\n+OK\r\n")
+	c.send(command("GET", "short"), "$1\r\nv\r\n")
+	time.Sleep(100 * time.Millisecond)
+	c.send(command("GET", "short"), "$-1\r\n")
+	c.send(command("EXISTS", "short", "long", "reset"), ":2\r\n")
+	c.send(command("GET", "reset"), "$4\r\nkept\r\n")
+
+	// The expired keys are deleted from the store without being read.
+	c.send(command("SET", "unread", "v", "PX", "10"), "+OK\r\n")
+	waitFor(t, "the expired key to be deleted", func() bool {
+		return db.Stats().Expiring == 1
+	})
+
+	// A write through the other APIs replaces the expiry time.
+	c.send(command("SET", "replaced", "v", "PX", "50"), "+OK\r\n")
+	if err := db.Put("replaced", "http"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.send(command("GET", "replaced"), "$4\r\nhttp\r\n")
+
+	c.send(command("SET", "key", "v", "EX", "0"), "-ERR invalid expire time in 'set' command\r\n")
+	c.send(command("SET", "key", "v", "EX", "x"), "-ERR value is not an integer or out of range\r\n")
+	c.send(command("SET", "key", "v", "EX"), "-ERR syntax error\r\n")
+
+	// The expiry times survive the restart.
+	c.send(command("SET", "restarted", "v", "PX", "300"), "+OK\r\n")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c = startRESP(t, db)
+	c.conn.Write([]byte(command("INFO", "keyspace")))
+	if info := readReply(t, c.r).(string); !strings.Contains(info, "db0:keys=4,expires=2\r\n") {
+		t.Errorf("Unexpected info %q", info)
+	}
+	waitFor(t, "the key to expire after the restart", func() bool {
+		_, err := db.Get("restarted")
+		return err == datastore.ErrNotFound
+	})
+	c.send(command("GET", "long"), "$1\r\nv\r\n")
+
+	c = startRESP(t, datastore.NewMemoryStore())
+	c.send(command("SET", "key", "v", "EX", "1"), "-ERR expiry times are not supported by the store\r\n")
+}
+
+func TestRESP_ProtocolError(t *testing.T) {
+	c := startRESP(t, datastore.NewMemoryStore())
+	c.send("*1\r\n+PING\r\n", "-ERR Protocol error: expected '$', got '+'\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection closed after a protocol error, got %v", err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*a*b", "xxaxxb", true},
+		{"*a*b", "xxaxxbc", false},
+	} {
+		if globMatch(tc.pattern, tc.s) != tc.match {
+			t.Errorf("Expected globMatch(%q, %q) = %t", tc.pattern, tc.s, tc.match)
+		}
+	}
+	if globPrefix("user:*") != "user:" || globPrefix(`a\*`) != "a" {
+		t.Error("Unexpected glob prefixes")
+	}
+}
+
+// readReply reads a bulk string, an integer or an array of them.
+func readReply(t *testing.T, r *bufio.Reader) any {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	var n int
+	fmt.Sscan(line[1:], &n)
+	switch line[0] {
+	case '$':
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return string(data[:n])
+	case '*':
+		items := make([]any, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return items
+	case ':':
+		return n
+	}
+	t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpServer accepts the connections of a TCP protocol and tracks them, so
+// that closing the server closes them and waits for their handlers.
+type tcpServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	port     int
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+
+	connections atomic.Int64
+}
+
+// serve calls handle in a new goroutine for every accepted connection until
+// the server is closed. The connection is closed once handle returns.
+func (s *tcpServer) serve(l net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		s.port = addr.Port
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		s.connections.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// close stops accepting the connections, closes the open ones and waits for
+// their handlers to return.
+func (s *tcpServer) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+	return err
+}
+
+// clients returns the number of the open connections and the port the
+// server listens on.
+func (s *tcpServer) clients() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.port
+}
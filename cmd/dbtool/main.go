@@ -0,0 +1,288 @@
+// Command dbtool inspects and repairs datastore directories of the db service.
+//
+// The segments, dump, verify and export commands open the directory read-only
+// and can run next to a live server. The compact and import commands need the
+// server to be stopped, repair never modifies the damaged directory.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const defaultSegmentSize = 10 * 1024 * 1024
+
+type command struct {
+	description string
+	run         func(args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"segments": {"list the segments and their stats", segmentsCommand},
+	"dump":     {"print the records as JSON lines", dumpCommand},
+	"verify":   {"check the checksums and the index consistency", verifyCommand},
+	"compact":  {"merge all the segments into one", compactCommand},
+	"repair":   {"copy the readable records into a new directory", repairCommand},
+	"export":   {"print the live keys as JSON lines", exportCommand},
+	"import":   {"store the JSON lines of a file or stdin", importCommand},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage())
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage())
+	}
+	return cmd.run(args[1:], out)
+}
+
+func usage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("usage: dbtool <command> -dir <data directory> [flags]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-10s %s\n", name, commands[name].description)
+	}
+	return b.String()
+}
+
+// parseFlags parses the command flags and returns the data directory.
+func parseFlags(fs *flag.FlagSet, args []string) (string, error) {
+	dir := fs.String("dir", "", "datastore directory")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if *dir == "" {
+		return "", fmt.Errorf("%s: -dir is required", fs.Name())
+	}
+	return *dir, nil
+}
+
+func openReadOnly(dir string) (*datastore.Db, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return datastore.NewDb(dir, defaultSegmentSize, datastore.ReadOnly())
+}
+
+func segmentsCommand(args []string, out io.Writer) error {
+	dir, err := parseFlags(flag.NewFlagSet("segments", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tSIZE\tKEYS\tENTRIES\tTOMBSTONES")
+	for _, segment := range db.Segments() {
+		entries, tombstones := 0, 0
+		err := datastore.ScanSegment(segment.Path, func(r datastore.Record) error {
+			entries++
+			if r.Deleted {
+				tombstones++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\n", segment.ID, segment.Path, segment.Size, segment.Keys, entries, tombstones)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	stats := db.Stats()
+	_, err = fmt.Fprintf(out, "\n%d live keys in %d segments, %d bytes\n", stats.Keys, stats.Segments, stats.Bytes)
+	return err
+}
+
+func dumpCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	only := fs.Int("segment", -1, "dump only the segment with this number")
+	dir, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	type dumpedRecord struct {
+		Segment int `json:"segment"`
+		datastore.Record
+	}
+	encoder := json.NewEncoder(out)
+	for _, segment := range db.Segments() {
+		if *only >= 0 && segment.ID != *only {
+			continue
+		}
+		err := datastore.ScanSegment(segment.Path, func(r datastore.Record) error {
+			return encoder.Encode(dumpedRecord{segment.ID, r})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyCommand(args []string, out io.Writer) error {
+	dir, err := parseFlags(flag.NewFlagSet("verify", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.Verify(); err != nil {
+		return fmt.Errorf("verification failed:\n%w", err)
+	}
+	stats := db.Stats()
+	_, err = fmt.Fprintf(out, "OK: %d segments, %d live keys\n", stats.Segments, stats.Keys)
+	return err
+}
+
+func compactCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	segmentSize := fs.Int64("segment-size", defaultSegmentSize, "segment size in bytes for the following writes")
+	keepVersions := fs.Int("keep-versions", 0, "number of the latest versions of every key to keep")
+	keepFor := fs.Duration("keep-for", 0, "keep the versions of the keys written within this period")
+	dir, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	db, err := datastore.NewDb(dir, *segmentSize, datastore.Exclusive(), datastore.WithHistory(*keepVersions, *keepFor))
+	if err != nil {
+		return err
+	}
+
+	before := db.Stats()
+	if err := db.Compact(); err != nil {
+		db.Close()
+		return err
+	}
+	after := db.Stats()
+	if err := db.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Compacted %d segments (%d bytes) into %d segments (%d bytes), %d live keys\n",
+		before.Segments, before.Bytes, after.Segments, after.Bytes, after.Keys)
+	return err
+}
+
+func repairCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	outDir := fs.String("out", "", "directory for the repaired datastore, must be empty")
+	segmentSize := fs.Int64("segment-size", defaultSegmentSize, "segment size in bytes of the repaired datastore")
+	dir, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *outDir == "" {
+		return errors.New("repair: -out is required")
+	}
+
+	report, err := datastore.Repair(dir, *outDir, *segmentSize)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Copied %d records to %s, skipped %d damaged bytes\n", report.Entries, *outDir, report.SkippedBytes)
+	return err
+}
+
+func exportCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	bucketName := fs.String("bucket", datastore.DefaultBucket, "bucket to export")
+	dir, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	bucket, err := db.Bucket(*bucketName)
+	if err != nil {
+		return err
+	}
+	return bucket.Export(out)
+}
+
+func importCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := fs.String("in", "-", "JSON lines file to import, - for stdin")
+	segmentSize := fs.Int64("segment-size", defaultSegmentSize, "segment size in bytes for the imported data")
+	bucketName := fs.String("bucket", datastore.DefaultBucket, "bucket to import into, created if missing")
+	dir, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := datastore.NewDb(dir, *segmentSize)
+	if err != nil {
+		return err
+	}
+	bucket, err := db.Bucket(*bucketName)
+	if errors.Is(err, datastore.ErrBucketNotFound) {
+		bucket, err = db.CreateBucket(*bucketName, 0)
+	}
+	var imported int
+	if err == nil {
+		imported, err = bucket.Import(r)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("imported %d records: %w", imported, err)
+	}
+	_, err = fmt.Fprintf(out, "Imported %d records\n", imported)
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func createDb(t *testing.T) string {
+	dir := t.TempDir()
+	db, err := datastore.NewDb(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key3", "key1"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDbTool(t *testing.T) {
+	dir := createDb(t)
+
+	var out bytes.Buffer
+	if err := run([]string{"segments", "-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "2 live keys") {
+		t.Errorf("Unexpected segments output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := run([]string{"dump", "-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 dumped records, got:\n%s", out.String())
+	}
+	var last struct {
+		Key     string `json:"key"`
+		Deleted bool   `json:"deleted"`
+	}
+	if err := json.Unmarshal([]byte(lines[4]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Key != "key2" || !last.Deleted {
+		t.Errorf("Expected the last record to delete key2, got %s", lines[4])
+	}
+
+	out.Reset()
+	if err := run([]string{"verify", "-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := run([]string{"compact", "-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "into 2 segments") {
+		t.Errorf("Unexpected compact output: %s", out.String())
+	}
+
+	repaired := filepath.Join(t.TempDir(), "repaired")
+	out.Reset()
+	if err := run([]string{"repair", "-dir", dir, "-out", repaired}, &out); err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(repaired, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key1"); err != nil || value != "value-key1" {
+		t.Errorf("Unexpected repaired value of key1: %q, %v", value, err)
+	}
+}
+
+func TestDbTool_ExportImport(t *testing.T) {
+	dir := createDb(t)
+
+	var out bytes.Buffer
+	if err := run([]string{"export", "-dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "\n") != 2 {
+		t.Fatalf("Expected 2 exported records, got:\n%s", out.String())
+	}
+	file := filepath.Join(t.TempDir(), "export.jsonl")
+	if err := os.WriteFile(file, out.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	out.Reset()
+	if err := run([]string{"import", "-dir", target, "-in", file, "-bucket", "copy"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Imported 2 records\n" {
+		t.Errorf("Unexpected import output: %s", out.String())
+	}
+	db, err := datastore.NewDb(target, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bucket, err := db.Bucket("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := bucket.Get("key3"); err != nil || value != "value-key3" {
+		t.Errorf("Unexpected imported value of key3: %q, %v", value, err)
+	}
+}
+
+func TestDbTool_Usage(t *testing.T) {
+	if err := run(nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Errorf("Expected usage, got %v", err)
+	}
+	if err := run([]string{"dump"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error without -dir")
+	}
+}
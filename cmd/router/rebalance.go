@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/sharding"
+)
+
+// rebalanceStatus describes the last rebalancing.
+type rebalanceStatus struct {
+	Running bool   `json:"running"`
+	Moved   int    `json:"moved"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ringInfo is the response of GET /router/ring, previous lists the nodes of
+// the ring being left while rebalancing.
+type ringInfo struct {
+	Nodes     []sharding.Node `json:"nodes"`
+	Previous  []sharding.Node `json:"previous,omitempty"`
+	Rebalance rebalanceStatus `json:"rebalance"`
+}
+
+func (r *router) info() ringInfo {
+	info := ringInfo{Nodes: r.ring.Nodes()}
+	if r.previous != nil {
+		info.Previous = r.previous.Nodes()
+	}
+	r.statusMu.Lock()
+	info.Rebalance = r.rebalance
+	r.statusMu.Unlock()
+	return info
+}
+
+// serveRing describes the ring on GET /router/ring.
+func (r *router) serveRing(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	writeJSON(res, http.StatusOK, r.info())
+}
+
+// serveNodes lists the nodes on GET /router/nodes, adds a node on
+// POST /router/nodes with a {"name": ..., "url": ...} body and removes one
+// on DELETE /router/nodes/<name>. A change starts the rebalancing, the next
+// change is rejected until it is done.
+func (r *router) serveNodes(res http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/router/nodes"), "/")
+	switch {
+	case req.Method == "GET" && name == "":
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		writeJSON(res, http.StatusOK, r.ring.Nodes())
+		return
+	case req.Method == "POST" && name == "", req.Method == "DELETE" && name != "":
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var node sharding.Node
+	if req.Method == "POST" {
+		body, ok := readBody(res, req, maxDefinitionBody)
+		if !ok {
+			return
+		}
+		if err := json.Unmarshal(body, &node); err != nil {
+			http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		node.URL = strings.TrimSuffix(node.URL, "/")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.previous != nil {
+		http.Error(res, "Rebalancing is in progress", http.StatusConflict)
+		return
+	}
+	var ring *sharding.Ring
+	var err error
+	if req.Method == "POST" {
+		if ring, err = r.ring.Add(node); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The keys moved on access need their buckets on the new node.
+		if err := r.copyBuckets(req.Context(), r.ring.Nodes(), node); err != nil {
+			http.Error(res, fmt.Sprintf("Failed to create the buckets on %s: %s", node.Name, err), http.StatusBadGateway)
+			return
+		}
+	} else if ring, err = r.ring.Remove(name); err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.previous, r.ring = r.ring, ring
+	r.startRebalance()
+	writeJSON(res, http.StatusAccepted, r.info())
+}
+
+// serveRebalance restarts the failed rebalancing on POST /router/rebalance.
+func (r *router) serveRebalance(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statusMu.Lock()
+	running := r.rebalance.Running
+	r.statusMu.Unlock()
+	if r.previous == nil || running {
+		writeJSON(res, http.StatusOK, r.info())
+		return
+	}
+	r.startRebalance()
+	writeJSON(res, http.StatusAccepted, r.info())
+}
+
+// startRebalance starts moving the keys from the previous ring to the
+// current one. It must be called with r.mu locked.
+func (r *router) startRebalance() {
+	r.statusMu.Lock()
+	r.rebalance = rebalanceStatus{Running: true}
+	r.statusMu.Unlock()
+	go r.migrate(r.previous, r.ring)
+}
+
+// migrate moves the keys owned by other nodes in the ring to them and
+// leaves the previous ring once all of them are moved.
+func (r *router) migrate(previous, ring *sharding.Ring) {
+	err := r.moveKeys(context.Background(), previous, ring)
+
+	r.statusMu.Lock()
+	r.rebalance.Running = false
+	if err != nil {
+		r.rebalance.Error = err.Error()
+	}
+	moved := r.rebalance.Moved
+	r.statusMu.Unlock()
+	if err != nil {
+		log.Printf("Rebalancing failed after moving %d keys: %s", moved, err)
+		return
+	}
+
+	r.mu.Lock()
+	if r.previous == previous {
+		r.previous = nil
+	}
+	r.mu.Unlock()
+	log.Printf("Rebalancing done, moved %d keys", moved)
+}
+
+// moveKeys streams the keys of every bucket of the previous nodes and moves
+// the ones owned by another node in the ring.
+func (r *router) moveKeys(ctx context.Context, previous, ring *sharding.Ring) error {
+	buckets, err := r.listBuckets(ctx, previous.Nodes())
+	if err != nil {
+		return err
+	}
+	names := []string{""}
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	for _, node := range previous.Nodes() {
+		for _, bucket := range names {
+			keys, err := r.movingKeys(ctx, node, bucket, ring)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				ringKey := sharding.Key(bucket, key)
+				unlock := r.lock(ringKey)
+				err := r.moveKey(ctx, bucket, key, node, ring.Owner(ringKey))
+				unlock()
+				if err != nil {
+					return fmt.Errorf("failed to move %q from %s: %w", ringKey, node.Name, err)
+				}
+				r.statusMu.Lock()
+				r.rebalance.Moved++
+				r.statusMu.Unlock()
+			}
+		}
+	}
+	return nil
+}
+
+// movingKeys returns the keys of the bucket on the node which the ring
+// places on other nodes. The export is read to the end before any key is
+// moved, so that the moves do not interfere with it.
+func (r *router) movingKeys(ctx context.Context, node sharding.Node, bucket string, ring *sharding.Ring) ([]string, error) {
+	path := "/db/_export"
+	if bucket != "" {
+		path += "?bucket=" + url.QueryEscape(bucket)
+	}
+	resp, err := r.call(ctx, "GET", node, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("db node %s responded %s to the export", node.Name, resp.Status)
+	}
+	var keys []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var record datastore.ExportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read the export of %s: %w", node.Name, err)
+		}
+		if ring.Owner(sharding.Key(bucket, record.Key)).Name != node.Name {
+			keys = append(keys, record.Key)
+		}
+	}
+}
+
+// moveKey copies the key to the node unless it is already there and deletes
+// it from the node it is moved from. A missing key has been moved already.
+// It must be called with the lock of the key held.
+func (r *router) moveKey(ctx context.Context, bucket, key string, from, to sharding.Node) error {
+	path := keyPath(bucket, key)
+	var record datastore.ExportRecord
+	found, err := r.getKey(ctx, from, path, &record)
+	if err != nil || !found {
+		return err
+	}
+	var existing datastore.ExportRecord
+	if found, err = r.getKey(ctx, to, path, &existing); err != nil {
+		return err
+	}
+	if !found {
+		body, _ := json.Marshal(map[string]string{"value": record.Value})
+		resp, err := r.call(ctx, "POST", to, path, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("db node %s responded %s to the put", to.Name, resp.Status)
+		}
+	}
+	resp, err := r.call(ctx, "DELETE", from, path, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("db node %s responded %s to the delete", from.Name, resp.Status)
+	}
+	return nil
+}
+
+// getKey reads the key from the node, found is false when it is missing.
+func (r *router) getKey(ctx context.Context, node sharding.Node, path string, record *datastore.ExportRecord) (bool, error) {
+	resp, err := r.call(ctx, "GET", node, path, nil)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return false, nil
+	}
+	return true, decodeResponse(node, resp, record)
+}
+
+// copyBuckets creates the buckets of the nodes on the new one.
+func (r *router) copyBuckets(ctx context.Context, nodes []sharding.Node, to sharding.Node) error {
+	buckets, err := r.listBuckets(ctx, nodes)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		body, _ := json.Marshal(map[string]int64{"quota": bucket.Quota})
+		resp, err := r.call(ctx, "PUT", to, "/db/_buckets/"+url.PathEscape(bucket.Name), body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("db node %s responded %s to the bucket %s", to.Name, resp.Status, bucket.Name)
+		}
+	}
+	return nil
+}
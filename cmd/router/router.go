@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/sharding"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+var (
+	port   = flag.Int("port", 8084, "router port")
+	nodes  = flag.String("nodes", "", "db nodes as name=URL pairs separated by commas")
+	vnodes = flag.Int("vnodes", sharding.DefaultVirtualNodes, "number of the ring points of every db node")
+	token  = flag.String("token", os.Getenv("DB_TOKEN"), "admin token of the db nodes moving the keys and of the /router/ endpoints, $DB_TOKEN by default")
+)
+
+const (
+	// maxDefinitionBody limits the bodies of the node and the bucket
+	// definitions.
+	maxDefinitionBody = 64 << 10
+	// maxImportBody limits the imports, they are split between the nodes
+	// in memory.
+	maxImportBody = 256 << 20
+)
+
+func main() {
+	flag.Parse()
+
+	initial, err := parseNodes(*nodes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ring, err := sharding.NewRing(*vnodes, initial...)
+	if err != nil {
+		log.Fatalf("Failed to build the ring: %v", err)
+	}
+
+	r := newRouter(ring, http.DefaultClient)
+	r.token = *token
+	server := httptools.CreateServer(*port, r)
+	go server.Start()
+	log.Printf("Router started on port %d for %d db nodes", *port, len(initial))
+
+	signal.WaitForTerminationSignal()
+}
+
+// parseNodes parses the name=URL pairs separated by commas.
+func parseNodes(list string) ([]sharding.Node, error) {
+	var nodes []sharding.Node
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid db node %q, expected name=URL", pair)
+		}
+		nodes = append(nodes, sharding.Node{Name: name, URL: strings.TrimSuffix(addr, "/")})
+	}
+	return nodes, nil
+}
+
+// keyLocks is the number of the locks serializing the requests for the
+// moving keys with their migration.
+const keyLocks = 64
+
+// router sends the requests for every key to the db node owning it. While
+// the ring changes, previous is the ring being left and the keys owned by
+// different nodes in the two rings are moved by the rebalancing, or by the
+// first request for them, under the lock of the key. The router must be the
+// only client writing to the db nodes.
+type router struct {
+	client *http.Client
+	// token is the bearer token of the requests of the router itself, the
+	// requests made for a client carry its own token.
+	token string
+
+	// mu guards the rings. The requests hold it for reading until they are
+	// done, so that a ring change waits for the requests routed by the
+	// previous ring.
+	mu       sync.RWMutex
+	ring     *sharding.Ring
+	previous *sharding.Ring
+
+	statusMu  sync.Mutex
+	rebalance rebalanceStatus
+
+	locks [keyLocks]sync.Mutex
+}
+
+func newRouter(ring *sharding.Ring, client *http.Client) *router {
+	return &router{ring: ring, client: client}
+}
+
+// ServeHTTP routes /db/[<bucket>/]<key> to the owner of the key, handles
+// the bucket definitions, the export and the import of all the nodes and
+// the ring changes on /router/. The /router/ endpoints need the token of
+// the router, as the ring changes send it and the keys to the added nodes.
+func (r *router) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/router/") && !r.authorized(req):
+		res.Header().Set("WWW-Authenticate", `Bearer realm="router"`)
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+	case path == "/router/ring":
+		r.serveRing(res, req)
+	case path == "/router/nodes" || strings.HasPrefix(path, "/router/nodes/"):
+		r.serveNodes(res, req)
+	case path == "/router/rebalance":
+		r.serveRebalance(res, req)
+	case path == "/db/_buckets" || strings.HasPrefix(path, "/db/_buckets/"):
+		r.serveBuckets(res, forClient(req))
+	case path == "/db/_export":
+		r.serveExport(res, forClient(req))
+	case path == "/db/_import":
+		r.serveImport(res, forClient(req))
+	case strings.HasPrefix(path, "/db/_"):
+		http.Error(res, "Not supported by the router", http.StatusNotFound)
+	case strings.HasPrefix(path, "/db/"):
+		r.serveKey(res, req)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// serveKey proxies the request for a key to its owner. A key moving to
+// another node is moved first.
+func (r *router) serveKey(res http.ResponseWriter, req *http.Request) {
+	bucket, key, err := parseKeyPath(req.URL.EscapedPath())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ringKey := sharding.Key(bucket, key)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	owner := r.ring.Owner(ringKey)
+	if r.previous != nil {
+		if from := r.previous.Owner(ringKey); from.Name != owner.Name {
+			unlock := r.lock(ringKey)
+			defer unlock()
+			if err := r.moveKey(req.Context(), bucket, key, from, owner); err != nil {
+				log.Printf("Failed to move %q from %s to %s: %s", ringKey, from.Name, owner.Name, err)
+				http.Error(res, "Failed to move the key to its new node", http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	r.proxy(res, req, owner)
+}
+
+func (r *router) proxy(res http.ResponseWriter, req *http.Request, node sharding.Node) {
+	target, err := url.Parse(node.URL)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Invalid URL of the db node %s", node.Name), http.StatusInternalServerError)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(p *httputil.ProxyRequest) {
+			p.SetURL(target)
+			p.SetXForwarded()
+		},
+		Transport: r.client.Transport,
+	}
+	proxy.ServeHTTP(res, req)
+}
+
+// authorized reports whether the request carries the token of the router.
+// Without a token the /router/ endpoints are disabled. The hashes are
+// compared in constant time.
+func (r *router) authorized(req *http.Request) bool {
+	secret, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || r.token == "" {
+		return false
+	}
+	got := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	want := sha256.Sum256([]byte(r.token))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+func (r *router) lock(ringKey string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(ringKey))
+	l := &r.locks[h.Sum32()%keyLocks]
+	l.Lock()
+	return l.Unlock
+}
+
+// parseKeyPath extracts the unescaped bucket and key from the escaped
+// /db/[<bucket>/]<key>[/history] path the way the db service does.
+func parseKeyPath(escaped string) (string, string, error) {
+	segments := strings.Split(strings.TrimPrefix(escaped, "/db/"), "/")
+	if len(segments) > 1 && segments[len(segments)-1] == "history" {
+		segments = segments[:len(segments)-1]
+	}
+	if len(segments) > 2 || segments[len(segments)-1] == "" {
+		return "", "", errors.New("Key must be a single URL-escaped path segment")
+	}
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", "", errors.New("Key is not properly escaped")
+		}
+		segments[i] = unescaped
+	}
+	if len(segments) == 1 {
+		return "", segments[0], nil
+	}
+	return segments[0], segments[1], nil
+}
+
+// keyPath is the escaped path of the key on a db node. A key named history
+// gets an escaped letter not to be taken for the history of a key.
+func keyPath(bucket, key string) string {
+	escaped := url.PathEscape(key)
+	if escaped == "history" {
+		escaped = "%68istory"
+	}
+	if bucket == "" {
+		return "/db/" + escaped
+	}
+	return "/db/" + url.PathEscape(bucket) + "/" + escaped
+}
+
+// allNodes returns the nodes of both rings. It must be called with r.mu
+// held.
+func (r *router) allNodes() []sharding.Node {
+	nodes := r.ring.Nodes()
+	if r.previous != nil {
+		for _, n := range r.previous.Nodes() {
+			if !containsNode(nodes, n.Name) {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes
+}
+
+func containsNode(nodes []sharding.Node, name string) bool {
+	for _, n := range nodes {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveBuckets defines the buckets on all the nodes and sums up their usage.
+func (r *router) serveBuckets(res http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := r.allNodes()
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/db/_buckets"), "/")
+
+	switch req.Method {
+	case "GET":
+		buckets, err := r.listBuckets(req.Context(), nodes)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if name == "" {
+			writeJSON(res, http.StatusOK, buckets)
+			return
+		}
+		for _, bucket := range buckets {
+			if bucket.Name == name {
+				writeJSON(res, http.StatusOK, bucket)
+				return
+			}
+		}
+		http.Error(res, fmt.Sprintf("%s: %s", datastore.ErrBucketNotFound, name), http.StatusNotFound)
+
+	case "PUT":
+		body, ok := readBody(res, req, maxDefinitionBody)
+		if !ok {
+			return
+		}
+		status := http.StatusOK
+		for _, node := range nodes {
+			resp, err := r.call(req.Context(), "PUT", node, req.URL.EscapedPath(), body)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusBadGateway)
+				return
+			}
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusCreated:
+				status = http.StatusCreated
+			case http.StatusOK:
+			default:
+				http.Error(res, fmt.Sprintf("db node %s responded %s", node.Name, resp.Status), resp.StatusCode)
+				return
+			}
+		}
+		buckets, err := r.listBuckets(req.Context(), nodes)
+		for _, bucket := range buckets {
+			if bucket.Name == name {
+				writeJSON(res, status, bucket)
+				return
+			}
+		}
+		if err == nil {
+			err = errors.New("bucket is missing after its creation")
+		}
+		http.Error(res, err.Error(), http.StatusBadGateway)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listBuckets sums up the buckets of the nodes.
+func (r *router) listBuckets(ctx context.Context, nodes []sharding.Node) ([]datastore.BucketInfo, error) {
+	byName := make(map[string]*datastore.BucketInfo)
+	for _, node := range nodes {
+		var buckets []datastore.BucketInfo
+		if err := r.getJSON(ctx, node, "/db/_buckets", &buckets); err != nil {
+			return nil, err
+		}
+		for _, bucket := range buckets {
+			if total, ok := byName[bucket.Name]; ok {
+				total.Keys += bucket.Keys
+				total.Bytes += bucket.Bytes
+			} else {
+				byName[bucket.Name] = &bucket
+			}
+		}
+	}
+	list := make([]datastore.BucketInfo, 0, len(byName))
+	for _, bucket := range byName {
+		list = append(list, *bucket)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// serveExport concatenates the exports of all the nodes. The keys are in
+// order within the part of every node only.
+func (r *router) serveExport(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.previous != nil {
+		http.Error(res, "Rebalancing is in progress", http.StatusConflict)
+		return
+	}
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	for i, node := range r.ring.Nodes() {
+		resp, err := r.call(req.Context(), "GET", node, "/db/_export?"+req.URL.RawQuery, nil)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("db node %s responded %s", node.Name, resp.Status)
+		}
+		if err != nil {
+			if i == 0 {
+				http.Error(res, err.Error(), http.StatusBadGateway)
+			} else {
+				// The status is already sent, the client sees a truncated stream.
+				log.Printf("Export failed: %s", err)
+			}
+			return
+		}
+		_, err = io.Copy(res, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Export failed: %s", err)
+			return
+		}
+	}
+}
+
+// serveImport splits the imported JSON lines between the nodes.
+func (r *router) serveImport(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.previous != nil {
+		http.Error(res, "Rebalancing is in progress", http.StatusConflict)
+		return
+	}
+	bucket := req.URL.Query().Get("bucket")
+	parts := make(map[string]*bytes.Buffer)
+	lines := bufio.NewScanner(http.MaxBytesReader(res, req.Body, maxImportBody))
+	lines.Buffer(nil, 16<<20)
+	for lines.Scan() {
+		line := bytes.TrimSpace(lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record datastore.ExportRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			http.Error(res, fmt.Sprintf("%s: %s", datastore.ErrInvalidImport, err), http.StatusBadRequest)
+			return
+		}
+		owner := r.ring.Owner(sharding.Key(bucket, record.Key)).Name
+		if parts[owner] == nil {
+			parts[owner] = &bytes.Buffer{}
+		}
+		parts[owner].Write(line)
+		parts[owner].WriteByte('\n')
+	}
+	var tooLarge *http.MaxBytesError
+	if err := lines.Err(); errors.As(err, &tooLarge) {
+		http.Error(res, fmt.Sprintf("Request is over %d bytes", maxImportBody), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(res, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	imported := 0
+	for _, node := range r.ring.Nodes() {
+		part := parts[node.Name]
+		if part == nil {
+			continue
+		}
+		var result struct {
+			Imported int `json:"imported"`
+		}
+		resp, err := r.call(req.Context(), "POST", node, "/db/_import?"+req.URL.RawQuery, part.Bytes())
+		if err == nil {
+			err = decodeResponse(node, resp, &result)
+		}
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Imported %d records: %s", imported, err), http.StatusBadGateway)
+			return
+		}
+		imported += result.Imported
+	}
+	writeJSON(res, http.StatusOK, map[string]int{"imported": imported})
+}
+
+// readBody reads the request body of at most limit bytes. It responds with
+// 413 or 400 and returns false if the body is rejected.
+func readBody(res http.ResponseWriter, req *http.Request, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(res, fmt.Sprintf("Request is over %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(res, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+type authorizationKey struct{}
+
+// forClient marks the calls made for the request to carry its
+// Authorization header.
+func forClient(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), authorizationKey{}, req.Header.Get("Authorization")))
+}
+
+// call sends a request to the db node with the Authorization header of the
+// client the call is made for, or with the token of the router.
+func (r *router) call(ctx context.Context, method string, node sharding.Node, path string, body []byte) (*http.Response, error) {
+	nodeReq, err := http.NewRequestWithContext(ctx, method, node.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if authorization, ok := ctx.Value(authorizationKey{}).(string); ok {
+		if authorization != "" {
+			nodeReq.Header.Set("Authorization", authorization)
+		}
+	} else if r.token != "" {
+		nodeReq.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return r.client.Do(nodeReq)
+}
+
+func (r *router) getJSON(ctx context.Context, node sharding.Node, path string, value any) error {
+	resp, err := r.call(ctx, "GET", node, path, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(node, resp, value)
+}
+
+func decodeResponse(node sharding.Node, resp *http.Response, value any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("db node %s responded %s: %s", node.Name, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func writeJSON(res http.ResponseWriter, status int, value any) {
+	response, _ := json.Marshal(value)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(response)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/sharding"
+)
+
+// fakeDb serves the part of the db service API used by the router from
+// memory.
+type fakeDb struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]string
+	quotas  map[string]int64
+}
+
+func newFakeDb() *fakeDb {
+	return &fakeDb{
+		buckets: map[string]map[string]string{"": {}},
+		quotas:  make(map[string]int64),
+	}
+}
+
+func (db *fakeDb) keys(bucket string) map[string]string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	keys := make(map[string]string)
+	for k, v := range db.buckets[bucket] {
+		keys[k] = v
+	}
+	return keys
+}
+
+func (db *fakeDb) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	bucket := req.URL.Query().Get("bucket")
+	switch path := req.URL.Path; {
+	case path == "/db/_buckets":
+		var list []datastore.BucketInfo
+		for name, keys := range db.buckets {
+			if name != "" {
+				list = append(list, datastore.BucketInfo{Name: name, Quota: db.quotas[name], Keys: len(keys)})
+			}
+		}
+		writeJSON(res, http.StatusOK, list)
+
+	case strings.HasPrefix(path, "/db/_buckets/"):
+		name := strings.TrimPrefix(path, "/db/_buckets/")
+		var options struct {
+			Quota int64 `json:"quota"`
+		}
+		json.NewDecoder(req.Body).Decode(&options)
+		status := http.StatusOK
+		if db.buckets[name] == nil {
+			db.buckets[name] = make(map[string]string)
+			status = http.StatusCreated
+		}
+		db.quotas[name] = options.Quota
+		writeJSON(res, status, datastore.BucketInfo{Name: name, Quota: options.Quota})
+
+	case path == "/db/_export":
+		keys, ok := db.buckets[bucket]
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		names := make([]string, 0, len(keys))
+		for k := range keys {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		encoder := json.NewEncoder(res)
+		for _, k := range names {
+			encoder.Encode(datastore.ExportRecord{Key: k, Value: keys[k]})
+		}
+
+	case path == "/db/_import":
+		imported := 0
+		decoder := json.NewDecoder(req.Body)
+		for {
+			var record datastore.ExportRecord
+			if err := decoder.Decode(&record); err != nil {
+				break
+			}
+			db.buckets[bucket][record.Key] = record.Value
+			imported++
+		}
+		writeJSON(res, http.StatusOK, map[string]int{"imported": imported})
+
+	default:
+		bucket, key, err := parseKeyPath(req.URL.EscapedPath())
+		keys, ok := db.buckets[bucket]
+		if err != nil || !ok {
+			http.NotFound(res, req)
+			return
+		}
+		value, found := keys[key]
+		switch req.Method {
+		case "GET":
+			if !found {
+				http.NotFound(res, req)
+				return
+			}
+			writeJSON(res, http.StatusOK, datastore.ExportRecord{Key: key, Value: value})
+		case "POST":
+			var data struct {
+				Value string `json:"value"`
+			}
+			json.NewDecoder(req.Body).Decode(&data)
+			keys[key] = data.Value
+			res.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if !found {
+				http.NotFound(res, req)
+				return
+			}
+			delete(keys, key)
+		}
+	}
+}
+
+// testToken is the token of the routers of the tests, their requests carry it.
+const testToken = "router-token"
+
+type testCluster struct {
+	router *router
+	server *httptest.Server
+	dbs    map[string]*fakeDb
+	nodes  map[string]sharding.Node
+}
+
+func startRouter(t *testing.T, names ...string) *testCluster {
+	c := &testCluster{dbs: make(map[string]*fakeDb), nodes: make(map[string]sharding.Node)}
+	var initial []sharding.Node
+	for i, name := range names {
+		db := newFakeDb()
+		server := httptest.NewServer(db)
+		t.Cleanup(server.Close)
+		c.dbs[name] = db
+		c.nodes[name] = sharding.Node{Name: name, URL: server.URL}
+		if i < 2 {
+			initial = append(initial, c.nodes[name])
+		}
+	}
+	ring, err := sharding.NewRing(16, initial...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.router = newRouter(ring, http.DefaultClient)
+	c.router.token = testToken
+	c.server = httptest.NewServer(c.router)
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+func (c *testCluster) request(t *testing.T, method, path, body string) (int, string) {
+	t.Helper()
+	return c.requestWithToken(t, method, path, body, testToken)
+}
+
+func (c *testCluster) requestWithToken(t *testing.T, method, path, body, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(response)
+}
+
+// checkPlacement checks that every key is stored by its owner only.
+func (c *testCluster) checkPlacement(t *testing.T, bucket string, want map[string]string) {
+	t.Helper()
+	c.router.mu.RLock()
+	ring := c.router.ring
+	c.router.mu.RUnlock()
+	found := 0
+	for name, db := range c.dbs {
+		for key, value := range db.keys(bucket) {
+			if owner := ring.Owner(sharding.Key(bucket, key)).Name; owner != name {
+				t.Errorf("Key %q of bucket %q is on %s instead of %s", key, bucket, name, owner)
+			}
+			if want[key] != value {
+				t.Errorf("Unexpected value %q of key %q", value, key)
+			}
+			found++
+		}
+	}
+	if found != len(want) {
+		t.Errorf("Expected %d keys in bucket %q, found %d", len(want), bucket, found)
+	}
+}
+
+func (c *testCluster) waitRebalanced(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.router.mu.RLock()
+		done := c.router.previous == nil
+		c.router.mu.RUnlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			_, ring := c.request(t, "GET", "/router/ring", "")
+			t.Fatalf("Rebalancing is not done: %s", ring)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	c := startRouter(t, "db1", "db2", "db3")
+	if code, body := c.request(t, "PUT", "/db/_buckets/team", `{"quota":1000}`); code != http.StatusCreated {
+		t.Fatalf("Expected 201 on a bucket creation, got %d %s", code, body)
+	}
+
+	values := make(map[string]string)
+	team := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		values[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value-%d", i)
+		team[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("team-%d", i)
+	}
+	values["a/b"] = "slash"
+	values["history"] = "named history"
+	for key, value := range values {
+		if code, body := c.request(t, "POST", keyPath("", key), `{"value":"`+value+`"}`); code != http.StatusCreated {
+			t.Fatalf("Expected 201 on a put of %q, got %d %s", key, code, body)
+		}
+	}
+	for key, value := range team {
+		if code, _ := c.request(t, "POST", keyPath("team", key), `{"value":"`+value+`"}`); code != http.StatusCreated {
+			t.Fatalf("Expected 201 on a put of %q, got %d", key, code)
+		}
+	}
+	c.checkPlacement(t, "", values)
+	c.checkPlacement(t, "team", team)
+	if code, body := c.request(t, "GET", "/db/a%2Fb", ""); code != http.StatusOK || !strings.Contains(body, "slash") {
+		t.Errorf("Unexpected response %d %s", code, body)
+	}
+	if code, body := c.request(t, "GET", "/db/_buckets/team", ""); code != http.StatusOK || !strings.Contains(body, `"keys":100`) {
+		t.Errorf("Expected the keys of the bucket summed up, got %d %s", code, body)
+	}
+	if code, body := c.request(t, "GET", "/db/_export", ""); code != http.StatusOK || strings.Count(body, "\n") != len(values) {
+		t.Errorf("Expected all the keys exported, got %d %d lines", code, strings.Count(body, "\n"))
+	}
+
+	// A new node takes over a part of the keys and the buckets.
+	node, _ := json.Marshal(c.nodes["db3"])
+	if code, body := c.request(t, "POST", "/router/nodes", string(node)); code != http.StatusAccepted {
+		t.Fatalf("Expected 202 on a node addition, got %d %s", code, body)
+	}
+	c.waitRebalanced(t)
+	c.checkPlacement(t, "", values)
+	c.checkPlacement(t, "team", team)
+	if len(c.dbs["db3"].keys("")) == 0 || len(c.dbs["db3"].keys("team")) == 0 {
+		t.Error("Expected the new node to get keys")
+	}
+	for key, value := range team {
+		if code, body := c.request(t, "GET", keyPath("team", key), ""); code != http.StatusOK || !strings.Contains(body, value) {
+			t.Fatalf("Unexpected response for %q %d %s", key, code, body)
+		}
+	}
+
+	// The keys leave a removed node.
+	if code, body := c.request(t, "DELETE", "/router/nodes/db1", ""); code != http.StatusAccepted {
+		t.Fatalf("Expected 202 on a node removal, got %d %s", code, body)
+	}
+	c.waitRebalanced(t)
+	if len(c.dbs["db1"].keys("")) != 0 || len(c.dbs["db1"].keys("team")) != 0 {
+		t.Error("Expected no keys left on the removed node")
+	}
+	c.checkPlacement(t, "", values)
+	c.checkPlacement(t, "team", team)
+	if code, _ := c.request(t, "DELETE", "/router/nodes/db1", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 on a removal of an unknown node, got %d", code)
+	}
+}
+
+func TestRouter_MoveOnAccess(t *testing.T) {
+	c := startRouter(t, "db1", "db2", "db3")
+	values := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		values[key] = "old"
+		c.request(t, "POST", keyPath("", key), `{"value":"old"}`)
+	}
+
+	// The ring changes without the migration running, the requests move
+	// the keys they touch.
+	r := c.router
+	previous := r.ring
+	ring, err := previous.Add(c.nodes["db3"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.previous, r.ring = previous, ring
+	r.mu.Unlock()
+
+	var moving []string
+	for key := range values {
+		if ring.Owner(key).Name != previous.Owner(key).Name {
+			moving = append(moving, key)
+		}
+	}
+	if len(moving) < 2 {
+		t.Fatalf("Expected keys moving to the new node, got %d", len(moving))
+	}
+	if code, body := c.request(t, "GET", keyPath("", moving[0]), ""); code != http.StatusOK || !strings.Contains(body, "old") {
+		t.Errorf("Unexpected response %d %s", code, body)
+	}
+	if code, _ := c.request(t, "POST", keyPath("", moving[1]), `{"value":"new"}`); code != http.StatusCreated {
+		t.Errorf("Expected 201 on a put of a moving key, got %d", code)
+	}
+	values[moving[1]] = "new"
+	for _, key := range moving[:2] {
+		if _, ok := c.dbs["db3"].keys("")[key]; !ok {
+			t.Errorf("Expected %q moved to the new node", key)
+		}
+		if _, ok := c.dbs[previous.Owner(key).Name].keys("")[key]; ok {
+			t.Errorf("Expected %q deleted from its previous node", key)
+		}
+	}
+	if code, _ := c.request(t, "POST", "/db/_import", `{"key":"k","value":"v"}`); code != http.StatusConflict {
+		t.Errorf("Expected 409 on an import while rebalancing, got %d", code)
+	}
+
+	// The rebalancing started afterwards moves the rest.
+	if code, body := c.request(t, "POST", "/router/rebalance", ""); code != http.StatusAccepted {
+		t.Fatalf("Expected 202 on a rebalancing, got %d %s", code, body)
+	}
+	c.waitRebalanced(t)
+	c.checkPlacement(t, "", values)
+	_, body := c.request(t, "GET", "/router/ring", "")
+	var info ringInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil || info.Rebalance.Moved != len(moving)-2 || len(info.Nodes) != 3 {
+		t.Errorf("Unexpected ring %s", body)
+	}
+}
+
+func TestRouter_Auth(t *testing.T) {
+	c := startRouter(t, "db1", "db2", "db3")
+	node, _ := json.Marshal(c.nodes["db3"])
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := c.requestWithToken(t, "POST", "/router/nodes", string(node), token); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 on a node addition with token %q, got %d", token, code)
+		}
+		if code, _ := c.requestWithToken(t, "GET", "/router/ring", "", token); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 on the ring with token %q, got %d", token, code)
+		}
+	}
+	if _, body := c.request(t, "GET", "/router/ring", ""); strings.Contains(body, "db3") {
+		t.Errorf("The node is added without the token: %s", body)
+	}
+
+	large := `{"name":"db3","url":"` + strings.Repeat("a", maxDefinitionBody) + `"}`
+	if code, _ := c.request(t, "POST", "/router/nodes", large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 on a large node definition, got %d", code)
+	}
+	if code, _ := c.request(t, "PUT", "/db/_buckets/team", large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 on a large bucket definition, got %d", code)
+	}
+
+	// A router without a token does not change its ring.
+	c.router.token = ""
+	if code, _ := c.request(t, "POST", "/router/nodes", string(node)); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on a router without a token, got %d", code)
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := parseNodes("db1=http://db1:8083/, db2=http://db2:8083")
+	if err != nil || len(nodes) != 2 || nodes[0] != (sharding.Node{Name: "db1", URL: "http://db1:8083"}) {
+		t.Errorf("Unexpected nodes %v, %v", nodes, err)
+	}
+	if _, err := parseNodes("db1"); err == nil {
+		t.Error("Expected an error for a node without a URL")
+	}
+	if _, _, err := parseKeyPath("/db/" + url.PathEscape("a/b") + "/history"); err != nil {
+		t.Error(err)
+	}
+}
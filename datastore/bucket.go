@@ -0,0 +1,292 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+)
+
+// DefaultBucket is the name of the bucket used by the Db methods.
+const DefaultBucket = "default"
+
+// The definitions of the buckets are stored as entries of the meta bucket:
+// the key is the bucket name and the value is the JSON of bucketMeta.
+const (
+	defaultBucketID uint32 = 0
+	metaBucketID    uint32 = 1<<32 - 1
+)
+
+var (
+	// ErrBucketNotFound is returned for buckets that were not created.
+	ErrBucketNotFound = errors.New("bucket does not exist")
+	// ErrBucketExists is returned when creating a bucket twice.
+	ErrBucketExists = errors.New("bucket already exists")
+	// ErrInvalidBucket is returned for bucket names not matching bucketNamePattern.
+	ErrInvalidBucket = errors.New("invalid bucket name")
+)
+
+// bucketNamePattern keeps the bucket names usable as a URL path segment.
+var bucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+type bucketMeta struct {
+	ID    uint32 `json:"id"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+// bucketState is the in-memory state of a bucket guarded by db.mu.
+type bucketState struct {
+	name  string
+	meta  bucketMeta
+	keys  int
+	bytes int64
+}
+
+// BucketInfo describes a bucket. Bytes counts the encoded size of the live
+// entries, which is what the quota limits.
+type BucketInfo struct {
+	Name  string `json:"name"`
+	Quota int64  `json:"quota,omitempty"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
+
+func newBucketState(name string, meta bucketMeta) *bucketState {
+	return &bucketState{name: name, meta: meta}
+}
+
+func (db *Db) registerBucket(state *bucketState) {
+	db.buckets[state.name] = state
+	db.bucketIDs[state.meta.ID] = state
+	if state.meta.ID >= db.nextBucketID {
+		db.nextBucketID = state.meta.ID + 1
+	}
+}
+
+// track updates the bucket usage and definitions with an entry written to
+// the log. The size of a key includes its merge entries until they are
+// folded. It must be called with db.mu held or during recovery.
+func (db *Db) track(e *entry) {
+	k := e.indexKey()
+	db.versions[k] = e.version
+	db.seq = max(db.seq, e.seq)
+	state := db.bucketIDs[e.bucket]
+	if e.kind == kindMerge {
+		size, ok := db.sizes[k]
+		db.sizes[k] = size + e.getLength()
+		if state != nil {
+			if !ok {
+				state.keys++
+			}
+			state.bytes += e.getLength()
+		}
+		return
+	}
+	if size, ok := db.sizes[k]; ok {
+		delete(db.sizes, k)
+		if state != nil {
+			state.keys--
+			state.bytes -= size
+		}
+	}
+	// The merges keep the expiry time of the value, the puts replace it.
+	if e.kind == kindPut && e.expires != 0 {
+		db.expiries[k] = e.expires
+	} else {
+		delete(db.expiries, k)
+	}
+	if e.kind == kindDelete {
+		return
+	}
+	size := e.getLength()
+	db.sizes[k] = size
+	if state != nil {
+		state.keys++
+		state.bytes += size
+	}
+
+	if e.bucket == metaBucketID {
+		var meta bucketMeta
+		if err := json.Unmarshal([]byte(e.value), &meta); err != nil {
+			log.Printf("Ignoring the invalid definition of bucket %s: %s", e.key, err)
+			return
+		}
+		if existing, ok := db.buckets[e.key]; ok {
+			existing.meta.Quota = meta.Quota
+		} else {
+			db.registerBucket(newBucketState(e.key, meta))
+		}
+	}
+}
+
+// recountBuckets computes the bucket usage from scratch. Recovery needs it
+// as merged segments may hold the keys of a bucket before its definition.
+func (db *Db) recountBuckets() {
+	for _, state := range db.bucketIDs {
+		state.keys, state.bytes = 0, 0
+	}
+	for k, size := range db.sizes {
+		bucket, _ := splitIndexKey(k)
+		if state, ok := db.bucketIDs[bucket]; ok {
+			state.keys++
+			state.bytes += size
+		}
+	}
+}
+
+// CreateBucket creates a bucket limiting its live data to quota bytes.
+// A zero quota means no limit.
+func (db *Db) CreateBucket(name string, quota int64) (*Bucket, error) {
+	if !bucketNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidBucket, name)
+	}
+	if quota < 0 {
+		return nil, fmt.Errorf("negative quota %d", quota)
+	}
+	db.bucketMu.Lock()
+	defer db.bucketMu.Unlock()
+
+	db.mu.RLock()
+	_, exists := db.buckets[name]
+	id := db.nextBucketID
+	db.mu.RUnlock()
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrBucketExists, name)
+	}
+	if id == metaBucketID {
+		return nil, errors.New("too many buckets")
+	}
+
+	value, err := json.Marshal(bucketMeta{ID: id, Quota: quota})
+	if err != nil {
+		return nil, err
+	}
+	err = db.apply(context.Background(), entry{key: name, value: string(value), bucket: metaBucketID})
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, id: id, name: name}, nil
+}
+
+// Bucket returns the bucket with the name or ErrBucketNotFound.
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	state, ok := db.buckets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return &Bucket{db: db, id: state.meta.ID, name: name}, nil
+}
+
+// Buckets lists the buckets in name order.
+func (db *Db) Buckets() []BucketInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	infos := make([]BucketInfo, 0, len(db.buckets))
+	for _, state := range db.buckets {
+		infos = append(infos, state.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (state *bucketState) info() BucketInfo {
+	return BucketInfo{
+		Name:  state.name,
+		Quota: state.meta.Quota,
+		Keys:  state.keys,
+		Bytes: state.bytes,
+	}
+}
+
+// Bucket is a separate key space of a Db. It shares the log and the
+// segments with the other buckets. Closing a Bucket does nothing, the Db
+// has to be closed instead.
+type Bucket struct {
+	db   *Db
+	id   uint32
+	name string
+}
+
+var _ Store = (*Bucket)(nil)
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Info returns the current usage of the bucket.
+func (b *Bucket) Info() BucketInfo {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	return b.db.bucketIDs[b.id].info()
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.db.get(context.Background(), b.id, key)
+}
+
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	return b.db.get(ctx, b.id, key)
+}
+
+// GetItem is GetContext returning the version and the time of the latest
+// write of the key along with its value.
+func (b *Bucket) GetItem(ctx context.Context, key string) (Item, error) {
+	return b.db.getItem(ctx, b.id, key)
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.db.put(context.Background(), b.id, key, value)
+}
+
+func (b *Bucket) PutContext(ctx context.Context, key, value string) error {
+	return b.db.put(ctx, b.id, key, value)
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.db.deleteKey(context.Background(), b.id, key)
+}
+
+func (b *Bucket) DeleteContext(ctx context.Context, key string) error {
+	return b.db.deleteKey(ctx, b.id, key)
+}
+
+func (b *Bucket) Scan(prefix string, fn func(key, value string) error) error {
+	return b.db.scan(b.id, prefix, "", fn)
+}
+
+func (b *Bucket) ScanAfter(prefix, after string, fn func(key, value string) error) error {
+	return b.db.scan(b.id, prefix, after, fn)
+}
+
+func (b *Bucket) Export(w io.Writer) error {
+	return b.db.exportBucket(b.id, w)
+}
+
+func (b *Bucket) Import(r io.Reader) (int, error) {
+	return b.db.importInto(b.id, r)
+}
+
+func (b *Bucket) Close() error {
+	return nil
+}
+
+// Stats of a bucket count its live keys and their encoded size, Segments
+// is the number of the segments shared by all the buckets.
+func (b *Bucket) Stats() Stats {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	state := b.db.bucketIDs[b.id]
+	return Stats{
+		Keys:     state.keys,
+		Segments: len(b.db.segments),
+		Bytes:    state.bytes,
+	}
+}
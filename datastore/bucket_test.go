@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDb_Buckets(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	team, err := db.CreateBucket("team-a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateBucket("team-a", 0); !errors.Is(err, ErrBucketExists) {
+		t.Errorf("Expected ErrBucketExists, got %v", err)
+	}
+	for _, name := range []string{"", "_export", "a/b", strings.Repeat("b", 65)} {
+		if _, err := db.CreateBucket(name, 0); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("Expected ErrInvalidBucket for %q, got %v", name, err)
+		}
+	}
+	if _, err := db.Bucket("team-b"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+
+	if err := db.Put("key", "default value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Put("key", "team value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("key"); value != "default value" {
+		t.Errorf("Unexpected value in the default bucket %q", value)
+	}
+	if value, _ := team.Get("key"); value != "team value" {
+		t.Errorf("Unexpected value in the team bucket %q", value)
+	}
+	if _, err := team.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := db.Delete("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the keys of a bucket to be invisible in the default one, got %v", err)
+	}
+
+	var keys []string
+	team.Scan("", func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []string{"key", "other"}) {
+		t.Errorf("Unexpected keys of the team bucket %v", keys)
+	}
+	if stats := team.Stats(); stats.Keys != 2 {
+		t.Errorf("Expected 2 keys in the team bucket, got %d", stats.Keys)
+	}
+	if stats := db.Stats(); stats.Keys != 3 {
+		t.Errorf("Expected 3 keys in the datastore, got %d", stats.Keys)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	expected := db.Buckets()
+	if len(expected) != 2 || expected[0].Name != DefaultBucket || expected[1].Keys != 2 {
+		t.Errorf("Unexpected buckets %+v", expected)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if buckets := db.Buckets(); !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Buckets changed after reopening: %+v, expected %+v", buckets, expected)
+	}
+	team, err = db.Bucket("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := team.Get("key"); value != "team value" {
+		t.Errorf("Unexpected value in the team bucket after reopening %q", value)
+	}
+	next, err := db.CreateBucket("team-b", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.id == team.id {
+		t.Error("A new bucket reused the id of an existing one")
+	}
+}
+
+func TestDb_BucketQuota(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entrySize := (&entry{key: "key1", value: "value1"}).getLength()
+	limited, err := db.CreateBucket("limited", 2*entrySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Put("key3", "value3"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := limited.Put("key2", "value0"); err != nil {
+		t.Errorf("Expected an overwrite of the same size to fit, got %s", err)
+	}
+	if err := limited.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Put("key3", "value3"); err != nil {
+		t.Errorf("Expected the deleted key to free the quota, got %s", err)
+	}
+
+	input := `{"key":"key4","value":"value4"}` + "\n"
+	if _, err := limited.Import(strings.NewReader(input)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded on import, got %v", err)
+	}
+	if info := limited.Info(); info.Keys != 2 || info.Bytes != 2*entrySize {
+		t.Errorf("Unexpected usage %+v", info)
+	}
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Errorf("The quota must not limit the other buckets, got %s", err)
+	}
+}
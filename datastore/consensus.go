@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+// Consensus orders the writes of the Db in a log replicated to the other
+// nodes of a cluster, so that all of them apply the same writes in the same
+// order, see WithConsensus.
+type Consensus interface {
+	// Replicate appends the commands to the log and returns once they are
+	// committed and applied with Db.ApplyCommand on this node. It returns
+	// the error of the first failed command.
+	Replicate(ctx context.Context, commands ...[]byte) error
+}
+
+// WithConsensus makes the Db pass the writes of the clients to c instead of
+// writing them. The committed writes come back through ApplyCommand and
+// take the index of the log as their log position, so the Db must start
+// empty or with the data of the same log.
+func WithConsensus(c Consensus) Option {
+	return func(db *Db) {
+		db.consensus = c
+	}
+}
+
+// propose passes the checked entries to the consensus. The entries are
+// stamped with the time of the proposal to get the same timestamps on all
+// the nodes.
+func (db *Db) propose(ctx context.Context, entries ...entry) error {
+	now := db.now().UnixNano()
+	commands := make([][]byte, len(entries))
+	for i := range entries {
+		entries[i].timestamp = now
+		commands[i] = entries[i].Encode()
+	}
+	return db.consensus.Replicate(ctx, commands...)
+}
+
+// ApplyCommand writes the command committed at the index of the consensus
+// log. The commands up to Position are already written and are skipped. The
+// write is checked against the quotas and the size limit again, so a command
+// rejected on one node is rejected on every node.
+func (db *Db) ApplyCommand(ctx context.Context, index uint64, command []byte) error {
+	var e entry
+	if err := e.Decode(command); err != nil {
+		return fmt.Errorf("%w: command %d: %s", ErrCorrupted, index, err)
+	}
+	if index <= db.Position() {
+		return nil
+	}
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+	e.seq = index
+	return db.write(ctx, putOperation{entry: e})
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mirror commits every command right away and applies it to all the Dbs,
+// returning the result of the first one.
+type mirror struct {
+	mu    sync.Mutex
+	index uint64
+	dbs   []*Db
+}
+
+func (m *mirror) Replicate(ctx context.Context, commands ...[]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result error
+	for _, command := range commands {
+		m.index++
+		for i, db := range m.dbs {
+			err := db.ApplyCommand(ctx, m.index, command)
+			if i == 0 && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+func TestDb_Consensus(t *testing.T) {
+	m := &mirror{}
+	for i := 0; i < 2; i++ {
+		db, err := NewDb(t.TempDir(), 256, WithConsensus(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		m.dbs = append(m.dbs, db)
+	}
+	leader, other := m.dbs[0], m.dbs[1]
+
+	if err := leader.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Merge("a", AppendOperator, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.CreateBucket("team", 80); err != nil {
+		t.Fatal(err)
+	}
+	team, err := leader.Bucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Put("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// The rejected writes fail on every node and keep their positions.
+	if err := team.Put("c", strings.Repeat("v", 40)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := leader.Delete("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := leader.Import(strings.NewReader(`{"key":"d","value":"1"}` + "\n" + `{"key":"e","value":"1"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, db := range m.dbs {
+		if value, err := db.Get("a"); err != nil || value != "12" {
+			t.Errorf("Unexpected value of a: %q, %v", value, err)
+		}
+		if db.Stats().Keys != 4 {
+			t.Errorf("Unexpected stats %+v", db.Stats())
+		}
+	}
+	if leader.Position() != other.Position() || other.Position() != 8 {
+		t.Errorf("Expected both at the last written command 8, got %d and %d", leader.Position(), other.Position())
+	}
+
+	// The commands already written are skipped.
+	command := (&entry{key: "a", value: "x"}).Encode()
+	if err := other.ApplyCommand(context.Background(), 1, command); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := other.Get("a"); value != "12" {
+		t.Errorf("Expected an applied command to be skipped, got %q", value)
+	}
+	if err := other.ApplyCommand(context.Background(), 10, command[1:]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
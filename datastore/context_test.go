@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDb_ContextAndClose(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding the lock stalls both the index and the put routines.
+	db.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.PutContext(ctx, "key", "stuck"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded on put, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetContext(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded on get, got %v", err)
+	}
+
+	// The put is queued behind the stalled one and is completed by Close.
+	pending := make(chan error)
+	go func() {
+		pending <- db.Put("other", "value")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	for !isClosing(db) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Put("late", "value"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed for a put after close, got %v", err)
+	}
+	db.mu.Unlock()
+
+	if err := <-pending; err != nil {
+		t.Errorf("Expected the queued put to be completed, got %s", err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after close, got %v", err)
+	}
+
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, expected := range map[string]string{"key": "stuck", "other": "value"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Unexpected value of %s after reopening: %q, %v", key, value, err)
+		}
+	}
+}
+
+func isClosing(db *Db) bool {
+	db.lifecycle.RLock()
+	defer db.lifecycle.RUnlock()
+	return db.closing
+}
+
+func TestDb_CloseCancelsMerge(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The background merge is scheduled but must not run after Close.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * mergeDelay)
+	if stats := db.Stats(); stats.Segments < 3 {
+		t.Errorf("Expected the segments to stay unmerged, got %d", stats.Segments)
+	}
+}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const crashTestKeys = 20
+
+// runCrashScenario applies random writes to a Db until the injected fault
+// makes one of them fail, "kills" the process and checks that every
+// acknowledged write survives reopening the directory.
+func runCrashScenario(t *testing.T, seed int64, inject func(fs *FaultFS, rnd *rand.Rand)) {
+	rnd := rand.New(rand.NewSource(seed))
+	dir := t.TempDir()
+	fs := NewFaultFS(OSFS)
+	db, err := NewDb(dir, 256, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inject(fs, rnd)
+
+	acked := make(map[string]string)
+	inFlight := ""
+	for i := 0; i < 400 && inFlight == ""; i++ {
+		if i == 200 {
+			// Let the background merges run.
+			time.Sleep(2 * mergeDelay)
+		}
+		key := fmt.Sprintf("key%d", rnd.Intn(crashTestKeys))
+		if rnd.Intn(5) == 0 {
+			err = db.Delete(key)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				delete(acked, key)
+				continue
+			}
+		} else {
+			value := fmt.Sprintf("value-%d-%d-%s", seed, i, strings.Repeat("x", rnd.Intn(40)))
+			err = db.Put(key, value)
+			if err == nil {
+				acked[key] = value
+				continue
+			}
+		}
+		inFlight = key
+	}
+
+	// Nothing the old process does from now on reaches the disk.
+	fs.CrashAfter(0)
+	db.Close()
+
+	reopened, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatalf("seed %d: reopening failed: %s", seed, err)
+	}
+	defer reopened.Close()
+
+	for i := 0; i < crashTestKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if key == inFlight {
+			// The failed write may or may not have reached the disk.
+			continue
+		}
+		value, err := reopened.Get(key)
+		expected, ok := acked[key]
+		if !ok {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("seed %d: expected %s to be absent, got %q, %v", seed, key, value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("seed %d: acknowledged %s is lost: %s", seed, key, err)
+		} else if value != expected {
+			t.Errorf("seed %d: unexpected value of %s, expected %q, got %q", seed, key, expected, value)
+		}
+	}
+}
+
+func TestDb_CrashRecovery(t *testing.T) {
+	faults := []struct {
+		name   string
+		inject func(fs *FaultFS, rnd *rand.Rand)
+	}{
+		{"crash", func(fs *FaultFS, rnd *rand.Rand) { fs.CrashAfter(rnd.Int63n(20000)) }},
+		{"disk full", func(fs *FaultFS, rnd *rand.Rand) { fs.LimitSpace(rnd.Int63n(20000)) }},
+		{"short write", func(fs *FaultFS, rnd *rand.Rand) { fs.ShortWriteAfter(1 + rnd.Intn(400)) }},
+	}
+
+	for _, fault := range faults {
+		fault := fault
+		t.Run(fault.name, func(t *testing.T) {
+			for seed := int64(1); seed <= 10; seed++ {
+				seed := seed
+				t.Run(fmt.Sprint(seed), func(t *testing.T) {
+					t.Parallel()
+					runCrashScenario(t, seed, fault.inject)
+				})
+			}
+		})
+	}
+}
+
+// TestDb_SyncFailure checks the syncs failing where the Db makes them: the
+// segment rotation, Sync, a merge and Close.
+func TestDb_SyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFaultFS(OSFS)
+	db, err := NewDb(dir, 64, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncErr := errors.New("sync failed")
+	fs.FailSync(syncErr)
+
+	// A segment holds one entry, every write rotates and syncs the previous.
+	if err := db.Put("key0", "value"); !errors.Is(err, syncErr) {
+		t.Errorf("Expected the rotation to fail with the sync error, got %v", err)
+	}
+	if err := db.Sync(); !errors.Is(err, syncErr) {
+		t.Errorf("Expected Sync to fail with the sync error, got %v", err)
+	}
+	segments := len(db.Segments())
+	if err := db.Compact(); !errors.Is(err, syncErr) {
+		t.Fatalf("Expected the merge to fail with the sync error, got %v", err)
+	}
+	if len(db.Segments()) < segments {
+		t.Errorf("Expected the segments kept after the failed merge, got %d of %d", len(db.Segments()), segments)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*"+mergeTmpSuffix)); len(leftovers) != 0 {
+		t.Errorf("Expected the merged file removed, found %v", leftovers)
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	fs.FailSync(nil)
+	if err := db.Sync(); err != nil {
+		t.Errorf("Expected Sync to succeed once the syncs do, got %s", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Expected the merge to succeed once the syncs do, got %s", err)
+	}
+	fs.FailSync(syncErr)
+	if err := db.Close(); !errors.Is(err, syncErr) {
+		t.Errorf("Expected Close to report the sync error, got %v", err)
+	}
+
+	reopened, err := NewDb(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for i := 16; i < 20; i++ {
+		if value, err := reopened.Get(fmt.Sprintf("key%d", i%4)); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Unexpected value of key%d: %q, %v", i%4, value, err)
+		}
+	}
+}
+
+func TestFaultFS(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFaultFS(OSFS)
+	f, err := fs.OpenFile(dir+"/file", os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fs.CrashAfter(6)
+	if n, err := f.Write([]byte("abcd")); n != 4 || err != nil {
+		t.Errorf("Unexpected write result before the crash: %d, %v", n, err)
+	}
+	if n, err := f.Write([]byte("efgh")); n != 2 || !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected a torn write, got %d, %v", n, err)
+	}
+	if _, err := f.Write([]byte("ijkl")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected writes to fail after the crash, got %v", err)
+	}
+	if _, err := fs.Stat(dir + "/file"); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected stat to fail after the crash, got %v", err)
+	}
+
+	info, err := OSFS.Stat(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 6 {
+		t.Errorf("Expected 6 bytes on disk, got %d", info.Size())
+	}
+}
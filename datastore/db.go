@@ -2,180 +2,642 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const outFileName = "current-data"
 
+// A merge writes its result into a temporary file and commits it by
+// renaming the file to the merged suffix. A committed merge replaces every
+// segment with a number up to its own, see finishMerge.
+const (
+	mergeTmpSuffix    = ".tmp"
+	mergeCommitSuffix = ".merged"
+)
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+// ErrReadOnly is returned on writes to a Db opened with ReadOnly.
+var ErrReadOnly = errors.New("datastore is opened read-only")
+
+// ErrCorrupted is returned when the data files cannot be read back.
+var ErrCorrupted = errors.New("corrupted file")
+
+// ErrClosed is returned by the operations on a closed Db.
+var ErrClosed = errors.New("datastore is closed")
+
 const bufferSize = 8192
 
+// deletedOffset is stored in a segment index for keys removed in that segment.
+const deletedOffset int64 = -1
+
+// mergeOnlyOffset is stored in a segment index for keys having only merge
+// entries in that segment, their base value is in the older segments.
+const mergeOnlyOffset int64 = -2
 
 type hashIndex map[string]int64
-// ok
 
+// indexOperation asks the index routine for the positions of the entries
+// making up the value of the key, see keyChain. The reply channel is
+// buffered, so the routine never waits for the caller.
 type indexOperation struct {
-	isWrite bool
-	key     string
-	offset  int64
+	key   string
+	reply chan []KeyPosition
 }
 
+// putOperation is handled by the put routine: it either appends the entry,
+// appends a batch of put entries with as few writes as possible, starts
+// a new segment or appends an entry received from the leader as it is.
+type putOperation struct {
+	entry      entry
+	batch      []entry
+	rotate     bool
+	sync       bool
+	replicated bool
+	done       chan error
+}
 
 type KeyPosition struct {
-	segment  *Segment
-	offset int64
+	segment *Segment
+	offset  int64
 }
 
 type Segment struct {
+	id        int
 	outOffset int64
+	// maxSeq is the highest log position of the entries in the segment.
+	maxSeq uint64
 
-	index    hashIndex
+	index hashIndex
+	// merges keeps the offsets of the merge entries of the keys written
+	// after their last put or delete in the segment.
+	merges map[string][]int64
+	// history keeps the offsets of all the entries of every key in write
+	// order. It is nil unless the Db keeps a history, see WithHistory.
+	history  map[string][]int64
 	filePath string
+	file     File
+	// readers counts reads in progress so that a merged segment is closed
+	// only after all of them are done.
+	readers sync.WaitGroup
 }
 
 type Db struct {
-	out              *os.File
-	outPath          string
-	outOffset        int64
-	dir              string
+	fs        FS
+	out       File
+	outOffset int64
+	dir       string
 
 	segmentSizeBytes int64
 	lastSegmentIndex int
 	indexOperations  chan indexOperation
-	positionLookups  chan *KeyPosition
-	putOperations    chan entry
-	putFinished      chan error
-	index    hashIndex
+	putOperations    chan putOperation
+	// queued counts the writes waiting for the put routine.
+	queued atomic.Int64
+
+	// Close sets closing under lifecycle so that no new operations start,
+	// waits for the pending ones and then stops the index and put routines
+	// and the merges by closing the closed channel.
+	lifecycle sync.RWMutex
+	closing   bool
+	pending   sync.WaitGroup
+	closed    chan struct{}
+	routines  sync.WaitGroup
+	// stopping is closed together with setting closing, it ends the
+	// replication streams before Close waits for the pending operations.
+	stopping chan struct{}
+
+	// mu guards the segments list and the index of the current segment.
+	mu       sync.RWMutex
 	segments []*Segment
+	merging  bool
+	// mergeTimer delays the background merge, see mergeDelay.
+	mergeTimer *time.Timer
+	// mergeMu serializes merges.
+	mergeMu sync.Mutex
+	// mergeObserver is told about every merge, see WithMergeObserver.
+	mergeObserver func(time.Duration, error)
+
+	// The bucket registry and the live entry sizes by index key, guarded
+	// by mu. bucketMu serializes the creation of buckets.
+	buckets      map[string]*bucketState
+	bucketIDs    map[uint32]*bucketState
+	nextBucketID uint32
+	sizes        map[string]int64
+	bucketMu     sync.Mutex
+	// versions holds the latest version of every key written, deleted
+	// keys included. expiries holds the expiry times of the keys, see
+	// PutExpiring. Both guarded by mu, updated by track.
+	versions map[string]uint64
+	expiries map[string]int64
+
+	// history is the merge policy for the older versions and now stamps
+	// the written entries.
+	history historyPolicy
+	now     func() time.Time
+	// operators fold the merge entries, see WithMergeOperator.
+	operators mergeOperators
+
+	// seq is the log position of the latest entry and compactedSeq the
+	// highest position a merge may have dropped entries up to. appended is
+	// closed and replaced on every write. All guarded by mu. writeSeq
+	// numbers the entries and is used by the put routine only.
+	seq          uint64
+	compactedSeq uint64
+	appended     chan struct{}
+	writeSeq     uint64
+	// follower rejects the writes of the clients, see Follower. replica
+	// is the state of the replication from the leader guarded by mu.
+	follower atomic.Bool
+	replica  replicaState
+	// consensus receives the writes of the clients, see WithConsensus.
+	consensus Consensus
+
+	limits  limits
+	maxSize int64
+	// writeErr stops the writes after the current segment could not be
+	// restored following a failed write. Used by the put routine only.
+	writeErr       error
+	strictRecovery bool
+	readOnly       bool
+	exclusive      bool
+	lock           *dirLock
+}
+
+var _ Store = (*Db)(nil)
+
+// Option configures a Db.
+type Option func(db *Db)
+
+// WithFS makes the Db access its files through fs instead of the OS.
+func WithFS(fs FS) Option {
+	return func(db *Db) {
+		db.fs = fs
+	}
+}
+
+// WithMergeObserver sets the function called after every merge of the
+// segments, background merges and Compact alike, with its duration and
+// error.
+func WithMergeObserver(observe func(duration time.Duration, err error)) Option {
+	return func(db *Db) {
+		db.mergeObserver = observe
+	}
+}
+
+// WithStrictRecovery makes NewDb fail with ErrCorrupted instead of cutting
+// off a partially written entry at the end of a segment.
+func WithStrictRecovery() Option {
+	return func(db *Db) {
+		db.strictRecovery = true
+	}
+}
+
+// ReadOnly opens the Db for reading only. It sees the data present at the
+// moment it is opened and can be used next to a Db writing to the directory.
+// Put and Delete fail with ErrReadOnly.
+func ReadOnly() Option {
+	return func(db *Db) {
+		db.readOnly = true
+	}
 }
 
+// Exclusive makes NewDb fail with ErrLocked if any read-only Db is using the
+// directory and keeps new ones out while the Db is open.
+func Exclusive() Option {
+	return func(db *Db) {
+		db.exclusive = true
+	}
+}
 
-func NewDb(dir string, segmentSizeBytes int64) (*Db, error) {
+// NewDb opens the datastore in dir, creating it if the directory is empty.
+// Only one writable Db can use a directory at a time, NewDb returns
+// ErrLocked if the directory is already in use.
+func NewDb(dir string, segmentSizeBytes int64, opts ...Option) (*Db, error) {
 	db := &Db{
-		segments:     make([]*Segment, 0),
-		dir:          dir,
-		segmentSizeBytes:  segmentSizeBytes,
-		indexOperations:     make(chan indexOperation),
-		positionLookups: make(chan *KeyPosition),
-		putOperations:       make(chan entry),
-		putFinished:      make(chan error),
+		fs:               OSFS,
+		segments:         make([]*Segment, 0),
+		dir:              dir,
+		segmentSizeBytes: segmentSizeBytes,
+		indexOperations:  make(chan indexOperation),
+		putOperations:    make(chan putOperation),
+		closed:           make(chan struct{}),
+		limits:           defaultLimits,
+		buckets:          make(map[string]*bucketState),
+		bucketIDs:        make(map[uint32]*bucketState),
+		sizes:            make(map[string]int64),
+		versions:         make(map[string]uint64),
+		expiries:         make(map[string]int64),
+		now:              time.Now,
+		operators:        defaultOperators(),
+		stopping:         make(chan struct{}),
+		appended:         make(chan struct{}),
+	}
+	db.registerBucket(newBucketState(DefaultBucket, bucketMeta{ID: defaultBucketID}))
+	for _, opt := range opts {
+		opt(db)
 	}
 
-	err := db.createNewSegment()
+	lock, err := lockDir(dir, db.readOnly, db.exclusive)
 	if err != nil {
 		return nil, err
 	}
+	db.lock = lock
 
 	err = db.recoverData()
-	if err != nil && err != io.EOF {
+	if err != nil {
+		db.closeSegments()
+		db.lock.release()
 		return nil, err
 	}
 
 	db.startRoutineForIndexOps()
-	db.startPutRoutine()
+	if !db.readOnly {
+		db.startPutRoutine()
+		db.startExpiryRoutine()
+	}
 
 	return db, nil
 }
 
-
 func (db *Db) startRoutineForIndexOps() {
 	processIndexOp := func(op indexOperation) {
-		if op.isWrite {
-			db.updateOffset(op.key, op.offset)
-		} else {
-			segment, position, err := db.locateKey(op.key)
-			if err != nil {
-				db.positionLookups <- nil
-			} else {
-				db.positionLookups <- &KeyPosition{
-					segment,
-					position,
-				}
-			}
-		}
+		db.mu.RLock()
+		chain := keyChain(db.segments, op.key)
+		db.mu.RUnlock()
+		op.reply <- chain
 	}
 
+	db.routines.Add(1)
 	go func() {
-		for op := range db.indexOperations {
-			processIndexOp(op)
+		defer db.routines.Done()
+		for {
+			select {
+			case op := <-db.indexOperations:
+				processIndexOp(op)
+			case <-db.closed:
+				return
+			}
 		}
 	}()
 }
 
+func (db *Db) segmentFileName(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, id))
+}
+
+// openSegment opens the read handle of a segment file.
+func (db *Db) openSegment(id int, path string) (*Segment, error) {
+	file, err := db.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	segment := &Segment{
+		id:       id,
+		filePath: path,
+		file:     file,
+		index:    make(hashIndex),
+	}
+	if db.history.enabled() {
+		segment.history = make(map[string][]int64)
+	}
+	return segment, nil
+}
+
+// add indexes the entry of the segment found at offset.
+func (segment *Segment) add(e *entry, offset int64) {
+	k := e.indexKey()
+	if e.seq > segment.maxSeq {
+		segment.maxSeq = e.seq
+	}
+	switch e.kind {
+	case kindMerge:
+		if _, ok := segment.index[k]; !ok {
+			segment.index[k] = mergeOnlyOffset
+		}
+		if segment.merges == nil {
+			segment.merges = make(map[string][]int64)
+		}
+		segment.merges[k] = append(segment.merges[k], offset)
+	case kindDelete:
+		segment.index[k] = deletedOffset
+		delete(segment.merges, k)
+	default:
+		segment.index[k] = offset
+		delete(segment.merges, k)
+	}
+	if segment.history != nil {
+		segment.history[k] = append(segment.history[k], offset)
+	}
+}
 
-// okay.
 func (db *Db) createNewSegment() error {
-	segmentFileName := db.generateSegmentFileName()
-	segmentFile, err := os.OpenFile(segmentFileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+	// The closed segments stay durable, so that Sync has the current one only.
+	if db.out != nil {
+		if err := db.out.Sync(); err != nil {
+			return err
+		}
+	}
+	id := db.generateSegmentID()
+	segmentFileName := db.segmentFileName(id)
+	segmentFile, err := db.fs.OpenFile(segmentFileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	newSegment, err := db.openSegment(id, segmentFileName)
 	if err != nil {
+		segmentFile.Close()
 		return err
 	}
 
-	newSegment := &Segment{
-		filePath: segmentFileName,
-		index:    make(hashIndex),
+	if db.out != nil {
+		db.out.Close()
 	}
 	db.out = segmentFile
 	db.outOffset = 0
+
+	db.mu.Lock()
 	db.segments = append(db.segments, newSegment)
-	if len(db.segments) >= 3 {
+	needsMerge := len(db.segments) >= 3 && !db.merging
+	if needsMerge {
+		db.merging = true
+	}
+	db.mu.Unlock()
+
+	if needsMerge {
 		db.compactAndMergeSegments()
 	}
-	return err
+	return nil
 }
 
-func (db *Db) generateSegmentFileName() string {
-	segmentFileName := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.lastSegmentIndex))
+func (db *Db) generateSegmentID() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	id := db.lastSegmentIndex
 	db.lastSegmentIndex++
-	return segmentFileName
+	return id
 }
-// done
+
+// mergeDelay postpones merging after a segment rollover so that a burst of
+// writes filling several segments is compacted in a single pass.
+const mergeDelay = 100 * time.Millisecond
 
 func (db *Db) compactAndMergeSegments() {
-	go db.mergeSegments()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.mergeTimer = time.AfterFunc(mergeDelay, db.mergeSegments)
 }
 
+// mergeSegments runs a background merge started on a segment rollover.
 func (db *Db) mergeSegments() {
-	newSegmentFileName := db.generateSegmentFileName()
-	newSegment := &Segment{
-		filePath: newSegmentFileName,
-		index:    make(hashIndex),
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.merging = false
+		db.mu.Unlock()
+	}()
+
+	select {
+	case <-db.closed:
+		return
+	default:
+	}
+	if err := db.observeMerge(db.merge); err != nil && err != ErrClosed {
+		log.Printf("Failed to merge segments in %s: %s", db.dir, err)
 	}
-	var offset int64
-	newSegmentFile, err := os.OpenFile(newSegmentFileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+}
+
+// observeMerge runs the merge reporting it to the merge observer.
+func (db *Db) observeMerge(merge func() error) error {
+	start := time.Now()
+	err := merge()
+	if db.mergeObserver != nil {
+		db.mergeObserver(time.Since(start), err)
+	}
+	return err
+}
+
+// merge rewrites all the segments except the current one into a single
+// segment keeping only the latest value of every key. The merged segment
+// takes the number of the newest segment it replaces. It must be called
+// with db.mergeMu held.
+func (db *Db) merge() error {
+	db.mu.RLock()
+	segments := make([]*Segment, len(db.segments)-1)
+	copy(segments, db.segments)
+	db.mu.RUnlock()
+	if len(segments) == 0 {
+		return nil
+	}
+
+	id := segments[len(segments)-1].id
+	finalPath := db.segmentFileName(id)
+	tmpPath := finalPath + mergeTmpSuffix
+	newSegmentFile, err := db.fs.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
-		return
+		return err
+	}
+	var written *Segment
+	if db.history.enabled() {
+		written, err = db.history.writeMerged(newSegmentFile, segments, db.operators, db.now(), db.closed)
+	} else {
+		written, err = writeMerged(newSegmentFile, segments, db.operators, db.closed)
+	}
+	if err == nil {
+		err = newSegmentFile.Sync()
 	}
-	lastSegmentIndex := len(db.segments) - 2
-	for i := 0; i <= lastSegmentIndex; i++ {
-		segment := db.segments[i]
-		for key, index := range segment.index {
-			if i < lastSegmentIndex {
-				isInNewerSegments := hasKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key)
-				if isInNewerSegments {
-					continue
+	if closeErr := newSegmentFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return err
+	}
+
+	commitPath := finalPath + mergeCommitSuffix
+	if err := db.fs.Rename(tmpPath, commitPath); err != nil {
+		db.fs.Remove(tmpPath)
+		return err
+	}
+	newSegment, err := db.openSegment(id, commitPath)
+	if err != nil {
+		return err
+	}
+	newSegment.filePath = finalPath
+	newSegment.index = written.index
+	newSegment.merges = written.merges
+	newSegment.history = written.history
+	newSegment.outOffset = written.outOffset
+
+	db.mu.Lock()
+	db.segments = append([]*Segment{newSegment}, db.segments[len(segments):]...)
+	for _, segment := range segments {
+		db.compactedSeq = max(db.compactedSeq, segment.maxSeq)
+	}
+	db.mu.Unlock()
+
+	for _, segment := range segments {
+		segment.readers.Wait()
+		segment.file.Close()
+	}
+	return db.finishMerge(id, segments)
+}
+
+// writeMerged writes the latest live value of every key in segments to out
+// folding the merge entries. The entries of a key the operators fail to fold
+// are copied as they are. It gives up with ErrClosed once stop is closed.
+func writeMerged(out io.Writer, segments []*Segment, ops mergeOperators, stop <-chan struct{}) (*Segment, error) {
+	merged := &Segment{index: make(hashIndex)}
+	for i, segment := range segments {
+		for key, position := range segment.index {
+			select {
+			case <-stop:
+				return nil, ErrClosed
+			default:
+			}
+			if hasKeyInSegments(segments[i+1:], key) {
+				continue
+			}
+			if position == deletedOffset && len(segment.merges[key]) == 0 {
+				continue
+			}
+			entries, err := readChain(keyChain(segments[:i+1], key))
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) > 1 || entries[0].kind == kindMerge {
+				if folded, err := ops.foldEntries(entries); err == nil {
+					entries = []entry{folded}
+				} else {
+					log.Printf("Keeping the merge entries unfolded: %s", err)
 				}
 			}
-			value, _ := segment.fetchValueFromSegment(index)
-			entry := entry{
-				key:   key,
-				value: value,
+			for j := range entries {
+				if err := merged.appendEntry(out, &entries[j]); err != nil {
+					return nil, err
+				}
 			}
-			n, err := newSegmentFile.Write(entry.Encode())
-			if err == nil {
-				newSegment.index[key] = offset
-				offset += int64(n)
+		}
+	}
+	return merged, nil
+}
+
+// appendEntry writes the entry to out at the end of the segment being
+// built by a merge.
+func (segment *Segment) appendEntry(out io.Writer, e *entry) error {
+	n, err := out.Write(e.Encode())
+	if err != nil {
+		return err
+	}
+	segment.add(e, segment.outOffset)
+	segment.outOffset += int64(n)
+	return nil
+}
+
+// finishMerge replaces the files of the merged segments with the committed
+// merge result. It is also used on recovery to complete an interrupted merge.
+func (db *Db) finishMerge(id int, segments []*Segment) error {
+	for _, segment := range segments {
+		if segment.id == id {
+			continue
+		}
+		if err := db.fs.Remove(segment.filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	path := db.segmentFileName(id)
+	return db.fs.Rename(path+mergeCommitSuffix, path)
+}
+
+// dataDir lists the files found in a data directory.
+type dataDir struct {
+	dir string
+	// paths maps segment numbers to their files.
+	paths map[int]string
+	// committed holds the sorted numbers of the merges waiting for finishMerge.
+	committed []int
+	// tmp lists the results of merges that were never committed.
+	tmp []string
+}
+
+func readDataDir(fs FS, dir string) (*dataDir, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := &dataDir{dir: dir, paths: make(map[int]string)}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		number, suffix, _ := strings.Cut(name[len(outFileName):], ".")
+		id, err := strconv.Atoi(number)
+		if err != nil {
+			continue
+		}
+		switch "." + suffix {
+		case ".":
+			contents.paths[id] = filepath.Join(dir, name)
+		case mergeCommitSuffix:
+			contents.committed = append(contents.committed, id)
+		case mergeTmpSuffix:
+			contents.tmp = append(contents.tmp, filepath.Join(dir, name))
+		}
+	}
+	sort.Ints(contents.committed)
+	return contents, nil
+}
+
+// resolveMerges replaces the segments covered by committed merges with the
+// merge results. finish completes every merge on disk; when it is nil the
+// committed files are read in place.
+func (d *dataDir) resolveMerges(finish func(id int, merged []*Segment) error) error {
+	for _, mergedID := range d.committed {
+		var merged []*Segment
+		for id, path := range d.paths {
+			if id <= mergedID {
+				merged = append(merged, &Segment{id: id, filePath: path})
+				delete(d.paths, id)
 			}
 		}
+		path := filepath.Join(d.dir, fmt.Sprintf("%s%d", outFileName, mergedID))
+		if finish == nil {
+			d.paths[mergedID] = path + mergeCommitSuffix
+			continue
+		}
+		if err := finish(mergedID, merged); err != nil {
+			return err
+		}
+		d.paths[mergedID] = path
 	}
-	db.segments = []*Segment{newSegment, db.getCurrentSegment()}
+	d.committed = nil
+	return nil
 }
 
+// ids returns the segment numbers in write order.
+func (d *dataDir) ids() []int {
+	ids := make([]int, 0, len(d.paths))
+	for id := range d.paths {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
 
 func hasKeyInSegments(segments []*Segment, keyToFind string) bool {
 	for _, segment := range segments {
@@ -186,55 +648,244 @@ func hasKeyInSegments(segments []*Segment, keyToFind string) bool {
 	return false
 }
 
+// recoverData loads the segments found in the data directory and opens the
+// newest one for writing. A read-only Db leaves the directory untouched.
 func (db *Db) recoverData() error {
-	var err error
-	buf := make([]byte, bufferSize)
-
-	reader := bufio.NewReaderSize(db.out, bufferSize)
-	for err == nil {
-		var (
-			header []byte
-			data   []byte
-			n      int
-		)
-		header, err = reader.Peek(bufferSize)
-		if err == io.EOF {
-			if len(header) == 0 {
+	contents, err := readDataDir(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	if !db.readOnly {
+		for _, tmpPath := range contents.tmp {
+			if err := db.fs.Remove(tmpPath); err != nil {
 				return err
 			}
-		} else if err != nil {
-			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
+	}
+	if db.readOnly {
+		contents.resolveMerges(nil)
+	} else if err := contents.resolveMerges(db.finishMerge); err != nil {
+		return err
+	}
 
-		if size < bufferSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+	for _, id := range contents.ids() {
+		segment, err := db.openSegment(id, contents.paths[id])
+		if err != nil {
+			return err
 		}
-		n, err = reader.Read(data)
-
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+		db.segments = append(db.segments, segment)
+		tornTail, err := segment.load(db.track)
+		if err != nil {
+			return err
+		}
+		if tornTail && !db.readOnly {
+			if db.strictRecovery {
+				return fmt.Errorf("%w: %s has an incomplete entry at offset %d", ErrCorrupted, segment.filePath, segment.outOffset)
 			}
+			if err := db.repairTail(segment); err != nil {
+				return err
+			}
+		}
+		db.lastSegmentIndex = id + 1
+	}
+
+	db.recountBuckets()
+	// Any segment but the current one may be a merge result.
+	for _, segment := range db.segments[:max(len(db.segments)-1, 0)] {
+		db.compactedSeq = max(db.compactedSeq, segment.maxSeq)
+	}
+	db.writeSeq = db.seq
+
+	if db.readOnly {
+		return nil
+	}
+	if len(db.segments) == 0 {
+		return db.createNewSegment()
+	}
+	current := db.getCurrentSegment()
+	db.out, err = db.fs.OpenFile(current.filePath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	db.outOffset = current.outOffset
+	return nil
+}
+
+// load builds the index of the segment from its file passing every entry
+// to track. It reports whether the file ends with a partially written
+// entry, which is ignored.
+func (segment *Segment) load(track func(e *entry)) (bool, error) {
+	reader := bufio.NewReaderSize(io.NewSectionReader(segment.file, 0, maxSegmentOffset), bufferSize)
+	size, err := scanEntries(reader, func(e *entry, offset int64) error {
+		segment.add(e, offset)
+		track(e)
+		return nil
+	})
+	segment.outOffset = size
+	if err == errIncompleteEntry {
+		return true, nil
+	} else if err == errCorruptedEntry {
+		return false, fmt.Errorf("%w: %s has a damaged entry at offset %d", ErrCorrupted, segment.filePath, size)
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// corruptSuffix is added to the segment file name to get the file keeping
+// the bytes cut off the segment by repairTail.
+const corruptSuffix = ".corrupt"
 
-			entry := entry{}
-			entry.Decode(data)
-			db.updateOffset(entry.key, int64(n))
+// repairTail truncates the segment file right after its last complete
+// entry. The discarded bytes are appended to a .corrupt file next to it.
+func (db *Db) repairTail(segment *Segment) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, info.Size()-segment.outOffset)
+	if _, err := segment.file.ReadAt(tail, segment.outOffset); err != nil {
+		return err
+	}
+
+	corruptPath := segment.filePath + corruptSuffix
+	corruptFile, err := db.fs.OpenFile(corruptPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = corruptFile.Write(tail)
+	if err == nil {
+		err = corruptFile.Sync()
+	}
+	if closeErr := corruptFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	segmentFile, err := db.fs.OpenFile(segment.filePath, os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer segmentFile.Close()
+	if err := segmentFile.Truncate(segment.outOffset); err != nil {
+		return err
+	}
+	if err := segmentFile.Sync(); err != nil {
+		return err
+	}
+	log.Printf("Discarded %d bytes of an incomplete entry at offset %d of %s, saved them to %s",
+		len(tail), segment.outOffset, segment.filePath, corruptPath)
+	return nil
+}
+
+// begin registers an operation so that Close waits for it. It fails with
+// ErrClosed once Close is called. Every successful begin must be paired
+// with db.pending.Done.
+func (db *Db) begin() error {
+	db.lifecycle.RLock()
+	defer db.lifecycle.RUnlock()
+	if db.closing {
+		return ErrClosed
+	}
+	db.pending.Add(1)
+	return nil
+}
+
+// Close stops accepting operations, completes the ones already started,
+// cancels the background merge, syncs and closes all the files. Every
+// operation after Close, Close included, fails with ErrClosed.
+func (db *Db) Close() error {
+	db.lifecycle.Lock()
+	if db.closing {
+		db.lifecycle.Unlock()
+		return ErrClosed
+	}
+	db.closing = true
+	close(db.stopping)
+	db.lifecycle.Unlock()
+
+	db.pending.Wait()
+	close(db.closed)
+	db.routines.Wait()
+
+	db.mu.Lock()
+	if db.mergeTimer != nil {
+		db.mergeTimer.Stop()
+	}
+	db.mu.Unlock()
+	// A running merge notices db.closed and stops, a later one does not start.
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	return db.closeFiles()
+}
+
+// Sync makes the writes completed before the call durable.
+func (db *Db) Sync() error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+	return db.write(context.Background(), putOperation{sync: true})
+}
+
+func (db *Db) closeFiles() error {
+	var err error
+	if db.out != nil {
+		err = db.out.Sync()
+		if closeErr := db.out.Close(); err == nil {
+			err = closeErr
 		}
 	}
+	db.closeSegments()
+	if lockErr := db.lock.release(); err == nil {
+		err = lockErr
+	}
 	return err
 }
-func (db *Db) Close() error {
-	return db.out.Close()
+
+func (db *Db) closeSegments() {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, segment := range db.segments {
+		segment.file.Close()
+	}
+}
+
+// checkWritable rejects the writes of the clients to the read-only Db and
+// to the followers.
+func (db *Db) checkWritable() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.follower.Load() {
+		return ErrNotLeader
+	}
+	return nil
 }
 
-func (db *Db) updateOffset(key string, dataSize int64) {
+// updateOffset indexes an entry of the given size appended to the current segment.
+func (db *Db) updateOffset(e *entry, dataSize int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	lastSegment := db.getCurrentSegment()
-	lastSegment.index[key] = db.outOffset
+	lastSegment.add(e, db.outOffset)
+	db.track(e)
 	db.outOffset += dataSize
+	lastSegment.outOffset = db.outOffset
+	db.notifyAppended()
 }
+
+// notifyAppended wakes up the replication streams waiting for new entries.
+// It must be called with db.mu held.
+func (db *Db) notifyAppended() {
+	close(db.appended)
+	db.appended = make(chan struct{})
+}
+
+// locateKey finds the newest segment containing the key. It must be called
+// with db.mu held.
 func (db *Db) locateKey(searchKey string) (*Segment, int64, error) {
 	for segmentIndex := len(db.segments) - 1; segmentIndex >= 0; segmentIndex-- {
 		currentSegment := db.segments[segmentIndex]
@@ -247,86 +898,445 @@ func (db *Db) locateKey(searchKey string) (*Segment, int64, error) {
 	return nil, 0, ErrNotFound
 }
 
-func (db *Db) fetchKeyPosition(searchKey string) *KeyPosition {
-	indexOperation := indexOperation{
-		isWrite: false,
-		key:     searchKey,
+// fetchKeyChain asks the index routine for the positions making up the
+// latest value of the key. The returned segment readers must be released
+// by the caller.
+func (db *Db) fetchKeyChain(ctx context.Context, searchKey string) ([]KeyPosition, error) {
+	op := indexOperation{
+		key:   searchKey,
+		reply: make(chan []KeyPosition, 1),
+	}
+	select {
+	case db.indexOperations <- op:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case chain := <-op.reply:
+		return chain, nil
+	case <-ctx.Done():
+		// The routine still replies, release the readers it may have taken.
+		go func() {
+			for _, position := range <-op.reply {
+				position.segment.readers.Done()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	db.indexOperations <- indexOperation
-	return <-db.positionLookups
 }
 
 func (db *Db) Get(key string) (string, error) {
-	keyPos := db.fetchKeyPosition(key)
-	if keyPos == nil {
-		return "", ErrNotFound
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is Get giving up when ctx is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	return db.get(ctx, defaultBucketID, key)
+}
+
+func (db *Db) get(ctx context.Context, bucket uint32, key string) (string, error) {
+	item, err := db.getItem(ctx, bucket, key)
+	return item.Value, err
+}
+
+// Item is the value of a key with the version and the time of its latest
+// write, a put or a merge.
+type Item struct {
+	Value    string
+	Version  uint64
+	Modified time.Time
+}
+
+// GetItem is GetContext returning the version and the time of the latest
+// write of the key along with its value.
+func (db *Db) GetItem(ctx context.Context, key string) (Item, error) {
+	return db.getItem(ctx, defaultBucketID, key)
+}
+
+func (db *Db) getItem(ctx context.Context, bucket uint32, key string) (Item, error) {
+	if err := db.limits.checkKey(key); err != nil {
+		return Item{}, err
+	}
+	if err := db.begin(); err != nil {
+		return Item{}, err
 	}
-	value, err := keyPos.segment.fetchValueFromSegment(keyPos.offset)
+	defer db.pending.Done()
+	chain, err := db.fetchKeyChain(ctx, indexKey(bucket, key))
 	if err != nil {
-		return "", err
+		return Item{}, err
 	}
-	return value, nil
+	if len(chain) == 0 {
+		return Item{}, ErrNotFound
+	}
+	e, err := db.entryOf(chain)
+	if err != nil {
+		return Item{}, err
+	}
+	if db.expired(&e) {
+		return Item{}, ErrNotFound
+	}
+	item := Item{Value: e.value, Version: e.version}
+	if e.timestamp != 0 {
+		item.Modified = time.Unix(0, e.timestamp).UTC()
+	}
+	return item, nil
 }
 
 func (db *Db) getCurrentSegment() *Segment {
 	lastSegmentIndex := len(db.segments) - 1
 	return db.segments[lastSegmentIndex]
 }
+
 func (db *Db) startPutRoutine() {
+	db.routines.Add(1)
 	go func() {
+		defer db.routines.Done()
 		for {
-			entry := <-db.putOperations
-			length := entry.getLength()
-			fileStat, err := db.out.Stat()
-			if err != nil {
-				db.putFinished <- err
-				continue
-			}
-			if fileStat.Size()+length > db.segmentSizeBytes {
-				err := db.createNewSegment()
-				if err != nil {
-					db.putFinished <- err
-					continue
+			select {
+			case op := <-db.putOperations:
+				if op.rotate {
+					op.done <- db.createNewSegment()
+				} else if op.sync {
+					op.done <- db.out.Sync()
+				} else if op.batch != nil {
+					op.done <- db.writeBatch(op.batch)
+				} else if op.replicated {
+					op.done <- db.writeReplicated(op.entry)
+				} else {
+					op.done <- db.writeEntry(op.entry)
 				}
+			case <-db.closed:
+				return
 			}
-			n, err := db.out.Write(entry.Encode())
-			if err == nil {
-				db.indexOperations <- indexOperation{
-					isWrite: true,
-					key:     entry.key,
-					offset:   int64(n),
-				}
-			}
-			db.putFinished <- nil
 		}
 	}()
 }
+
+// writeEntry appends the entry to the current segment, starting a new
+// segment when the current one would grow over segmentSizeBytes.
+func (db *Db) writeEntry(e entry) error {
+	db.stamp(&e, nil)
+	if e.kind == kindDelete {
+		k := e.indexKey()
+		db.mu.RLock()
+		segment, position, err := db.locateKey(k)
+		live := err == nil && (position != deletedOffset || len(segment.merges[k]) > 0)
+		deadline := db.expiries[k]
+		db.mu.RUnlock()
+		if e.expires != 0 {
+			// The expiry does not delete a key written again.
+			live = live && deadline == e.expires
+		} else if deadline != 0 && e.timestamp >= deadline {
+			live = false
+		}
+		if !live {
+			return ErrNotFound
+		}
+		return db.appendEntry(e)
+	}
+	if e.kind == kindMerge {
+		if err := db.checkMerge(&e); err != nil {
+			return err
+		}
+	}
+	if err := db.checkQuota(&e); err != nil {
+		return err
+	} else if err := db.checkMaxSize(&e, 0); err != nil {
+		return err
+	}
+	return db.appendEntry(e)
+}
+
+// appendEntry appends the checked entry to the current segment, starting
+// a new segment when the current one would grow over segmentSizeBytes.
+func (db *Db) appendEntry(e entry) error {
+	if db.outOffset > 0 && db.outOffset+e.getLength() > db.segmentSizeBytes {
+		if err := db.createNewSegment(); err != nil {
+			return err
+		}
+	}
+	data := e.Encode()
+	if err := db.appendOut(data); err != nil {
+		return err
+	}
+	db.updateOffset(&e, int64(len(data)))
+	return nil
+}
+
+// appendOut writes data to the end of the current segment. A failed write
+// may leave a part of the data in the file, it is cut off so that the file
+// keeps matching outOffset. If that fails too, the Db stops writing.
+func (db *Db) appendOut(data []byte) error {
+	if db.writeErr != nil {
+		return db.writeErr
+	}
+	_, err := db.out.Write(data)
+	if err == nil {
+		return nil
+	}
+	if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+		db.writeErr = fmt.Errorf("stopped writing after a failed rollback of %s: %w", db.getCurrentSegment().filePath, truncErr)
+		log.Print(db.writeErr)
+	}
+	return err
+}
+
+// writeBatch appends the put entries to the current segment. The entries
+// fitting into the same segment are written at once.
+func (db *Db) writeBatch(entries []entry) error {
+	var buf []byte
+	pending := entries[:0:0]
+	// The versions of the keys written by the batch but not tracked yet.
+	versions := make(map[string]uint64)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := db.appendOut(buf); err != nil {
+			return err
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		segment := db.getCurrentSegment()
+		for i := range pending {
+			segment.add(&pending[i], db.outOffset)
+			db.track(&pending[i])
+			db.outOffset += pending[i].getLength()
+		}
+		segment.outOffset = db.outOffset
+		db.notifyAppended()
+		buf, pending = buf[:0], pending[:0]
+		return nil
+	}
+
+	for _, e := range entries {
+		db.stamp(&e, versions)
+		if db.hasQuota(e.bucket) {
+			// The usage must include the pending entries.
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := db.checkQuota(&e); err != nil {
+				return err
+			}
+		}
+		if err := db.checkMaxSize(&e, int64(len(buf))); err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+			return err
+		}
+		size := db.outOffset + int64(len(buf))
+		if size > 0 && size+e.getLength() > db.segmentSizeBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := db.createNewSegment(); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, e.Encode()...)
+		pending = append(pending, e)
+	}
+	return flush()
+}
+
+// write passes the operation to the put routine and waits for the result.
+// If ctx is done after the routine took the operation, the operation may
+// still be applied. The caller must hold an operation started with begin.
+func (db *Db) write(ctx context.Context, op putOperation) error {
+	op.done = make(chan error, 1)
+	db.queued.Add(1)
+	select {
+	case db.putOperations <- op:
+		db.queued.Add(-1)
+	case <-ctx.Done():
+		db.queued.Add(-1)
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put giving up when ctx is done.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	return db.put(ctx, defaultBucketID, key, value)
+}
+
+func (db *Db) put(ctx context.Context, bucket uint32, key, value string) error {
 	e := entry{
-		key:   key,
-		value: value,
+		key:    key,
+		value:  value,
+		bucket: bucket,
+	}
+	if err := db.checkEntry(&e); err != nil {
+		return err
 	}
-	db.putOperations <- e
-	return <-db.putFinished
+	return db.apply(ctx, e)
 }
 
+// apply writes the entry through the put routine or the consensus.
+func (db *Db) apply(ctx context.Context, e entry) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+	if db.consensus != nil {
+		return db.propose(ctx, e)
+	}
+	return db.write(ctx, putOperation{entry: e})
+}
 
-func (segment *Segment) fetchValueFromSegment(offset int64) (string, error) {
-	segmentFile, err := os.Open(segment.filePath)
-	if err != nil {
-		return "", err
+// Delete writes a tombstone for the key. The key disappears from the disk
+// once the segments holding it are merged.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete giving up when ctx is done.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.deleteKey(ctx, defaultBucketID, key)
+}
+
+func (db *Db) deleteKey(ctx context.Context, bucket uint32, key string) error {
+	if err := db.limits.checkKey(key); err != nil {
+		return err
 	}
-	defer segmentFile.Close()
+	return db.apply(ctx, entry{
+		key:    key,
+		kind:   kindDelete,
+		bucket: bucket,
+	})
+}
 
-	_, err = segmentFile.Seek(offset, 0)
-	if err != nil {
-		return "", err
+// Scan reads the values of all the live keys with the given prefix in key order.
+func (db *Db) Scan(prefix string, fn func(key, value string) error) error {
+	return db.scan(defaultBucketID, prefix, "", fn)
+}
+
+// ScanAfter is Scan of the keys following after, the keys up to after are
+// skipped without reading their values.
+func (db *Db) ScanAfter(prefix, after string, fn func(key, value string) error) error {
+	return db.scan(defaultBucketID, prefix, after, fn)
+}
+
+func (db *Db) scan(bucket uint32, prefix, after string, fn func(key, value string) error) error {
+	return db.scanEntries(bucket, prefix, after, func(key string, e entry) error {
+		return fn(key, e.value)
+	})
+}
+
+// scanEntries is scan passing the folded entries of the keys.
+func (db *Db) scanEntries(bucket uint32, prefix, after string, fn func(key string, e entry) error) error {
+	if err := db.begin(); err != nil {
+		return err
 	}
+	defer db.pending.Done()
+	chains := db.liveChains(indexKey(bucket, prefix))
+	from := indexKey(bucket, after)
+	keys := make([]string, 0, len(chains))
+	for key, chain := range chains {
+		if key <= from {
+			releaseChain(chain)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	segmentReader := bufio.NewReader(segmentFile)
+	var err error
+	for _, key := range keys {
+		if err != nil {
+			releaseChain(chains[key])
+			continue
+		}
+		var e entry
+		e, err = db.entryOf(chains[key])
+		if err == nil && !db.expired(&e) {
+			_, userKey := splitIndexKey(key)
+			err = fn(userKey, e)
+		}
+	}
+	return err
+}
+
+// Stats describes the whole datastore, the keys of all the buckets included.
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := Stats{
+		Segments:    len(db.segments),
+		Replication: db.replicationStats(),
+	}
+	var live int64
+	for _, state := range db.bucketIDs {
+		stats.Keys += state.keys
+		live += state.bytes
+	}
+	for _, segment := range db.segments {
+		stats.Bytes += segment.outOffset
+	}
+	stats.DeadBytes = max(stats.Bytes-live, 0)
+	stats.WriteQueue = int(db.queued.Load())
+	stats.Expiring = len(db.expiries)
+	return stats
+}
+
+// liveChains resolves the latest value positions of every non-deleted key
+// with the prefix, see keyChain. Every returned segment reader must be
+// released by the caller.
+func (db *Db) liveChains(prefix string) map[string][]KeyPosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return collectChains(db.segments, prefix)
+}
+
+// collectChains is liveChains for the segments, it must be called with
+// db.mu held.
+func collectChains(segments []*Segment, prefix string) map[string][]KeyPosition {
+	seen := make(map[string]struct{})
+	chains := make(map[string][]KeyPosition)
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		for key := range segment.index {
+			if _, ok := seen[key]; ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			seen[key] = struct{}{}
+			if chain := keyChain(segments[:i+1], key); len(chain) > 0 {
+				chains[key] = chain
+			}
+		}
+	}
+	return chains
+}
+
+// maxSegmentOffset bounds the section readers over segment files, which
+// keep growing while they are read.
+const maxSegmentOffset = 1<<63 - 1
+
+func (segment *Segment) fetchValueFromSegment(offset int64) (string, error) {
+	segmentReader := bufio.NewReader(io.NewSectionReader(segment.file, offset, maxSegmentOffset-offset))
 	value, err := readValue(segmentReader)
 	if err != nil {
 		return "", err
 	}
 	return value, nil
 }
+
+func (segment *Segment) fetchEntry(offset int64) (entry, error) {
+	return readEntry(bufio.NewReader(io.NewSectionReader(segment.file, offset, maxSegmentOffset-offset)))
+}
@@ -18,7 +18,7 @@ func TestDb_Put(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a new instance of the database in the temporary directory
-	dbInstance, err := NewDb(tempDir, 150)
+	dbInstance, err := NewDb(tempDir, 400)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,8 +112,11 @@ func TestDb_Segmentation(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
+	// Every record below has the same size, two of them fit into a segment
+	recordSize := (&entry{key: "key1", value: "value1"}).getLength()
+
 	// Create a new instance of the database in the temporary directory
-	dbInstance, err := NewDb(tempDir, 45)
+	dbInstance, err := NewDb(tempDir, 2*recordSize+recordSize/2)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,8 +128,8 @@ func TestDb_Segmentation(t *testing.T) {
 		dbInstance.Put("key3", "value3")
 		dbInstance.Put("key2", "value5")
 
-		if len(dbInstance.segments) != 2 {
-			t.Errorf("Expected 2 files, got %d", len(dbInstance.segments))
+		if len(dbInstance.Segments()) != 2 {
+			t.Errorf("Expected 2 files, got %d", len(dbInstance.Segments()))
 		}
 	})
 
@@ -135,14 +138,14 @@ func TestDb_Segmentation(t *testing.T) {
 	t.Run("should remove segment after time", func(t *testing.T) {
 		dbInstance.Put("key4", "value4")
 
-		segmentCount := len(dbInstance.segments)
+		segmentCount := len(dbInstance.Segments())
 		if segmentCount != 3 {
 			t.Errorf("Expected 3 segments, got %d", segmentCount)
 		}
 
 		time.Sleep(2 * time.Second)
 
-		segmentCount = len(dbInstance.segments)
+		segmentCount = len(dbInstance.Segments())
 		if segmentCount != 2 {
 			t.Errorf("Expected 2 segments, got %d", segmentCount)
 		}
@@ -150,12 +153,12 @@ func TestDb_Segmentation(t *testing.T) {
 
 
 	t.Run("shouldn't store duplicate key values", func(t *testing.T) {
-		fileInfo, err := os.Stat(dbInstance.segments[0].filePath)
+		fileInfo, err := os.Stat(dbInstance.Segments()[0].Path)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		expectedSize := int64(66)
+		expectedSize := 3 * recordSize
 		if fileInfo.Size() != expectedSize {
 			t.Errorf("Expected file size %d, but got %d", expectedSize, fileInfo.Size())
 		}
@@ -3,82 +3,221 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Entry kinds stored in the entry header.
+const (
+	kindPut byte = iota
+	kindDelete
+	kindMerge
+)
+
+// An encoded entry is laid out as follows, all the integers are little endian:
+//
+//	size     uint32  total size of the entry
+//	checksum uint32  CRC-32 (IEEE) of everything after this field
+//	kind     byte
+//	bucket   uint32  id of the bucket the key belongs to
+//	seq      uint64  position of the write in the log of the datastore
+//	version  uint64  number of the write of the key, starting at 1
+//	time     int64   write time in Unix nanoseconds
+//	key      uint32 length followed by the key bytes
+//	value    uint32 length followed by the value bytes
+//	expires  int64   expiry time in Unix nanoseconds, only present if it is set
+const (
+	checksumOffset  = 4
+	kindOffset      = 8
+	bucketOffset    = 9
+	seqOffset       = 13
+	versionOffset   = 21
+	timestampOffset = 29
+	keyOffset       = 37
+)
+
+// entryHeaderSize is the size of the fixed part of an encoded entry.
+const entryHeaderSize = keyOffset + 4 + 4
+
+// expiresSize is the size of the optional expiry time after the value.
+const expiresSize = 8
+
+var (
+	errCorruptedEntry  = errors.New("corrupted entry")
+	errIncompleteEntry = errors.New("incomplete entry")
 )
 
 type entry struct {
 	key, value string
+	kind       byte
+	bucket     uint32
+	seq        uint64
+	version    uint64
+	timestamp  int64
+	// expires is the expiry time of a put, see Db.PutExpiring, or the one
+	// a delete of the expiry is conditioned on.
+	expires int64
+}
+
+// indexKey is the key of the entry in the segment indexes.
+func (e *entry) indexKey() string {
+	return indexKey(e.bucket, e.key)
+}
+
+// indexKey prefixes the key with the big endian bucket id, so the keys of
+// a bucket share a prefix and keep their order.
+func indexKey(bucket uint32, key string) string {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], bucket)
+	return string(prefix[:]) + key
+}
+
+// splitIndexKey is the reverse of indexKey.
+func splitIndexKey(k string) (uint32, string) {
+	return binary.BigEndian.Uint32([]byte(k[:4])), k[4:]
 }
 
 // calcEntrySize calculates the size of entry in bytes
 func calcEntrySize(key string, value string) int64 {
 	keySize := int64(len(key))
 	valueSize := int64(len(value))
-	headerSize := int64(8)
-	totalSize := headerSize + keySize + valueSize
+	totalSize := entryHeaderSize + keySize + valueSize
 	return totalSize
 }
 
 func (e *entry) getLength() int64 {
-	return calcEntrySize(e.key, e.value)
+	size := calcEntrySize(e.key, e.value)
+	if e.expires != 0 {
+		size += expiresSize
+	}
+	return size
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 12
+	size := int(e.getLength())
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	res[kindOffset] = e.kind
+	binary.LittleEndian.PutUint32(res[bucketOffset:], e.bucket)
+	binary.LittleEndian.PutUint64(res[seqOffset:], e.seq)
+	binary.LittleEndian.PutUint64(res[versionOffset:], e.version)
+	binary.LittleEndian.PutUint64(res[timestampOffset:], uint64(e.timestamp))
+	binary.LittleEndian.PutUint32(res[keyOffset:], uint32(kl))
+	copy(res[keyOffset+4:], e.key)
+	binary.LittleEndian.PutUint32(res[keyOffset+4+kl:], uint32(vl))
+	copy(res[keyOffset+8+kl:], e.value)
+	if e.expires != 0 {
+		binary.LittleEndian.PutUint64(res[size-expiresSize:], uint64(e.expires))
+	}
+	binary.LittleEndian.PutUint32(res[checksumOffset:], crc32.ChecksumIEEE(res[kindOffset:]))
 	return res
 }
 
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryHeaderSize {
+		return errCorruptedEntry
+	}
+	if binary.LittleEndian.Uint32(input[checksumOffset:]) != crc32.ChecksumIEEE(input[kindOffset:]) {
+		return errCorruptedEntry
+	}
+	e.kind = input[kindOffset]
+	e.bucket = binary.LittleEndian.Uint32(input[bucketOffset:])
+	e.seq = binary.LittleEndian.Uint64(input[seqOffset:])
+	e.version = binary.LittleEndian.Uint64(input[versionOffset:])
+	e.timestamp = int64(binary.LittleEndian.Uint64(input[timestampOffset:]))
+	kl := int(binary.LittleEndian.Uint32(input[keyOffset:]))
+	if kl+entryHeaderSize > len(input) {
+		return errCorruptedEntry
+	}
+	e.key = string(input[keyOffset+4 : keyOffset+4+kl])
 
+	vl := int(binary.LittleEndian.Uint32(input[keyOffset+4+kl:]))
+	switch len(input) - kl - vl - entryHeaderSize {
+	case 0:
+		e.expires = 0
+	case expiresSize:
+		e.expires = int64(binary.LittleEndian.Uint64(input[len(input)-expiresSize:]))
+	default:
+		return errCorruptedEntry
+	}
+	e.value = string(input[keyOffset+8+kl : keyOffset+8+kl+vl])
+	return nil
+}
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
+// scanEntries decodes the entries read from r and calls fn with each of
+// them and its offset. It returns the size of the successfully decoded
+// prefix; if the input ends in the middle of an entry or its last entry is
+// damaged, errIncompleteEntry is returned along with the offset where that
+// entry starts.
+func scanEntries(r io.Reader, fn func(e *entry, offset int64) error) (int64, error) {
+	var offset int64
+	sizeBuf := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(r, sizeBuf)
+		if err == io.EOF {
+			return offset, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return offset, errIncompleteEntry
+		} else if err != nil {
+			return offset, err
+		}
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
+		size := binary.LittleEndian.Uint32(sizeBuf)
+		if size < entryHeaderSize {
+			return offset, errCorruptedEntry
+		}
+		data := make([]byte, size)
+		copy(data, sizeBuf)
+		if _, err := io.ReadFull(r, data[4:]); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return offset, errIncompleteEntry
+		} else if err != nil {
+			return offset, err
+		}
+
+		var e entry
+		if err := e.Decode(data); err != nil {
+			// A damaged last entry is a write that did not complete.
+			if _, readErr := io.ReadFull(r, sizeBuf[:1]); readErr == io.EOF {
+				return offset, errIncompleteEntry
+			}
+			return offset, err
+		}
+		if err := fn(&e, offset); err != nil {
+			return offset, err
+		}
+		offset += int64(size)
+	}
 }
 
+// readValue reads the entry at the reader position and returns its value
+// after verifying the checksum.
 func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	e, err := readEntry(in)
 	if err != nil {
 		return "", err
 	}
+	return e.value, nil
+}
 
-	header, err = in.Peek(4)
+// readEntry reads and decodes the entry at the reader position.
+func readEntry(in *bufio.Reader) (entry, error) {
+	var e entry
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", err
+		return e, err
 	}
-
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
+	size := binary.LittleEndian.Uint32(header)
+	if size < entryHeaderSize {
+		return e, errCorruptedEntry
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return e, fmt.Errorf("can't read entry bytes (expected %d): %w", size, err)
 	}
-
-	return string(data), nil
+	err = e.Decode(data)
+	return e, err
 }
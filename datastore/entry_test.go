@@ -7,18 +7,36 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
-	e.Decode(e.Encode())
-	if e.key != "key" {
-		t.Error("incorrect key")
+	for _, e := range []entry{
+		{key: "key", value: "value", bucket: 7, seq: 11, version: 3, timestamp: 1700000000000000000},
+		{key: "key", value: "value", version: 1, timestamp: 1700000000000000000, expires: 1700000001000000000},
+	} {
+		data := e.Encode()
+		if int64(len(data)) != e.getLength() {
+			t.Errorf("Encoded %d bytes, expected %d", len(data), e.getLength())
+		}
+		var decoded entry
+		if err := decoded.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != e {
+			t.Errorf("Decoded %+v, expected %+v", decoded, e)
+		}
 	}
-	if e.value != "value" {
-		t.Error("incorrect value")
+}
+
+func TestIndexKey(t *testing.T) {
+	k := indexKey(258, "key")
+	if bucket, key := splitIndexKey(k); bucket != 258 || key != "key" {
+		t.Errorf("Unexpected split of the index key: %d %q", bucket, key)
+	}
+	if indexKey(1, "z") > indexKey(2, "a") {
+		t.Error("The keys of a bucket must sort before the keys of the next one")
 	}
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
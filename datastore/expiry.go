@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// expiryInterval is how often the expired keys are deleted. They are not
+// read in between already.
+const expiryInterval = 100 * time.Millisecond
+
+// PutExpiring is Put of a value that expires at the given time. The expiry
+// time is stored with the value, so it survives the restarts and reaches
+// the followers. An expired key is not read and is deleted in the
+// background. A later put of the key, expiring or not, replaces the expiry
+// time, the merges keep it.
+func (db *Db) PutExpiring(key, value string, expires time.Time) error {
+	return db.PutExpiringContext(context.Background(), key, value, expires)
+}
+
+// PutExpiringContext is PutExpiring giving up when ctx is done.
+func (db *Db) PutExpiringContext(ctx context.Context, key, value string, expires time.Time) error {
+	return db.putExpiring(ctx, defaultBucketID, key, value, expires)
+}
+
+func (db *Db) putExpiring(ctx context.Context, bucket uint32, key, value string, expires time.Time) error {
+	e := entry{
+		key:     key,
+		value:   value,
+		bucket:  bucket,
+		expires: expires.UnixNano(),
+	}
+	if err := db.checkEntry(&e); err != nil {
+		return err
+	}
+	return db.apply(ctx, e)
+}
+
+// PutExpiring writes the value expiring at the given time to the key of
+// the bucket, see Db.PutExpiring.
+func (b *Bucket) PutExpiring(key, value string, expires time.Time) error {
+	return b.db.putExpiring(context.Background(), b.id, key, value, expires)
+}
+
+// PutExpiringContext is PutExpiring giving up when ctx is done.
+func (b *Bucket) PutExpiringContext(ctx context.Context, key, value string, expires time.Time) error {
+	return b.db.putExpiring(ctx, b.id, key, value, expires)
+}
+
+// expired tells if the folded entry is past its expiry time.
+func (db *Db) expired(e *entry) bool {
+	return e.expires != 0 && db.now().UnixNano() >= e.expires
+}
+
+// expiredAt tells if the key has expired by the time t in Unix
+// nanoseconds. It must be called with db.mu held.
+func (db *Db) expiredAt(k string, t int64) bool {
+	deadline, ok := db.expiries[k]
+	return ok && t >= deadline
+}
+
+// startExpiryRoutine deletes the expired keys every expiryInterval. The
+// deletes carry the expiry time they are made for, so a key written again
+// in the meantime stays.
+func (db *Db) startExpiryRoutine() {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.routines.Add(1)
+	go func() {
+		defer db.routines.Done()
+		defer cancel()
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.deleteExpired(ctx)
+			case <-db.stopping:
+				return
+			}
+		}
+	}()
+	// Close waits for the deletes in progress, they must not wait for the
+	// consensus any longer.
+	go func() {
+		<-db.stopping
+		cancel()
+	}()
+}
+
+func (db *Db) deleteExpired(ctx context.Context) {
+	if db.follower.Load() {
+		return
+	}
+	var expired []entry
+	db.mu.RLock()
+	if len(db.expiries) == 0 {
+		db.mu.RUnlock()
+		return
+	}
+	now := db.now().UnixNano()
+	for k, deadline := range db.expiries {
+		if now >= deadline {
+			bucket, key := splitIndexKey(k)
+			expired = append(expired, entry{key: key, kind: kindDelete, bucket: bucket, expires: deadline})
+		}
+	}
+	db.mu.RUnlock()
+	for _, e := range expired {
+		err := db.apply(ctx, e)
+		switch {
+		case err == nil, errors.Is(err, ErrNotFound):
+		case errors.Is(err, ErrNotLeader), errors.Is(err, ErrClosed), ctx.Err() != nil:
+			return
+		default:
+			log.Printf("Failed to delete the expired key %s: %s", e.key, err)
+		}
+	}
+}
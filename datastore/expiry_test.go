@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDb_PutExpiring(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := db.PutExpiring("kept", "1", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutExpiring("expired", "2", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "1" {
+		t.Errorf("Got %q, %v for the key expiring later", value, err)
+	}
+	if _, err := db.Get("expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for the expired key, got %v", err)
+	}
+	if err := db.Scan("", func(key, value string) error {
+		if key == "expired" {
+			t.Error("The expired key is scanned")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The merges keep the expiry time, the puts replace it.
+	if err := db.PutExpiring("counter", "5", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("counter", AddOperator, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutExpiring("plain", "1", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "2"); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.RLock()
+	counterExpires := db.expiries[indexKey(defaultBucketID, "counter")]
+	_, plainExpires := db.expiries[indexKey(defaultBucketID, "plain")]
+	db.mu.RUnlock()
+	if counterExpires != later.UnixNano() {
+		t.Errorf("The merge changed the expiry time to %d", counterExpires)
+	}
+	if plainExpires {
+		t.Error("The put kept the expiry time")
+	}
+	if value, err := db.Get("counter"); err != nil || value != "7" {
+		t.Errorf("Got %q, %v for the merged key", value, err)
+	}
+
+	// A delete of the expiry does not delete the key written again.
+	err = db.apply(context.Background(), entry{key: "kept", kind: kindDelete, expires: later.UnixNano() - 1})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for the delete of another expiry, got %v", err)
+	}
+	if _, err := db.Get("kept"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 50 && db.Stats().Expiring != 2; i++ {
+		time.Sleep(expiryInterval)
+	}
+	if stats := db.Stats(); stats.Expiring != 2 || stats.Keys != 3 {
+		t.Errorf("The expired key is not deleted: %+v", stats)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.mu.RLock()
+	keptExpires := db.expiries[indexKey(defaultBucketID, "kept")]
+	db.mu.RUnlock()
+	if keptExpires != later.UnixNano() {
+		t.Errorf("The expiry time is %d after the reopen, expected %d", keptExpires, later.UnixNano())
+	}
+	if stats := db.Stats(); stats.Expiring != 2 {
+		t.Errorf("Expected 2 expiring keys after the reopen, got %d", stats.Expiring)
+	}
+}
+
+func TestDb_MergeExpired(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutExpiring("counter", "5", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("counter", AddOperator, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("counter"); err != nil || value != "2" {
+		t.Errorf("Got %q, %v for the merge into the expired value", value, err)
+	}
+	if stats := db.Stats(); stats.Expiring != 0 {
+		t.Errorf("The merge into the expired value kept the expiry: %+v", stats)
+	}
+}
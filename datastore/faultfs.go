@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrCrashed is returned by every FaultFS operation after the simulated crash.
+var ErrCrashed = errors.New("simulated crash")
+
+// FaultFS wraps another FS and injects failures into it. It is meant for
+// testing how the datastore behaves with torn writes and failing disks.
+type FaultFS struct {
+	FS FS
+
+	mu         sync.Mutex
+	written    int64
+	crashAt    int64
+	spaceLeft  int64
+	shortWrite int
+	syncErr    error
+	crashed    bool
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{
+		FS:        fs,
+		crashAt:   -1,
+		spaceLeft: -1,
+	}
+}
+
+// CrashAfter makes the process "die" once n more bytes are written: the
+// write crossing the limit is torn and every following operation fails.
+func (f *FaultFS) CrashAfter(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAt = f.written + n
+	if n <= 0 {
+		f.crashed = true
+	}
+}
+
+// LimitSpace makes writes fail with ENOSPC once n more bytes are written.
+// A negative n removes the limit.
+func (f *FaultFS) LimitSpace(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spaceLeft = n
+}
+
+// ShortWriteAfter makes the nth write from now store only half of its data
+// and return io.ErrShortWrite.
+func (f *FaultFS) ShortWriteAfter(nth int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shortWrite = nth
+}
+
+// FailSync makes every Sync return err. A nil err restores normal syncs.
+func (f *FaultFS) FailSync(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncErr = err
+}
+
+// Crashed reports whether the simulated crash has happened.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+func (f *FaultFS) check() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.FS.Stat(name)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.FS.ReadDir(name)
+}
+
+// allowWrite decides how many bytes of a write of size n reach the disk
+// and which error the write reports.
+func (f *FaultFS) allowWrite(n int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return 0, ErrCrashed
+	}
+
+	allowed, err := n, error(nil)
+	if f.shortWrite > 0 {
+		f.shortWrite--
+		if f.shortWrite == 0 {
+			allowed, err = n/2, io.ErrShortWrite
+		}
+	}
+	if f.spaceLeft >= 0 && int64(allowed) > f.spaceLeft {
+		allowed, err = int(f.spaceLeft), syscall.ENOSPC
+	}
+	if f.crashAt >= 0 && f.written+int64(allowed) >= f.crashAt {
+		allowed, err = int(f.crashAt-f.written), ErrCrashed
+		f.crashed = true
+	}
+
+	f.written += int64(allowed)
+	if f.spaceLeft >= 0 {
+		f.spaceLeft -= int64(allowed)
+	}
+	return allowed, err
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	allowed, faultErr := f.fs.allowWrite(len(p))
+	n, err := f.File.Write(p[:allowed])
+	if err != nil {
+		return n, err
+	}
+	if faultErr != nil {
+		return n, faultErr
+	}
+	return n, nil
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	syncErr := f.fs.syncErr
+	f.fs.mu.Unlock()
+	if syncErr != nil {
+		return syncErr
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
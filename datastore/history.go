@@ -0,0 +1,246 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// ErrHistoryDisabled is returned by History and GetAt of a Db opened
+// without WithHistory.
+var ErrHistoryDisabled = errors.New("history is not kept")
+
+// Version is a value written for a key. Versions of a key are numbered
+// from 1 in write order, a delete takes a version too.
+type Version struct {
+	Version   uint64    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	// Operator is set for the versions written by Db.Merge, Value is the
+	// result of the merge.
+	Operator string `json:"operator,omitempty"`
+}
+
+// historyPolicy selects the versions surviving a merge. The zero policy
+// keeps the latest value only.
+type historyPolicy struct {
+	versions  int
+	retention time.Duration
+}
+
+// WithHistory makes the Db keep the previous values of the keys. A merge
+// keeps the newest versions of every key and all the versions written
+// within retention. Zero versions or retention disables that criterion.
+func WithHistory(versions int, retention time.Duration) Option {
+	return func(db *Db) {
+		db.history = historyPolicy{versions: versions, retention: retention}
+	}
+}
+
+func (p historyPolicy) enabled() bool {
+	return p.versions > 0 || p.retention > 0
+}
+
+// keep filters the versions of a key in write order. The latest version
+// always stays unless it is a tombstone with nothing left to hide, then the
+// key is dropped completely.
+func (p historyPolicy) keep(versions []entry, now time.Time) []entry {
+	var kept []entry
+	last := len(versions) - 1
+	for i, e := range versions {
+		recent := p.versions > 0 && i > last-p.versions
+		young := p.retention > 0 && now.Sub(time.Unix(0, e.timestamp)) < p.retention
+		if i == last || recent || young {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == 1 && kept[0].kind == kindDelete {
+		return nil
+	}
+	return kept
+}
+
+// writeMerged writes the versions of every key in segments kept by the
+// policy to out, turning the merge entries into puts of the folded values.
+// The versions of a key the operators fail to fold are all kept as they
+// are. It gives up with ErrClosed once stop is closed.
+func (p historyPolicy) writeMerged(out io.Writer, segments []*Segment, ops mergeOperators, now time.Time, stop <-chan struct{}) (*Segment, error) {
+	merged := &Segment{
+		index:   make(hashIndex),
+		history: make(map[string][]int64),
+	}
+	for i, segment := range segments {
+		for key := range segment.index {
+			select {
+			case <-stop:
+				return nil, ErrClosed
+			default:
+			}
+			if hasKeyInSegments(segments[i+1:], key) {
+				continue
+			}
+			var versions []entry
+			for _, older := range segments[:i+1] {
+				for _, position := range older.history[key] {
+					e, err := older.fetchEntry(position)
+					if err != nil {
+						return nil, err
+					}
+					versions = append(versions, e)
+				}
+			}
+			if folded, err := ops.foldVersions(versions); err == nil {
+				versions = p.keep(folded, now)
+			} else {
+				log.Printf("Keeping the merge entries unfolded: %s", err)
+			}
+			for j := range versions {
+				if err := merged.appendEntry(out, &versions[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return merged, nil
+}
+
+// foldVersions returns the versions of a key in write order with the
+// merge entries replaced by puts of the values they produce.
+func (ops mergeOperators) foldVersions(versions []entry) ([]entry, error) {
+	folded := make([]entry, len(versions))
+	var value *string
+	for i, e := range versions {
+		switch e.kind {
+		case kindMerge:
+			result, err := ops.fold(value, []entry{e})
+			if err != nil {
+				return nil, err
+			}
+			e.kind, e.value = kindPut, result
+		case kindDelete:
+			value = nil
+		}
+		folded[i] = e
+		if e.kind == kindPut {
+			value = &folded[i].value
+		}
+	}
+	return folded, nil
+}
+
+// stamp sets the log position, the version and the time of an entry about
+// to be written. pending holds the versions of the keys written by a batch
+// and not tracked yet. Entries copied by Repair and received from the
+// leader keep their versions, the commands of the consensus their time. The
+// imported entries keep their versions and get the time of the import.
+// It is called by the put routine.
+func (db *Db) stamp(e *entry, pending map[string]uint64) {
+	if e.seq == 0 {
+		db.writeSeq++
+		e.seq = db.writeSeq
+	} else {
+		db.writeSeq = max(db.writeSeq, e.seq)
+	}
+	k := e.indexKey()
+	if e.version == 0 {
+		version, ok := pending[k]
+		if !ok {
+			db.mu.RLock()
+			version = db.versions[k]
+			db.mu.RUnlock()
+		}
+		e.version = version + 1
+	}
+	if e.timestamp == 0 {
+		e.timestamp = db.now().UnixNano()
+	}
+	if pending != nil {
+		pending[k] = e.version
+	}
+}
+
+// History returns the versions of the key kept by the Db from the oldest
+// to the latest one.
+func (db *Db) History(key string) ([]Version, error) {
+	return db.keyHistory(defaultBucketID, key)
+}
+
+// GetAt reads the value of the key at the version. Deleted and dropped
+// versions are reported as ErrNotFound.
+func (db *Db) GetAt(key string, version uint64) (string, error) {
+	return db.getAt(defaultBucketID, key, version)
+}
+
+func (db *Db) keyHistory(bucket uint32, key string) ([]Version, error) {
+	if !db.history.enabled() {
+		return nil, ErrHistoryDisabled
+	}
+	if err := db.limits.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := db.begin(); err != nil {
+		return nil, err
+	}
+	defer db.pending.Done()
+
+	k := indexKey(bucket, key)
+	var positions []KeyPosition
+	db.mu.RLock()
+	for _, segment := range db.segments {
+		for _, offset := range segment.history[k] {
+			segment.readers.Add(1)
+			positions = append(positions, KeyPosition{segment, offset})
+		}
+	}
+	db.mu.RUnlock()
+
+	entries, err := readChain(positions)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	folded, err := db.operators.foldVersions(entries)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, len(folded))
+	for i, e := range folded {
+		versions[i] = Version{
+			Version:   e.version,
+			Timestamp: time.Unix(0, e.timestamp).UTC(),
+			Value:     e.value,
+			Deleted:   e.kind == kindDelete,
+		}
+		if entries[i].kind == kindMerge {
+			versions[i].Operator, _, _ = decodeOperand(entries[i].value)
+		}
+	}
+	return versions, nil
+}
+
+func (db *Db) getAt(bucket uint32, key string, version uint64) (string, error) {
+	versions, err := db.keyHistory(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range versions {
+		if v.Version == version && !v.Deleted {
+			return v.Value, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// History returns the versions of the key kept in the bucket.
+func (b *Bucket) History(key string) ([]Version, error) {
+	return b.db.keyHistory(b.id, key)
+}
+
+// GetAt reads the value of the key in the bucket at the version.
+func (b *Bucket) GetAt(key string, version uint64) (string, error) {
+	return b.db.getAt(b.id, key, version)
+}
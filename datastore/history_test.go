@@ -0,0 +1,188 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func historyValues(t *testing.T, versions []Version) []string {
+	t.Helper()
+	values := make([]string, len(versions))
+	for i, v := range versions {
+		if v.Version != versions[0].Version+uint64(i) {
+			t.Errorf("Unexpected version numbers %+v", versions)
+		}
+		values[i] = v.Value
+		if v.Deleted {
+			values[i] = "<deleted>"
+		}
+	}
+	return values
+}
+
+func TestDb_History(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 128, WithHistory(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "v5"); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := db.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := historyValues(t, versions); len(got) != 5 || got[0] != "v1" || got[3] != "<deleted>" || got[4] != "v5" {
+		t.Errorf("Unexpected history %v", got)
+	}
+	if versions[0].Version != 1 || versions[0].Timestamp.IsZero() {
+		t.Errorf("Unexpected first version %+v", versions[0])
+	}
+	if value, err := db.GetAt("key", 2); err != nil || value != "v2" {
+		t.Errorf("Unexpected value at version 2: %q, %v", value, err)
+	}
+	if _, err := db.GetAt("key", 4); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted version, got %v", err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 128, WithHistory(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	versions, err = db.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := historyValues(t, versions); len(got) != 3 || got[0] != "v3" || got[1] != "<deleted>" || got[2] != "v5" {
+		t.Errorf("Unexpected history after compaction %v", got)
+	}
+	if _, err := db.GetAt("key", 1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a dropped version, got %v", err)
+	}
+	if err := db.Put("key", "v6"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetAt("key", 6); err != nil || value != "v6" {
+		t.Errorf("Expected the versions to continue after reopening, got %q, %v", value, err)
+	}
+}
+
+func TestDb_HistoryRetention(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024, WithHistory(0, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	team, err := db.CreateBucket("team", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"old", "older"} {
+		if err := team.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := team.Put("gone", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	for _, value := range []string{"recent", "latest"} {
+		if err := team.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := team.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := historyValues(t, versions); len(got) != 2 || got[0] != "recent" || got[1] != "latest" {
+		t.Errorf("Unexpected history %v", got)
+	}
+	if value, err := team.GetAt("key", 3); err != nil || value != "recent" {
+		t.Errorf("Unexpected value at version 3: %q, %v", value, err)
+	}
+	if _, err := team.History("gone"); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to be dropped, got %v", err)
+	}
+	if _, err := db.History("key"); err != ErrNotFound {
+		t.Errorf("Expected the default bucket to have no history of the key, got %v", err)
+	}
+}
+
+func TestDb_HistoryDisabled(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.History("key"); !errors.Is(err, ErrHistoryDisabled) {
+		t.Errorf("Expected ErrHistoryDisabled, got %v", err)
+	}
+	if _, err := db.GetAt("key", 1); !errors.Is(err, ErrHistoryDisabled) {
+		t.Errorf("Expected ErrHistoryDisabled, got %v", err)
+	}
+}
+
+func TestDb_GetItem(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := db.GetItem(ctx, "key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	db.Put("key", "1")
+	now = now.Add(time.Minute)
+	db.Merge("key", AddOperator, "2")
+	item, err := db.GetItem(ctx, "key")
+	if err != nil || item.Value != "3" || item.Version != 2 || !item.Modified.Equal(now) {
+		t.Errorf("Unexpected item %+v, %v", item, err)
+	}
+
+	team, err := db.CreateBucket("team", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team.Put("key", "team value")
+	if item, err := team.GetItem(ctx, "key"); err != nil || item.Value != "team value" || item.Version != 1 {
+		t.Errorf("Unexpected item of the bucket %+v, %v", item, err)
+	}
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidKey is returned for empty keys, keys that are not valid UTF-8
+	// and keys starting with ReservedKeyPrefix.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrKeyTooLarge is returned for keys longer than the key size limit.
+	ErrKeyTooLarge = errors.New("key is too large")
+	// ErrValueTooLarge is returned for values longer than the value size
+	// limit or not fitting into a segment.
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+// ReservedKeyPrefix starts the names of the control endpoints served next to
+// the keys, e.g. /db/_export of the db service, so the keys cannot start
+// with it. The bucket names cannot either, see bucketNamePattern.
+const ReservedKeyPrefix = "_"
+
+// Default size limits in bytes, see WithLimits.
+const (
+	DefaultMaxKeySize   = 1024
+	DefaultMaxValueSize = 1024 * 1024
+)
+
+// limits bounds the sizes of the stored keys and values.
+type limits struct {
+	maxKeySize   int
+	maxValueSize int
+}
+
+var defaultLimits = limits{DefaultMaxKeySize, DefaultMaxValueSize}
+
+func (l limits) checkKey(key string) error {
+	if key == "" || !utf8.ValidString(key) || strings.HasPrefix(key, ReservedKeyPrefix) {
+		return ErrInvalidKey
+	}
+	if len(key) > l.maxKeySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), l.maxKeySize)
+	}
+	return nil
+}
+
+func (l limits) checkValue(value string) error {
+	if len(value) > l.maxValueSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(value), l.maxValueSize)
+	}
+	return nil
+}
+
+// WithLimits sets the maximum key and value sizes in bytes. An entry must
+// also fit into a segment, so larger values are rejected regardless.
+func WithLimits(maxKeySize, maxValueSize int) Option {
+	return func(db *Db) {
+		db.limits = limits{maxKeySize, maxValueSize}
+	}
+}
+
+// checkEntry validates the entry before it is written.
+func (db *Db) checkEntry(e *entry) error {
+	if err := db.limits.checkKey(e.key); err != nil {
+		return err
+	}
+	if err := db.limits.checkValue(e.value); err != nil {
+		return err
+	}
+	return db.checkFits(e)
+}
+
+// checkFits verifies that the entry fits into a segment.
+func (db *Db) checkFits(e *entry) error {
+	if e.getLength() > db.segmentSizeBytes {
+		return fmt.Errorf("%w: the entry of %d bytes does not fit into a segment of %d bytes",
+			ErrValueTooLarge, e.getLength(), db.segmentSizeBytes)
+	}
+	return nil
+}
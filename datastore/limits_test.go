@@ -0,0 +1,41 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_Limits(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 128, WithLimits(8, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("12345678", strings.Repeat("v", 64)); err != nil {
+		t.Errorf("Expected an entry at the limits to be stored, got %s", err)
+	}
+	if err := db.Put("123456789", "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Put("key", strings.Repeat("v", 65)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+
+	small, err := NewDb(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	// 45 bytes of the header and 3 of the key leave 16 bytes for the value.
+	if err := small.Put("key", strings.Repeat("v", 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge for an entry over the segment size, got %v", err)
+	}
+	if err := small.Put("key", strings.Repeat("v", 16)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := small.Stats(); stats.Segments != 1 || stats.Bytes != 64 {
+		t.Errorf("Expected a single full segment, got %+v", stats)
+	}
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by NewDb when the directory is used by another Db.
+var ErrLocked = errors.New("datastore directory is locked by another process")
+
+// Lock files placed in the data directory. The writer lock is held
+// exclusively by the only Db allowed to modify the directory. Read-only
+// handles share the readers lock, which an Exclusive Db takes exclusively.
+const (
+	writerLockName  = "LOCK"
+	readersLockName = "LOCK.readers"
+)
+
+// dirLock holds the lock files of an open Db.
+type dirLock struct {
+	files []*os.File
+}
+
+func lockDir(dir string, readOnly, exclusive bool) (*dirLock, error) {
+	lock := &dirLock{}
+	acquire := func(name string, exclusive bool) error {
+		f, err := lockFile(filepath.Join(dir, name), exclusive)
+		if err != nil {
+			lock.release()
+			return err
+		}
+		lock.files = append(lock.files, f)
+		return nil
+	}
+
+	var err error
+	if readOnly {
+		err = acquire(readersLockName, false)
+	} else {
+		err = acquire(writerLockName, true)
+		if err == nil && exclusive {
+			err = acquire(readersLockName, true)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// release unlocks the directory. Closing the files drops the locks.
+func (l *dirLock) release() error {
+	var err error
+	for _, f := range l.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	l.files = nil
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile only creates the lock file: flock is not available on this
+// platform and the directory is not protected from concurrent use.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+}
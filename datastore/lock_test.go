@@ -0,0 +1,72 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDb_DirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(dir, 1024); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked for a second writer, got %v", err)
+	}
+
+	reader, err := NewDb(dir, 1024, ReadOnly())
+	if err != nil {
+		t.Fatalf("Expected a read-only Db to open next to the writer, got %s", err)
+	}
+	if value, err := reader.Get("key"); err != nil || value != "value" {
+		t.Errorf("Unexpected value read by the read-only Db: %q, %v", value, err)
+	}
+	if err := reader.Put("key", "other"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly on put, got %v", err)
+	}
+	if err := reader.Delete("key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly on delete, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, 1024, Exclusive()); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked for an exclusive writer while a reader is open, got %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024, Exclusive())
+	if err != nil {
+		t.Fatalf("Expected the lock to be released on close, got %s", err)
+	}
+	defer db.Close()
+	if _, err := NewDb(dir, 1024, ReadOnly()); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a reader while an exclusive writer is open, got %v", err)
+	}
+}
+
+func TestDb_ReadOnlyEmptyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024, ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if stats := db.Stats(); stats.Segments != 0 {
+		t.Errorf("A read-only Db must not create segments, got %d", stats.Segments)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file and places an advisory flock on it without
+// waiting. It returns ErrLocked if a conflicting lock is held.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
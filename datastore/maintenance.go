@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Record is an entry as it is stored in a segment file.
+type Record struct {
+	Offset  int64     `json:"offset"`
+	Bucket  uint32    `json:"bucket,omitempty"`
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+	// Operator is set for the merge entries, Value holds the operand.
+	Operator string `json:"operator,omitempty"`
+}
+
+// ScanSegment reads the segment file calling fn with every record in it.
+// Damaged and incomplete entries are reported as ErrCorrupted.
+func ScanSegment(path string, fn func(r Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := scanEntries(bufio.NewReaderSize(f, bufferSize), func(e *entry, offset int64) error {
+		r := Record{
+			Offset:  offset,
+			Bucket:  e.bucket,
+			Version: e.version,
+			Time:    time.Unix(0, e.timestamp).UTC(),
+			Key:     e.key,
+			Value:   e.value,
+			Deleted: e.kind == kindDelete,
+		}
+		if e.kind == kindMerge {
+			r.Operator, r.Value, _ = decodeOperand(e.value)
+		}
+		return fn(r)
+	})
+	if err == errIncompleteEntry || err == errCorruptedEntry {
+		return fmt.Errorf("%w: %s at offset %d: %s", ErrCorrupted, path, size, err)
+	}
+	return err
+}
+
+// SegmentInfo describes a segment of an open Db.
+type SegmentInfo struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Keys int    `json:"keys"`
+}
+
+// Segments lists the segments from the oldest to the current one.
+func (db *Db) Segments() []SegmentInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	infos := make([]SegmentInfo, len(db.segments))
+	for i, segment := range db.segments {
+		infos[i] = SegmentInfo{
+			ID:   segment.id,
+			Path: segment.filePath,
+			Size: segment.outOffset,
+			Keys: len(segment.index),
+		}
+	}
+	return infos
+}
+
+// Verify re-reads all the segments checking the entry checksums and that
+// the in-memory index matches the segment contents.
+func (db *Db) Verify() error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+
+	type snapshot struct {
+		segment *Segment
+		size    int64
+		index   hashIndex
+		merges  map[string]int
+	}
+
+	db.mu.RLock()
+	snapshots := make([]snapshot, len(db.segments))
+	for i, segment := range db.segments {
+		index := make(hashIndex, len(segment.index))
+		for key, offset := range segment.index {
+			index[key] = offset
+		}
+		merges := make(map[string]int, len(segment.merges))
+		for key, offsets := range segment.merges {
+			merges[key] = len(offsets)
+		}
+		segment.readers.Add(1)
+		snapshots[i] = snapshot{segment, segment.outOffset, index, merges}
+	}
+	db.mu.RUnlock()
+
+	var problems []error
+	for _, s := range snapshots {
+		expected := &Segment{index: make(hashIndex)}
+		reader := bufio.NewReaderSize(io.NewSectionReader(s.segment.file, 0, s.size), bufferSize)
+		size, err := scanEntries(reader, func(e *entry, offset int64) error {
+			expected.add(e, offset)
+			return nil
+		})
+		s.segment.readers.Done()
+
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%w: %s at offset %d: %s", ErrCorrupted, s.segment.filePath, size, err))
+			continue
+		}
+		for key, offset := range expected.index {
+			if indexed, ok := s.index[key]; !ok || indexed != offset {
+				problems = append(problems, fmt.Errorf("%s: key %q is at offset %d, index has %d", s.segment.filePath, key, offset, indexed))
+			}
+			if merges := len(expected.merges[key]); merges != s.merges[key] {
+				problems = append(problems, fmt.Errorf("%s: key %q has %d merges, index has %d", s.segment.filePath, key, merges, s.merges[key]))
+			}
+		}
+		for key := range s.index {
+			if _, ok := expected.index[key]; !ok {
+				problems = append(problems, fmt.Errorf("%s: indexed key %q is not in the file", s.segment.filePath, key))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Compact merges all the data, including the current segment, into a single
+// segment. The writes coming after it go to a new empty segment.
+func (db *Db) Compact() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	if err := db.write(context.Background(), putOperation{rotate: true}); err != nil {
+		return err
+	}
+	return db.observeMerge(db.merge)
+}
+
+// RepairReport summarizes the result of Repair.
+type RepairReport struct {
+	Entries      int   `json:"entries"`
+	SkippedBytes int64 `json:"skipped_bytes"`
+}
+
+// Repair copies every readable entry of the datastore in src into a new
+// datastore in dst. Damaged bytes are skipped until the next valid entry.
+// The dst directory must be empty or not exist.
+func Repair(src, dst string, segmentSizeBytes int64) (RepairReport, error) {
+	var report RepairReport
+	contents, err := readDataDir(OSFS, src)
+	if err != nil {
+		return report, err
+	}
+	contents.resolveMerges(nil)
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return report, err
+	}
+	if files, err := os.ReadDir(dst); err != nil {
+		return report, err
+	} else if len(files) > 0 {
+		return report, fmt.Errorf("repair destination %s is not empty", dst)
+	}
+	db, err := NewDb(dst, segmentSizeBytes)
+	if err != nil {
+		return report, err
+	}
+
+	for _, id := range contents.ids() {
+		data, err := os.ReadFile(contents.paths[id])
+		if err != nil {
+			db.Close()
+			return report, err
+		}
+		for offset := 0; offset < len(data); {
+			e, size, ok := decodeAt(data[offset:])
+			if !ok {
+				offset++
+				report.SkippedBytes++
+				continue
+			}
+			offset += size
+			report.Entries++
+
+			err = db.apply(context.Background(), e)
+			if e.kind == kindDelete && errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+			if err != nil {
+				db.Close()
+				return report, err
+			}
+		}
+	}
+	return report, db.Close()
+}
+
+// decodeAt decodes the entry at the beginning of data if there is a valid one.
+func decodeAt(data []byte) (entry, int, bool) {
+	var e entry
+	if len(data) < entryHeaderSize {
+		return e, 0, false
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if size < entryHeaderSize || size > len(data) {
+		return e, 0, false
+	}
+	if err := e.Decode(data[:size]); err != nil {
+		return e, 0, false
+	}
+	return e, size, true
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScanSegment(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Delete("key1")
+	db.Close()
+
+	var records []Record
+	err = ScanSegment(filepath.Join(dir, outFileName+"0"), func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	if records[1].Key != "key2" || records[1].Value != "value2" || records[1].Offset == 0 {
+		t.Errorf("Unexpected second record %+v", records[1])
+	}
+	if !records[2].Deleted || records[2].Key != "key1" {
+		t.Errorf("Expected a tombstone of key1, got %+v", records[2])
+	}
+}
+
+func TestDb_Verify(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+
+	if err := db.Verify(); err != nil {
+		t.Fatalf("Unexpected problems in a healthy Db: %s", err)
+	}
+
+	db.segments[0].index["ghost"] = 0
+	if err := db.Verify(); err == nil {
+		t.Error("Expected an index inconsistency to be reported")
+	}
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir := t.TempDir()
+	var merges atomic.Int32
+	db, err := NewDb(dir, 64, WithMergeObserver(func(d time.Duration, err error) {
+		if err == nil && d > 0 {
+			merges.Add(1)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := db.Stats(); stats.DeadBytes == 0 || stats.WriteQueue != 0 {
+		t.Errorf("Expected dead bytes and no queued writes, got %+v", stats)
+	}
+	before := merges.Load()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if merges.Load() <= before {
+		t.Error("Expected the compaction reported to the merge observer")
+	}
+	if stats := db.Stats(); stats.DeadBytes != 0 {
+		t.Errorf("Expected no dead bytes after the compaction, got %d", stats.DeadBytes)
+	}
+
+	segments := db.Segments()
+	if len(segments) != 2 || segments[1].Size != 0 {
+		t.Fatalf("Expected a merged and an empty segment, got %+v", segments)
+	}
+	if segments[0].Keys != 4 {
+		t.Errorf("Expected 4 keys in the merged segment, got %d", segments[0].Keys)
+	}
+	for i := 16; i < 20; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i%4)); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Unexpected value of key%d: %q, %v", i%4, value, err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	src := t.TempDir()
+	db, err := NewDb(src, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete("key3")
+	db.Close()
+
+	segmentPath := filepath.Join(src, outFileName+"0")
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the first entry, the ones after it must survive.
+	data[keyOffset+4] ^= 0xff
+	if err := os.WriteFile(segmentPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(src, 1024); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("Expected the source to be unreadable, got %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "repaired")
+	report, err := Repair(src, dst, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Entries != 3 || report.SkippedBytes != (&entry{key: "key1", value: "value-key1"}).getLength() {
+		t.Errorf("Unexpected repair report %+v", report)
+	}
+
+	repaired, err := NewDb(dst, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repaired.Close()
+	if value, err := repaired.Get("key2"); err != nil || value != "value-key2" {
+		t.Errorf("Unexpected value of key2: %q, %v", value, err)
+	}
+	for _, key := range []string{"key1", "key3"} {
+		if _, err := repaired.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected %s to be missing, got %v", key, err)
+		}
+	}
+
+	if _, err := Repair(src, dst, 1024); err == nil {
+		t.Error("Expected repair into a non-empty directory to fail")
+	}
+}
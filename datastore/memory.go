@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a Store that keeps all the data in a map. Nothing survives Close.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	data   map[string]string
+	limits limits
+}
+
+// NewMemoryStore creates an empty store with the default size limits.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]string), limits: defaultLimits}
+}
+
+func (s *MemoryStore) checkEntry(e *entry) error {
+	if err := s.limits.checkKey(e.key); err != nil {
+		return err
+	}
+	return s.limits.checkValue(e.value)
+}
+
+func (s *MemoryStore) Get(key string) (string, error) {
+	if err := s.limits.checkKey(key); err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.data == nil {
+		return "", ErrClosed
+	}
+	value, ok := s.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *MemoryStore) Put(key, value string) error {
+	if err := s.checkEntry(&entry{key: key, value: value}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return ErrClosed
+	}
+	s.data[key] = value
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	if err := s.limits.checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return ErrClosed
+	}
+	if _, ok := s.data[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.data, key)
+	return nil
+}
+
+func (s *MemoryStore) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return s.Get(key)
+}
+
+func (s *MemoryStore) PutContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Put(key, value)
+}
+
+func (s *MemoryStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+func (s *MemoryStore) Scan(prefix string, fn func(key, value string) error) error {
+	return s.ScanAfter(prefix, "", fn)
+}
+
+func (s *MemoryStore) ScanAfter(prefix, after string, fn func(key, value string) error) error {
+	s.mu.RLock()
+	if s.data == nil {
+		s.mu.RUnlock()
+		return ErrClosed
+	}
+	keys := make([]string, 0, len(s.data))
+	values := make(map[string]string)
+	for key, value := range s.data {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+			values[key] = value
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return ErrClosed
+	}
+	s.data = nil
+	return nil
+}
+
+func (s *MemoryStore) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := Stats{Keys: len(s.data)}
+	for key, value := range s.data {
+		stats.Bytes += int64(len(key) + len(value))
+	}
+	return stats
+}
@@ -0,0 +1,317 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	// ErrUnknownOperator is returned for merges with an operator the Db
+	// does not have, see WithMergeOperator.
+	ErrUnknownOperator = errors.New("unknown merge operator")
+	// ErrInvalidOperand is returned for operands rejected by the operator.
+	ErrInvalidOperand = errors.New("invalid merge operand")
+	// ErrMergeConflict is returned for merges the operator cannot fold into
+	// the current value of the key, e.g. add to a value that is not a number.
+	ErrMergeConflict = errors.New("merge does not apply to the value")
+)
+
+// MergeOperator folds an operand written by Db.Merge into the value of
+// a key. existing is nil if the key has no value.
+type MergeOperator func(existing *string, operand string) (string, error)
+
+// The names of the built-in merge operators.
+const (
+	AppendOperator     = "append"
+	AddOperator        = "add"
+	MergePatchOperator = "merge-patch"
+)
+
+// mergeOperators maps the operator names to the operators of a Db.
+type mergeOperators map[string]MergeOperator
+
+func defaultOperators() mergeOperators {
+	return mergeOperators{
+		AppendOperator:     appendOperands,
+		AddOperator:        addOperands,
+		MergePatchOperator: mergePatch,
+	}
+}
+
+// WithMergeOperator registers the operator under the name, replacing
+// a built-in one with the same name. The operators must stay the same for
+// the lifetime of the data as the merges are folded when reading.
+func WithMergeOperator(name string, op MergeOperator) Option {
+	return func(db *Db) {
+		db.operators[name] = op
+	}
+}
+
+// appendOperands concatenates the operand to the value.
+func appendOperands(existing *string, operand string) (string, error) {
+	if existing == nil {
+		return operand, nil
+	}
+	return *existing + operand, nil
+}
+
+// addOperands adds the operand to the value, both being int64 numbers.
+// A missing value counts as 0.
+func addOperands(existing *string, operand string) (string, error) {
+	delta, err := strconv.ParseInt(operand, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidOperand, err)
+	}
+	var value int64
+	if existing != nil {
+		if value, err = strconv.ParseInt(*existing, 10, 64); err != nil {
+			return "", fmt.Errorf("value is not a number: %w", err)
+		}
+	}
+	return strconv.FormatInt(value+delta, 10), nil
+}
+
+// mergePatch applies the operand as an RFC 7396 JSON merge patch.
+func mergePatch(existing *string, operand string) (string, error) {
+	var patch any
+	if err := json.Unmarshal([]byte(operand), &patch); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidOperand, err)
+	}
+	var target any
+	if existing != nil {
+		if err := json.Unmarshal([]byte(*existing), &target); err != nil {
+			return "", fmt.Errorf("value is not JSON: %w", err)
+		}
+	}
+	result, err := json.Marshal(applyPatch(target, patch))
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+func applyPatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]any)
+	if !ok {
+		object = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = applyPatch(object[name], value)
+		}
+	}
+	return object
+}
+
+// encodeOperand stores the operator name in front of the operand as the
+// value of a merge entry.
+func encodeOperand(operator, operand string) string {
+	return string([]byte{byte(len(operator))}) + operator + operand
+}
+
+func decodeOperand(value string) (operator, operand string, err error) {
+	if len(value) == 0 || len(value) < 1+int(value[0]) {
+		return "", "", errCorruptedEntry
+	}
+	n := 1 + int(value[0])
+	return value[1:n], value[n:], nil
+}
+
+// fold applies the merge entries in write order to the base value, which
+// is nil if the key has no value.
+func (ops mergeOperators) fold(base *string, merges []entry) (string, error) {
+	value := base
+	for _, e := range merges {
+		name, operand, err := decodeOperand(e.value)
+		if err != nil {
+			return "", err
+		}
+		op, ok := ops[name]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrUnknownOperator, name)
+		}
+		folded, err := op(value, operand)
+		if err != nil {
+			return "", fmt.Errorf("merging %q into %q: %w", name, e.key, err)
+		}
+		value = &folded
+	}
+	if value == nil {
+		return "", ErrNotFound
+	}
+	return *value, nil
+}
+
+// foldEntries turns the base entry and the merge entries following it into
+// a single put entry carrying the version of the last one and the expiry
+// time of the base.
+func (ops mergeOperators) foldEntries(chain []entry) (entry, error) {
+	var base *string
+	merges := chain
+	if chain[0].kind == kindPut {
+		base = &chain[0].value
+		merges = chain[1:]
+	}
+	value, err := ops.fold(base, merges)
+	if err != nil {
+		return entry{}, err
+	}
+	folded := chain[len(chain)-1]
+	folded.kind = kindPut
+	folded.value = value
+	folded.expires = 0
+	if chain[0].kind == kindPut {
+		folded.expires = chain[0].expires
+	}
+	return folded, nil
+}
+
+// keyChain locates the entries making up the value of a key: the base put
+// entry, if any, and the merge entries written after it. Every segment
+// reader of the returned positions must be released by the caller. It must
+// be called with db.mu held.
+func keyChain(segments []*Segment, k string) []KeyPosition {
+	var chain []KeyPosition
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		base, ok := segment.index[k]
+		if !ok {
+			continue
+		}
+		positions := make([]KeyPosition, 0, len(segment.merges[k])+1)
+		if base >= 0 {
+			positions = append(positions, KeyPosition{segment, base})
+		}
+		for _, offset := range segment.merges[k] {
+			positions = append(positions, KeyPosition{segment, offset})
+		}
+		for range positions {
+			segment.readers.Add(1)
+		}
+		chain = append(positions, chain...)
+		if base != mergeOnlyOffset {
+			break
+		}
+	}
+	return chain
+}
+
+// readChain reads the entries of a chain releasing the segment readers.
+func readChain(chain []KeyPosition) ([]entry, error) {
+	entries := make([]entry, 0, len(chain))
+	var err error
+	for _, position := range chain {
+		if err == nil {
+			var e entry
+			e, err = position.segment.fetchEntry(position.offset)
+			entries = append(entries, e)
+		}
+		position.segment.readers.Done()
+	}
+	return entries, err
+}
+
+func releaseChain(chain []KeyPosition) {
+	for _, position := range chain {
+		position.segment.readers.Done()
+	}
+}
+
+// entryOf reads the chain releasing its segment readers and folds it into a
+// put entry with the version and the time of the latest write.
+func (db *Db) entryOf(chain []KeyPosition) (entry, error) {
+	entries, err := readChain(chain)
+	if err != nil {
+		return entry{}, err
+	}
+	if len(entries) == 1 && entries[0].kind == kindPut {
+		return entries[0], nil
+	}
+	return db.operators.foldEntries(entries)
+}
+
+// Merge writes the operand for the operator to be folded into the value of
+// the key when it is read. The operand is folded into the current value
+// before it is written, a merge the value does not take fails with
+// ErrMergeConflict instead of breaking the reads of the key.
+func (db *Db) Merge(key, operator, operand string) error {
+	return db.MergeContext(context.Background(), key, operator, operand)
+}
+
+// MergeContext is Merge giving up when ctx is done.
+func (db *Db) MergeContext(ctx context.Context, key, operator, operand string) error {
+	return db.mergeKey(ctx, defaultBucketID, key, operator, operand)
+}
+
+func (db *Db) mergeKey(ctx context.Context, bucket uint32, key, operator, operand string) error {
+	op, ok := db.operators[operator]
+	if !ok || len(operator) > 255 {
+		return fmt.Errorf("%w: %q", ErrUnknownOperator, operator)
+	}
+	e := entry{
+		key:    key,
+		value:  operand,
+		kind:   kindMerge,
+		bucket: bucket,
+	}
+	if err := db.checkEntry(&e); err != nil {
+		return err
+	}
+	// The operand alone must be acceptable, otherwise every read would fail.
+	if _, err := op(nil, operand); err != nil {
+		return err
+	}
+	e.value = encodeOperand(operator, operand)
+	if err := db.checkFits(&e); err != nil {
+		return err
+	}
+	return db.apply(ctx, e)
+}
+
+// checkMerge folds the merge entry into the current value of its key. It is
+// called by the put routine, so the value does not change before the entry
+// is written.
+func (db *Db) checkMerge(e *entry) error {
+	k := e.indexKey()
+	db.mu.RLock()
+	if db.expiredAt(k, e.timestamp) {
+		db.mu.RUnlock()
+		// The merge into an expired value starts a new one without the
+		// expiry, so it is written as a put of the folded operand.
+		folded, err := db.operators.foldEntries([]entry{*e})
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMergeConflict, err)
+		}
+		*e = folded
+		return nil
+	}
+	chain := keyChain(db.segments, k)
+	db.mu.RUnlock()
+	entries, err := readChain(chain)
+	if err != nil {
+		return err
+	}
+	if _, err := db.operators.foldEntries(append(entries, *e)); err != nil {
+		return fmt.Errorf("%w: %s", ErrMergeConflict, err)
+	}
+	return nil
+}
+
+// Merge writes the operand for the operator to the key of the bucket.
+func (b *Bucket) Merge(key, operator, operand string) error {
+	return b.db.mergeKey(context.Background(), b.id, key, operator, operand)
+}
+
+// MergeContext is Merge giving up when ctx is done.
+func (b *Bucket) MergeContext(ctx context.Context, key, operator, operand string) error {
+	return b.db.mergeKey(ctx, b.id, key, operator, operand)
+}
@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_Merge(t *testing.T) {
+	dir := t.TempDir()
+	upper := WithMergeOperator("upper", func(existing *string, operand string) (string, error) {
+		return strings.ToUpper(operand), nil
+	})
+	db, err := NewDb(dir, 256, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("list", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, operand := range []string{",b", ",c"} {
+		if err := db.Merge("list", AppendOperator, operand); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, operand := range []string{"5", "-2"} {
+		if err := db.Merge("counter", AddOperator, operand); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("doc", `{"name":"db","tags":{"a":1}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("doc", MergePatchOperator, `{"tags":{"a":null,"b":2},"size":3}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("name", "upper", "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("gone", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("gone", AddOperator, "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Merge("list", "unknown", "x"); !errors.Is(err, ErrUnknownOperator) {
+		t.Errorf("Expected ErrUnknownOperator, got %v", err)
+	}
+	if err := db.Merge("counter", AddOperator, "x"); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	// The merges the current value does not take are rejected, the reads of
+	// the keys keep working.
+	if err := db.Merge("list", AddOperator, "1"); !errors.Is(err, ErrMergeConflict) {
+		t.Errorf("Expected ErrMergeConflict for add to a list, got %v", err)
+	}
+	if err := db.Merge("name", MergePatchOperator, `{"a":1}`); !errors.Is(err, ErrMergeConflict) {
+		t.Errorf("Expected ErrMergeConflict for a patch of a value that is not JSON, got %v", err)
+	}
+	if err := db.Merge("list", AppendOperator, strings.Repeat("v", DefaultMaxValueSize+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+
+	expected := map[string]string{
+		"counter": "3",
+		"doc":     `{"name":"db","size":3,"tags":{"b":2}}`,
+		"gone":    "2",
+		"list":    "a,b,c",
+		"name":    "DB",
+	}
+	check := func(stage string) {
+		t.Helper()
+		for key, value := range expected {
+			if got, err := db.Get(key); err != nil || got != value {
+				t.Errorf("%s: unexpected value of %s: %q, %v", stage, key, got, err)
+			}
+		}
+		scanned := 0
+		err := db.Scan("", func(key, value string) error {
+			scanned++
+			if expected[key] != value {
+				t.Errorf("%s: unexpected scanned value of %s: %q", stage, key, value)
+			}
+			return nil
+		})
+		if err != nil || scanned != len(expected) {
+			t.Errorf("%s: scanned %d keys, %v", stage, scanned, err)
+		}
+		if stats := db.Stats(); stats.Keys != len(expected) {
+			t.Errorf("%s: expected %d keys, got %+v", stage, len(expected), stats)
+		}
+	}
+	check("merged")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 256, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopened")
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted")
+	if err := db.Verify(); err != nil {
+		t.Error(err)
+	}
+	for _, segment := range db.Segments() {
+		err := ScanSegment(segment.Path, func(r Record) error {
+			if r.Operator != "" {
+				t.Errorf("Expected the merges to be folded, found %+v", r)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Delete("counter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("counter", AddOperator, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("counter"); err != nil {
+		t.Errorf("Expected a merged key to be deletable, got %v", err)
+	}
+	if _, err := db.Get("counter"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDb_MergeHistory(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024, WithHistory(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, operand := range []string{"1", "2", "3"} {
+		if err := db.Merge("counter", AddOperator, operand); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := db.History("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := historyValues(t, versions); len(got) != 3 || got[0] != "1" || got[1] != "3" || got[2] != "6" {
+		t.Errorf("Unexpected history %v", got)
+	}
+	if value, err := db.GetAt("counter", 2); err != nil || value != "3" {
+		t.Errorf("Unexpected value at version 2: %q, %v", value, err)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, test := range []struct {
+		target, patch, result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`"text"`, `{"a":1}`, `{"a":1}`},
+	} {
+		result, err := mergePatch(&test.target, test.patch)
+		if err != nil || result != test.result {
+			t.Errorf("Patching %s with %s: got %s, %v, expected %s", test.target, test.patch, result, err, test.result)
+		}
+	}
+	if _, err := mergePatch(nil, `{`); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrQuotaExceeded is returned for writes that would make the live data of
+// a bucket larger than its quota or the datastore larger than its maximum
+// size. Such writes are rejected before anything reaches the disk.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// WithMaxSize limits the total size of the segment files to maxSize bytes.
+// Puts growing the datastore over the limit fail with ErrQuotaExceeded,
+// deletes are always allowed as merging them frees space.
+func WithMaxSize(maxSize int64) Option {
+	return func(db *Db) {
+		db.maxSize = maxSize
+	}
+}
+
+// checkMaxSize verifies that appending the entry after pending more bytes
+// keeps the datastore within its maximum size.
+func (db *Db) checkMaxSize(e *entry, pending int64) error {
+	if db.maxSize <= 0 {
+		return nil
+	}
+	db.mu.RLock()
+	size := pending + e.getLength()
+	for _, segment := range db.segments {
+		size += segment.outOffset
+	}
+	db.mu.RUnlock()
+	if size > db.maxSize {
+		return fmt.Errorf("%w: the datastore would grow to %d of %d bytes", ErrQuotaExceeded, size, db.maxSize)
+	}
+	return nil
+}
+
+func (db *Db) hasQuota(bucket uint32) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	state, ok := db.bucketIDs[bucket]
+	return ok && state.meta.Quota > 0
+}
+
+// checkQuota verifies that the put or merge entry keeps its bucket within
+// the quota.
+func (db *Db) checkQuota(e *entry) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	state, ok := db.bucketIDs[e.bucket]
+	if !ok || state.meta.Quota == 0 {
+		return nil
+	}
+	usage := state.bytes + e.getLength()
+	if e.kind == kindPut {
+		usage -= db.sizes[e.indexKey()]
+	}
+	if usage > state.meta.Quota {
+		return fmt.Errorf("%w: bucket %s would use %d of %d bytes", ErrQuotaExceeded, state.name, usage, state.meta.Quota)
+	}
+	return nil
+}
+
+// SetQuota changes the quota of the bucket, the default one included.
+// A zero quota means no limit. The data already over a lowered quota stays,
+// only the writes growing it further are rejected.
+func (db *Db) SetQuota(name string, quota int64) error {
+	if quota < 0 {
+		return fmt.Errorf("negative quota %d", quota)
+	}
+	db.bucketMu.Lock()
+	defer db.bucketMu.Unlock()
+
+	db.mu.RLock()
+	state, ok := db.buckets[name]
+	var meta bucketMeta
+	if ok {
+		meta = state.meta
+	}
+	db.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+
+	meta.Quota = quota
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.apply(context.Background(), entry{key: name, value: string(value), bucket: metaBucketID})
+}
@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestDb_MaxSize(t *testing.T) {
+	entrySize := (&entry{key: "key1", value: "value1"}).getLength()
+	db, err := NewDb(t.TempDir(), 1024, WithMaxSize(3*entrySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key4", "value4"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := db.Put("key1", "value0"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for an overwrite growing the log, got %v", err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Errorf("Expected deletes to be allowed over the limit, got %s", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Errorf("Expected the compaction to free space, got %s", err)
+	}
+}
+
+func TestDb_SetQuota(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySize := (&entry{key: "key1", value: "value1"}).getLength()
+	if err := db.SetQuota(DefaultBucket, entrySize); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota("missing", entrySize); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key2", "value2"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the quota to survive reopening, got %v", err)
+	}
+	if err := db.SetQuota(DefaultBucket, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Errorf("Expected no limit after removing the quota, got %s", err)
+	}
+}
+
+func TestDb_DiskFull(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFaultFS(OSFS)
+	db, err := NewDb(dir, 1024, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.LimitSpace(10)
+	if err := db.Put("key2", "value2"); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC, got %v", err)
+	}
+	if _, err := db.Get("key2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the failed put to be invisible, got %v", err)
+	}
+	fs.LimitSpace(-1)
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Errorf("Expected the segment to match the index after the rollback, got %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024, WithStrictRecovery())
+	if err != nil {
+		t.Fatalf("Expected no partial entry to be left, got %s", err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key3"} {
+		if value, err := db.Get(key); err != nil || value != "value"+key[3:] {
+			t.Errorf("Unexpected value of %s: %q, %v", key, value, err)
+		}
+	}
+}
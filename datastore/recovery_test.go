@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTornDb creates a directory with two complete entries followed by the
+// first half of a third one and returns the path of its segment.
+func writeTornDb(t *testing.T) (string, []byte) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	torn := (&entry{key: "key3", value: "value3"}).Encode()
+	torn = torn[:len(torn)/2]
+	segmentPath := filepath.Join(dir, outFileName+"0")
+	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	return segmentPath, torn
+}
+
+func TestDb_RepairTornTail(t *testing.T) {
+	segmentPath, torn := writeTornDb(t)
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := info.Size() - int64(len(torn))
+
+	db, err := NewDb(filepath.Dir(segmentPath), 1024)
+	if err != nil {
+		t.Fatalf("Expected the torn tail to be repaired, got %s", err)
+	}
+
+	if info, _ := os.Stat(segmentPath); info.Size() != validSize {
+		t.Errorf("Expected the segment to be truncated to %d bytes, got %d", validSize, info.Size())
+	}
+	cut, err := os.ReadFile(segmentPath + corruptSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cut, torn) {
+		t.Errorf("Unexpected bytes saved to the corrupt file: %v", cut)
+	}
+
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Unexpected value of key2: %q, %v", value, err)
+	}
+	if _, err := db.Get("key3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the torn entry to be dropped, got %v", err)
+	}
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDb(filepath.Dir(segmentPath), 1024, WithStrictRecovery())
+	if err != nil {
+		t.Fatalf("Expected the repaired directory to open in strict mode, got %s", err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Unexpected value of key3 written after the repair: %q, %v", value, err)
+	}
+}
+
+func TestDb_StrictRecovery(t *testing.T) {
+	segmentPath, torn := writeTornDb(t)
+	before, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDb(filepath.Dir(segmentPath), 1024, WithStrictRecovery())
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("Expected ErrCorrupted, got %v", err)
+	}
+
+	after, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) || !bytes.HasSuffix(after, torn) {
+		t.Error("Strict recovery must not modify the segment")
+	}
+	if _, err := os.Stat(segmentPath + corruptSuffix); !os.IsNotExist(err) {
+		t.Errorf("Strict recovery must not create the corrupt file, got %v", err)
+	}
+}
+
+func TestDb_DamagedEntry(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	segmentPath := filepath.Join(dir, outFileName+"0")
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte of the first key, the damage is not at the end of the file.
+	data[keyOffset+4] ^= 0xff
+	if err := os.WriteFile(segmentPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(dir, 1024); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted for a damaged entry, got %v", err)
+	}
+}
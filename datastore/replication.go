@@ -0,0 +1,400 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned for the writes to a follower, see Follower.
+	ErrNotLeader = errors.New("datastore is a follower, writes go to the leader")
+	// ErrNotFollower is returned by ApplyLog of a Db that is not a follower
+	// or was promoted, and by ApplySnapshot of such a Db without a consensus.
+	ErrNotFollower = errors.New("datastore is not a follower")
+	// ErrLogCompacted is returned by WriteLog for the positions the log has
+	// no complete history after. The follower needs a snapshot then.
+	ErrLogCompacted = errors.New("log position is compacted")
+)
+
+// The replication stream is a sequence of frames: an entry frame holds an
+// encoded entry, a heartbeat frame the log position and the time of the
+// leader as uint64 and int64 Unix nanoseconds.
+const (
+	frameEntry     byte = 'E'
+	frameHeartbeat byte = 'H'
+)
+
+// replicaState tracks the replication from the leader, guarded by db.mu.
+type replicaState struct {
+	leaderSeq   uint64
+	leaderTime  time.Time
+	contact     time.Time
+	appliedTime time.Time
+}
+
+// ReplicationStats describes the replication state of a Db. Lag is the
+// number of log positions the follower is behind the leader and
+// LagSeconds the age of the latest applied entry compared to the leader
+// clock, both as of the last heartbeat from the leader.
+type ReplicationStats struct {
+	Role           string    `json:"role"`
+	Position       uint64    `json:"position"`
+	LeaderPosition uint64    `json:"leader_position,omitempty"`
+	Lag            uint64    `json:"lag"`
+	LagSeconds     float64   `json:"lag_seconds"`
+	LastContact    time.Time `json:"last_contact,omitempty"`
+}
+
+// Follower opens the Db as a replica of a leader. It rejects the writes
+// with ErrNotLeader and receives the data with ApplyLog and ApplySnapshot
+// until it is promoted.
+func Follower() Option {
+	return func(db *Db) {
+		db.follower.Store(true)
+	}
+}
+
+// Promote turns a follower into a leader accepting writes.
+func (db *Db) Promote() {
+	db.follower.Store(false)
+}
+
+// IsFollower reports whether the Db is a follower.
+func (db *Db) IsFollower() bool {
+	return db.follower.Load()
+}
+
+// Position returns the log position of the latest entry.
+func (db *Db) Position() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+func (db *Db) replicationStats() *ReplicationStats {
+	stats := &ReplicationStats{Role: "leader", Position: db.seq}
+	if !db.follower.Load() {
+		return stats
+	}
+	stats.Role = "follower"
+	stats.LeaderPosition = db.replica.leaderSeq
+	stats.LastContact = db.replica.contact
+	if db.replica.leaderSeq > db.seq {
+		stats.Lag = db.replica.leaderSeq - db.seq
+		if !db.replica.appliedTime.IsZero() {
+			stats.LagSeconds = db.replica.leaderTime.Sub(db.replica.appliedTime).Seconds()
+		}
+	}
+	return stats
+}
+
+// WriteLog streams the entries following the log position from to w until
+// ctx is done or the Db is closed. Every batch of entries is followed by
+// a heartbeat, which is repeated each heartbeat interval without writes.
+// w is flushed after every heartbeat if it has a Flush method.
+func (db *Db) WriteLog(ctx context.Context, w io.Writer, from uint64, heartbeat time.Duration) error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+
+	type segmentRead struct {
+		segment    *Segment
+		start, end int64
+	}
+	out := bufio.NewWriterSize(w, bufferSize)
+	// The stream continues reading the segment it stopped at, the entries
+	// of the other segments before from are skipped.
+	var cursor *Segment
+	var cursorOffset int64
+	for {
+		db.mu.RLock()
+		seq, compacted, appended := db.seq, db.compactedSeq, db.appended
+		var reads []segmentRead
+		if from >= compacted && from <= seq {
+			for _, segment := range db.segments {
+				var start int64
+				if segment == cursor {
+					start = cursorOffset
+				} else if segment.maxSeq <= from {
+					continue
+				}
+				if start < segment.outOffset {
+					segment.readers.Add(1)
+					reads = append(reads, segmentRead{segment, start, segment.outOffset})
+				}
+			}
+		}
+		db.mu.RUnlock()
+		if from < compacted || from > seq {
+			return fmt.Errorf("%w: %d is not in [%d, %d]", ErrLogCompacted, from, compacted, seq)
+		}
+
+		var err error
+		for _, read := range reads {
+			if err == nil {
+				section := io.NewSectionReader(read.segment.file, read.start, read.end-read.start)
+				_, err = scanEntries(bufio.NewReaderSize(section, bufferSize), func(e *entry, offset int64) error {
+					if e.seq <= from {
+						return nil
+					}
+					from = e.seq
+					return writeEntryFrame(out, e)
+				})
+				cursor, cursorOffset = read.segment, read.end
+			}
+			read.segment.readers.Done()
+		}
+		if err == nil {
+			err = writeHeartbeat(out, seq, db.now())
+		}
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if flusher, ok := w.(interface{ Flush() }); ok {
+			flusher.Flush()
+		}
+
+		timer := time.NewTimer(heartbeat)
+		select {
+		case <-appended:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-db.stopping:
+			timer.Stop()
+			return ErrClosed
+		}
+		timer.Stop()
+	}
+}
+
+// WriteSnapshot writes the live data of all the buckets to w as a stream
+// for ApplySnapshot: a heartbeat with the log position of the snapshot, the
+// entries and the same heartbeat again. The merge entries are folded.
+func (db *Db) WriteSnapshot(w io.Writer) error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+
+	db.mu.RLock()
+	seq := db.seq
+	chains := collectChains(db.segments, "")
+	db.mu.RUnlock()
+
+	keys := make([]string, 0, len(chains))
+	for key := range chains {
+		keys = append(keys, key)
+	}
+	// The bucket definitions go first so that the follower knows the buckets.
+	sort.Slice(keys, func(i, j int) bool {
+		bucketI, _ := splitIndexKey(keys[i])
+		bucketJ, _ := splitIndexKey(keys[j])
+		if (bucketI == metaBucketID) != (bucketJ == metaBucketID) {
+			return bucketI == metaBucketID
+		}
+		return keys[i] < keys[j]
+	})
+
+	out := bufio.NewWriterSize(w, bufferSize)
+	err := writeHeartbeat(out, seq, db.now())
+	for _, key := range keys {
+		if err != nil {
+			releaseChain(chains[key])
+			continue
+		}
+		var entries []entry
+		entries, err = readChain(chains[key])
+		if err != nil {
+			continue
+		}
+		if folded, foldErr := db.operators.foldEntries(entries); foldErr == nil {
+			entries = []entry{folded}
+		}
+		for i := 0; i < len(entries) && err == nil; i++ {
+			err = writeEntryFrame(out, &entries[i])
+		}
+	}
+	if err == nil {
+		err = writeHeartbeat(out, seq, db.now())
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	return err
+}
+
+// ApplyLog appends the entries streamed by WriteLog of the leader until r
+// ends, fails or ctx is done. The entries keep their log positions.
+func (db *Db) ApplyLog(ctx context.Context, r io.Reader) error {
+	in := bufio.NewReaderSize(r, bufferSize)
+	for {
+		kind, e, err := readFrame(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if kind == frameHeartbeat {
+			db.heartbeat(e.seq, e.timestamp)
+			continue
+		}
+		if e.seq <= db.Position() {
+			continue
+		}
+		if !db.follower.Load() {
+			return ErrNotFollower
+		}
+		if err := db.applyReplicated(ctx, e); err != nil {
+			return err
+		}
+	}
+}
+
+// ApplySnapshot makes the follower data equal to the snapshot written by
+// WriteSnapshot of the leader. The keys missing from the snapshot are
+// deleted and the segments are compacted, so the follower continues from
+// the position of the snapshot. A Db with a consensus applies the snapshots
+// of the other nodes of its cluster the same way.
+func (db *Db) ApplySnapshot(ctx context.Context, r io.Reader) error {
+	in := bufio.NewReaderSize(r, bufferSize)
+	kind, start, err := readFrame(in)
+	if err != nil {
+		return fmt.Errorf("reading the snapshot: %w", err)
+	}
+	if kind != frameHeartbeat {
+		return fmt.Errorf("%w: the snapshot does not start with its position", ErrCorrupted)
+	}
+
+	received := make(map[string]struct{})
+	for {
+		kind, e, err := readFrame(in)
+		if err == io.EOF {
+			return fmt.Errorf("reading the snapshot: %w", io.ErrUnexpectedEOF)
+		} else if err != nil {
+			return fmt.Errorf("reading the snapshot: %w", err)
+		}
+		if kind == frameHeartbeat {
+			break
+		}
+		received[e.indexKey()] = struct{}{}
+		if err := db.applyReplicated(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	db.mu.RLock()
+	var missing []string
+	for key := range db.sizes {
+		if _, ok := received[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	db.mu.RUnlock()
+	for _, key := range missing {
+		bucket, userKey := splitIndexKey(key)
+		err := db.applyReplicated(ctx, entry{key: userKey, bucket: bucket, kind: kindDelete, seq: start.seq})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The entries of the snapshot are not in the log order, the compaction
+	// keeps the followers of this Db from streaming them.
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.seq = start.seq
+	db.mu.Unlock()
+	db.heartbeat(start.seq, start.timestamp)
+	return nil
+}
+
+// applyReplicated writes an entry received from the leader without the
+// checks of the client writes.
+func (db *Db) applyReplicated(ctx context.Context, e entry) error {
+	if !db.follower.Load() && db.consensus == nil {
+		return ErrNotFollower
+	}
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.pending.Done()
+	if err := db.write(ctx, putOperation{entry: e, replicated: true}); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.replica.appliedTime = time.Unix(0, e.timestamp)
+	db.mu.Unlock()
+	return nil
+}
+
+// writeReplicated appends an entry received from the leader. It is called
+// by the put routine.
+func (db *Db) writeReplicated(e entry) error {
+	db.stamp(&e, nil)
+	return db.appendEntry(e)
+}
+
+func (db *Db) heartbeat(seq uint64, timestamp int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.replica.leaderSeq = seq
+	db.replica.leaderTime = time.Unix(0, timestamp)
+	db.replica.contact = db.now()
+}
+
+func writeEntryFrame(out *bufio.Writer, e *entry) error {
+	if err := out.WriteByte(frameEntry); err != nil {
+		return err
+	}
+	_, err := out.Write(e.Encode())
+	return err
+}
+
+func writeHeartbeat(out *bufio.Writer, seq uint64, now time.Time) error {
+	var frame [17]byte
+	frame[0] = frameHeartbeat
+	binary.LittleEndian.PutUint64(frame[1:], seq)
+	binary.LittleEndian.PutUint64(frame[9:], uint64(now.UnixNano()))
+	_, err := out.Write(frame[:])
+	return err
+}
+
+// readFrame reads the next frame of a replication stream. A heartbeat is
+// returned as an entry with the seq and timestamp fields set.
+func readFrame(in *bufio.Reader) (byte, entry, error) {
+	var e entry
+	kind, err := in.ReadByte()
+	if err != nil {
+		return 0, e, err
+	}
+	switch kind {
+	case frameEntry:
+		e, err = readEntry(in)
+	case frameHeartbeat:
+		var frame [16]byte
+		if _, err = io.ReadFull(in, frame[:]); err == nil {
+			e.seq = binary.LittleEndian.Uint64(frame[:])
+			e.timestamp = int64(binary.LittleEndian.Uint64(frame[8:]))
+		}
+	default:
+		err = fmt.Errorf("%w: unknown replication frame %q", ErrCorrupted, kind)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return kind, e, err
+}
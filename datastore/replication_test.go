@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// copyLog writes the log of the leader after the follower position and
+// applies it to the follower.
+func copyLog(t *testing.T, leader, follower *Db) error {
+	t.Helper()
+	var stream bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := leader.WriteLog(ctx, &stream, follower.Position(), time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return follower.ApplyLog(context.Background(), &stream)
+}
+
+func TestDb_Replication(t *testing.T) {
+	leader, err := NewDb(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := NewDb(t.TempDir(), 256, Follower())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := leader.Put(key, key+"1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := copyLog(t, leader, follower); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Put("d", "d1"); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected ErrNotLeader, got %v", err)
+	}
+
+	if err := leader.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Put("c", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyLog(t, leader, follower); !errors.Is(err, ErrLogCompacted) {
+		t.Fatalf("Expected ErrLogCompacted, got %v", err)
+	}
+	var snapshot bytes.Buffer
+	if err := leader.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplySnapshot(context.Background(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leader.Put("e", "e1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyLog(t, leader, follower); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Position() != leader.Position() {
+		t.Errorf("Follower is at %d, leader at %d", follower.Position(), leader.Position())
+	}
+	for key, value := range map[string]string{"a": "a1", "c": "c2", "e": "e1"} {
+		if got, err := follower.Get(key); err != nil || got != value {
+			t.Errorf("Unexpected value of %s: %q, %v", key, got, err)
+		}
+	}
+	if _, err := follower.Get("b"); err != ErrNotFound {
+		t.Errorf("Expected the key deleted on the leader to be gone, got %v", err)
+	}
+	if stats := follower.Stats(); stats.Keys != 3 || stats.Replication.Role != "follower" || stats.Replication.Lag != 0 {
+		t.Errorf("Unexpected stats %+v %+v", stats, stats.Replication)
+	}
+
+	follower.Promote()
+	if err := follower.Put("d", "d1"); err != nil {
+		t.Errorf("Expected a promoted follower to accept writes, got %v", err)
+	}
+	if err := follower.ApplyLog(context.Background(), &bytes.Buffer{}); err != nil {
+		t.Errorf("Expected an empty log to apply, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"context"
+	"io"
+)
+
+// Store is a key-value storage engine. Db is the persistent log-structured
+// implementation, MemoryStore keeps everything in memory.
+type Store interface {
+	// Get returns the value stored for the key or ErrNotFound.
+	Get(key string) (string, error)
+	// Put stores the value for the key, replacing the previous one. Keys and
+	// values over the size limits are rejected with ErrKeyTooLarge and
+	// ErrValueTooLarge, empty and non UTF-8 keys and the keys starting with
+	// ReservedKeyPrefix with ErrInvalidKey.
+	Put(key, value string) error
+	// Delete removes the key. It returns ErrNotFound if the key does not exist.
+	Delete(key string) error
+	// GetContext, PutContext and DeleteContext are the variants of the
+	// operations above returning ctx.Err() once ctx is done.
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	// Scan calls fn for every key starting with prefix in ascending key order.
+	// Scanning stops at the first error returned by fn.
+	Scan(prefix string, fn func(key, value string) error) error
+	// ScanAfter is Scan of the keys following after. The skipped keys cost
+	// no reads of their values, so that the pages of a listing stay cheap.
+	ScanAfter(prefix, after string, fn func(key, value string) error) error
+	// Export writes all the live keys as JSON lines of ExportRecord.
+	Export(w io.Writer) error
+	// Import stores the JSON lines of ExportRecord read from r and returns
+	// the number of stored records.
+	Import(r io.Reader) (int, error)
+	// Close releases the resources held by the store. The operations on
+	// a closed store fail with ErrClosed.
+	Close() error
+	// Stats returns a snapshot of the store usage.
+	Stats() Stats
+}
+
+// Stats describes the current state of a store. DeadBytes counts the bytes
+// of the overwritten and deleted entries a merge would drop, WriteQueue the
+// writes waiting for the put routine of a Db and Expiring the keys with an
+// expiry time, see Db.PutExpiring. Replication is set by the stores taking
+// part in the replication, see Db.WriteLog.
+type Stats struct {
+	Keys        int               `json:"keys"`
+	Segments    int               `json:"segments"`
+	Bytes       int64             `json:"bytes"`
+	DeadBytes   int64             `json:"dead_bytes"`
+	WriteQueue  int               `json:"write_queue"`
+	Expiring    int               `json:"expiring,omitempty"`
+	Replication *ReplicationStats `json:"replication,omitempty"`
+}
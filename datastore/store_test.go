@@ -0,0 +1,290 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStore is the conformance suite every Store implementation must pass.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("put/get", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if err := store.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		value, err := store.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value1" {
+			t.Errorf("Unexpected value, expected value1, got %s", value)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		for i := 0; i < 10; i++ {
+			if err := store.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		value, err := store.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value9" {
+			t.Errorf("Unexpected value, expected value9, got %s", value)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if err := store.Delete("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound on delete, got %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if err := store.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if err := store.Delete("key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound on second delete, got %v", err)
+		}
+		if err := store.Put("key", "again"); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := store.Get("key"); value != "again" {
+			t.Errorf("Unexpected value after re-put: %s", value)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		for _, key := range []string{"b2", "a1", "b1", "c1", "b3"} {
+			if err := store.Put(key, "v-"+key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Delete("b3"); err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		err := store.Scan("b", func(key, value string) error {
+			if value != "v-"+key {
+				t.Errorf("Unexpected value for %s: %s", key, value)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"b1", "b2"}) {
+			t.Errorf("Unexpected scanned keys %v", keys)
+		}
+		keys = nil
+		err = store.ScanAfter("b", "b1", func(key, value string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(keys, []string{"b2"}) {
+			t.Errorf("Unexpected keys scanned after b1 %v, %v", keys, err)
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+		err = store.Scan("", func(string, string) error {
+			calls++
+			return errStop
+		})
+		if err != errStop || calls != 1 {
+			t.Errorf("Scan did not stop on error: %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		for i := 0; i < 20; i++ {
+			if err := store.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Delete("key0"); err != nil {
+			t.Fatal(err)
+		}
+		stats := store.Stats()
+		if stats.Keys != 4 {
+			t.Errorf("Expected 4 keys, got %d", stats.Keys)
+		}
+		if stats.Bytes <= 0 {
+			t.Errorf("Expected positive size, got %d", stats.Bytes)
+		}
+	})
+
+	t.Run("export/import", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		for _, key := range []string{"b", "a", "c"} {
+			if err := store.Put(key, "v-"+key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Delete("c"); err != nil {
+			t.Fatal(err)
+		}
+		var exported bytes.Buffer
+		if err := store.Export(&exported); err != nil {
+			t.Fatal(err)
+		}
+		// The versions depend on the store, only the Db has them.
+		var records []ExportRecord
+		decoder := json.NewDecoder(bytes.NewReader(exported.Bytes()))
+		for decoder.More() {
+			var record ExportRecord
+			if err := decoder.Decode(&record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, ExportRecord{Key: record.Key, Value: record.Value})
+		}
+		expected := []ExportRecord{{Key: "a", Value: "v-a"}, {Key: "b", Value: "v-b"}}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("Unexpected export:\n%s", exported.String())
+		}
+
+		target := newStore(t)
+		defer target.Close()
+		if n, err := target.Import(&exported); err != nil || n != 2 {
+			t.Fatalf("Unexpected import result: %d, %v", n, err)
+		}
+		if value, err := target.Get("b"); err != nil || value != "v-b" {
+			t.Errorf("Unexpected imported value of b: %q, %v", value, err)
+		}
+
+		if _, err := target.Import(strings.NewReader(`{"key":"d","value":"v"}` + "\n" + `{"value":"v"}`)); err == nil {
+			t.Error("Expected an error for a record without a key")
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if err := store.PutContext(context.Background(), "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := store.GetContext(context.Background(), "key"); err != nil || value != "value" {
+			t.Errorf("Unexpected value %q, %v", value, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := store.GetContext(ctx, "key"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled on get, got %v", err)
+		}
+		if err := store.PutContext(ctx, "other", "value"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled on put, got %v", err)
+		}
+		if err := store.DeleteContext(ctx, "key"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled on delete, got %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("key"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed on get, got %v", err)
+		}
+		if err := store.Put("key", "value"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed on put, got %v", err)
+		}
+		if err := store.Delete("key"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed on delete, got %v", err)
+		}
+		if err := store.Close(); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed on the second close, got %v", err)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if err := store.Put("", "value"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for an empty key, got %v", err)
+		}
+		if _, err := store.Get("\xff"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a non UTF-8 key, got %v", err)
+		}
+		if err := store.Put(ReservedKeyPrefix+"export", "value"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a reserved key, got %v", err)
+		}
+		longKey := strings.Repeat("k", DefaultMaxKeySize+1)
+		if err := store.Put(longKey, "value"); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if err := store.Delete(longKey); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge on delete, got %v", err)
+		}
+		if err := store.Put("key", strings.Repeat("v", DefaultMaxValueSize+1)); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if err := store.Put("a/b c", "value"); err != nil {
+			t.Errorf("Unexpected error for a key with a slash and a space: %s", err)
+		}
+
+		_, err := store.Import(strings.NewReader(`{"key":"","value":"v"}`))
+		if !errors.Is(err, ErrInvalidImport) || !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected an invalid import of an invalid key, got %v", err)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestDb_Store(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := NewDb(t.TempDir(), 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportRecord is a line of the JSON lines format used by Export and Import.
+// Version is the version of the key in the exported Db, it is omitted by the
+// stores without versions.
+type ExportRecord struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// ErrInvalidImport is returned by Import for malformed input.
+var ErrInvalidImport = errors.New("invalid import record")
+
+// importBatchSize limits the number of entries written in a single batch.
+const importBatchSize = 1000
+
+// exportStore writes all the live records of the store in key order.
+func exportStore(store Store, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return store.Scan("", func(key, value string) error {
+		return encoder.Encode(ExportRecord{Key: key, Value: value})
+	})
+}
+
+// readImport decodes the records from r, validates them with check and
+// passes them to write in batches. It returns the number of written records.
+func readImport(r io.Reader, check func(e *entry) error, write func(batch []entry) error) (int, error) {
+	decoder := json.NewDecoder(r)
+	batch := make([]entry, 0, importBatchSize)
+	imported := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := write(batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		var record ExportRecord
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return imported, fmt.Errorf("%w %d: %s", ErrInvalidImport, line, err)
+		}
+		e := entry{key: record.Key, value: record.Value, version: record.Version}
+		if err := check(&e); err != nil {
+			return imported, fmt.Errorf("%w %d: %w", ErrInvalidImport, line, err)
+		}
+
+		batch = append(batch, e)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+// Export writes all the live keys as JSON lines in key order.
+func (db *Db) Export(w io.Writer) error {
+	return db.exportBucket(defaultBucketID, w)
+}
+
+// exportBucket is exportStore writing the versions of the keys.
+func (db *Db) exportBucket(bucket uint32, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return db.scanEntries(bucket, "", "", func(key string, e entry) error {
+		return encoder.Encode(ExportRecord{Key: key, Value: e.value, Version: e.version})
+	})
+}
+
+// Import stores the records read as JSON lines from r. The records are
+// written in batches, so on error the records before the failed one may
+// stay stored. It returns the number of records in the completed batches.
+// The versions of the records are kept unless the Db has the same or a
+// later version of the key, the record becomes its next version then.
+func (db *Db) Import(r io.Reader) (int, error) {
+	return db.importInto(defaultBucketID, r)
+}
+
+func (db *Db) importInto(bucket uint32, r io.Reader) (int, error) {
+	if err := db.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := db.begin(); err != nil {
+		return 0, err
+	}
+	defer db.pending.Done()
+	check := func(e *entry) error {
+		e.bucket = bucket
+		if e.version != 0 {
+			db.mu.RLock()
+			if e.version <= db.versions[e.indexKey()] {
+				e.version = 0
+			}
+			db.mu.RUnlock()
+		}
+		return db.checkEntry(e)
+	}
+	return readImport(r, check, func(batch []entry) error {
+		if db.consensus != nil {
+			return db.propose(context.Background(), batch...)
+		}
+		return db.write(context.Background(), putOperation{batch: batch})
+	})
+}
+
+func (s *MemoryStore) Export(w io.Writer) error {
+	return exportStore(s, w)
+}
+
+func (s *MemoryStore) Import(r io.Reader) (int, error) {
+	return readImport(r, s.checkEntry, func(batch []entry) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.data == nil {
+			return ErrClosed
+		}
+		for _, e := range batch {
+			s.data[e.key] = e.value
+		}
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDb_Import(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input bytes.Buffer
+	for i := 0; i < 2500; i++ {
+		fmt.Fprintf(&input, "{\"key\":\"key%d\",\"value\":\"value%d\"}\n", i, i)
+	}
+	if n, err := db.Import(&input); err != nil || n != 2500 {
+		t.Fatalf("Unexpected import result: %d, %v", n, err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if stats := db.Stats(); stats.Keys != 2500 {
+		t.Errorf("Expected 2500 keys after reopening, got %d", stats.Keys)
+	}
+	if value, err := db.Get("key1234"); err != nil || value != "value1234" {
+		t.Errorf("Unexpected value of key1234: %q, %v", value, err)
+	}
+}
+
+func TestDb_ExportVersions(t *testing.T) {
+	source, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	source.Put("a", "a1")
+	source.Put("a", "a2")
+	source.Put("b", "b1")
+
+	var exported bytes.Buffer
+	if err := source.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"key":"a","value":"a2","version":2}` + "\n" + `{"key":"b","value":"b1","version":1}` + "\n"
+	if exported.String() != expected {
+		t.Fatalf("Unexpected export %q", exported.String())
+	}
+
+	target, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	target.Put("b", "b0")
+	target.Put("b", "b0")
+	if _, err := target.Import(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	// b has the imported version already, the record becomes a new one.
+	for key, version := range map[string]uint64{"a": 2, "b": 3} {
+		item, err := target.GetItem(context.Background(), key)
+		if err != nil || item.Version != version {
+			t.Errorf("Expected version %d of %s, got %+v, %v", version, key, item, err)
+		}
+		// The records keeping their versions get the time of the import.
+		if item.Modified.IsZero() || time.Since(item.Modified) > time.Minute {
+			t.Errorf("Unexpected modification time of %s: %s", key, item.Modified)
+		}
+	}
+	if err := target.Put("a", "a3"); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := target.GetItem(context.Background(), "a"); err != nil || item.Version != 3 {
+		t.Errorf("Expected the writes to continue the imported versions, got %+v, %v", item, err)
+	}
+}
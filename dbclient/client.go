@@ -0,0 +1,198 @@
+// Package dbclient is the Go client of the db service.
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbproto"
+)
+
+var (
+	// ErrNotFound is returned for the missing keys.
+	ErrNotFound = errors.New("key not found")
+	// ErrInvalid is returned for the requests rejected by the service:
+	// invalid or too large keys and values, unknown buckets.
+	ErrInvalid = errors.New("invalid request")
+	// ErrUnavailable is returned when the service cannot be reached, is
+	// shutting down or the request timed out.
+	ErrUnavailable = errors.New("db service unavailable")
+	// ErrNotLeader is returned for the writes sent to a follower.
+	ErrNotLeader = errors.New("db node is not the leader")
+	// ErrClosed is returned by a closed Client.
+	ErrClosed = errors.New("client is closed")
+)
+
+// Client sends the requests to the db service over its binary protocol, see
+// package dbproto. It keeps a pool of connections, each of them carrying
+// any number of requests at once, and retries the requests failing with
+// ErrUnavailable. A Client is safe for concurrent use.
+//
+// A retried Delete whose first attempt succeeded without the response
+// reaching the client returns ErrNotFound.
+type Client struct {
+	addr string
+	opts options
+
+	mu     sync.Mutex
+	conns  []*conn
+	next   int
+	closed bool
+}
+
+// New returns a client of the binary protocol listener of the db service at
+// addr, e.g. db:8085. The connections are opened on demand.
+func New(addr string, opts ...Option) *Client {
+	o := newOptions(opts)
+	return &Client{addr: addr, opts: o, conns: make([]*conn, o.poolSize)}
+}
+
+// Get returns the value of the key in the default bucket.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.Bucket("").Get(ctx, key)
+}
+
+// Put stores the value of the key in the default bucket.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.Bucket("").Put(ctx, key, value)
+}
+
+// Delete removes the key from the default bucket.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.Bucket("").Delete(ctx, key)
+}
+
+// Ping checks the service answers.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, dbproto.Request{Op: dbproto.OpPing})
+	return err
+}
+
+// Bucket returns the client of the named bucket, the empty name selects
+// the default one.
+func (c *Client) Bucket(name string) Bucket {
+	return Bucket{c: c, name: name}
+}
+
+// Close closes the connections. The requests in flight fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for i, cn := range c.conns {
+		if cn != nil {
+			cn.fail(ErrClosed)
+			c.conns[i] = nil
+		}
+	}
+	return nil
+}
+
+// Bucket sends the requests for the keys of a bucket.
+type Bucket struct {
+	c    *Client
+	name string
+}
+
+// Get returns the value of the key or ErrNotFound.
+func (b Bucket) Get(ctx context.Context, key string) (string, error) {
+	return b.c.do(ctx, dbproto.Request{Op: dbproto.OpGet, Bucket: b.name, Key: key})
+}
+
+// Put stores the value of the key.
+func (b Bucket) Put(ctx context.Context, key, value string) error {
+	_, err := b.c.do(ctx, dbproto.Request{Op: dbproto.OpPut, Bucket: b.name, Key: key, Value: value})
+	return err
+}
+
+// Delete removes the key, it returns ErrNotFound if there is no such key.
+func (b Bucket) Delete(ctx context.Context, key string) error {
+	_, err := b.c.do(ctx, dbproto.Request{Op: dbproto.OpDelete, Bucket: b.name, Key: key})
+	return err
+}
+
+// do sends the request, retrying it while it fails with ErrUnavailable.
+func (c *Client) do(ctx context.Context, req dbproto.Request) (string, error) {
+	for attempt := 0; ; attempt++ {
+		value, err := c.attempt(ctx, req)
+		if !errors.Is(err, ErrUnavailable) || attempt == c.opts.retries {
+			return value, err
+		}
+		if err := c.opts.wait(ctx, attempt); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, req dbproto.Request) (string, error) {
+	if c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	cn, err := c.conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+	}
+	resp, err := cn.send(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, responseError(resp)
+}
+
+func responseError(resp dbproto.Response) error {
+	switch resp.Status {
+	case dbproto.StatusOK:
+		return nil
+	case dbproto.StatusNotFound:
+		return ErrNotFound
+	case dbproto.StatusInvalid:
+		return fmt.Errorf("%w: %s", ErrInvalid, resp.Value)
+	case dbproto.StatusUnavailable:
+		return fmt.Errorf("%w: %s", ErrUnavailable, resp.Value)
+	case dbproto.StatusNotLeader:
+		return fmt.Errorf("%w: %s", ErrNotLeader, resp.Value)
+	}
+	return fmt.Errorf("db service failed: %s", resp.Value)
+}
+
+// conn returns the next connection of the pool, opening it if needed.
+func (c *Client) conn(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	i := c.next
+	c.next = (c.next + 1) % len(c.conns)
+	if cn := c.conns[i]; cn != nil && !cn.broken() {
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	cn, err := dial(ctx, c.addr, c.opts.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		cn.fail(ErrClosed)
+		return nil, ErrClosed
+	}
+	if existing := c.conns[i]; existing != nil && !existing.broken() {
+		// Another request opened the connection meanwhile.
+		cn.fail(ErrClosed)
+		return existing, nil
+	}
+	c.conns[i] = cn
+	return cn, nil
+}
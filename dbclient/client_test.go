@@ -0,0 +1,238 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbproto"
+)
+
+// fakeServer answers the dbproto requests from a map. The requests for the
+// key "slow" wait until release is closed, the first failures requests are
+// answered with StatusUnavailable.
+type fakeServer struct {
+	l        net.Listener
+	release  chan struct{}
+	failures atomic.Int32
+	conns    atomic.Int32
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func startFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, release: make(chan struct{}), values: make(map[string]string)}
+	var open []net.Conn
+	var openMu sync.Mutex
+	t.Cleanup(func() {
+		l.Close()
+		openMu.Lock()
+		defer openMu.Unlock()
+		for _, nc := range open {
+			nc.Close()
+		}
+	})
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			openMu.Lock()
+			open = append(open, nc)
+			openMu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	r := bufio.NewReader(nc)
+	var writeMu sync.Mutex
+	for {
+		req, err := dbproto.ReadRequest(r)
+		if err != nil {
+			nc.Close()
+			return
+		}
+		go func() {
+			resp := s.handle(req)
+			writeMu.Lock()
+			dbproto.WriteResponse(nc, resp)
+			writeMu.Unlock()
+		}()
+	}
+}
+
+func (s *fakeServer) handle(req dbproto.Request) dbproto.Response {
+	resp := dbproto.Response{ID: req.ID}
+	if s.failures.Add(-1) >= 0 {
+		resp.Status, resp.Value = dbproto.StatusUnavailable, "closing"
+		return resp
+	}
+	if req.Key == "slow" {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := req.Bucket + "/" + req.Key
+	switch req.Op {
+	case dbproto.OpGet:
+		value, ok := s.values[key]
+		if !ok {
+			resp.Status = dbproto.StatusNotFound
+		}
+		resp.Value = value
+	case dbproto.OpPut:
+		if req.Key == "" {
+			resp.Status, resp.Value = dbproto.StatusInvalid, "key is empty"
+		}
+		s.values[key] = req.Value
+	case dbproto.OpDelete:
+		if _, ok := s.values[key]; !ok {
+			resp.Status = dbproto.StatusNotFound
+		}
+		delete(s.values, key)
+	}
+	return resp
+}
+
+func TestClient(t *testing.T) {
+	s := startFakeServer(t)
+	c := New(s.l.Addr().String(), WithPoolSize(2))
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if err := c.Bucket("team").Put(ctx, "key", "team value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := c.Bucket("team").Get(ctx, "key"); value != "team value" {
+		t.Errorf("Unexpected value %q in the bucket", value)
+	}
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound on the second delete, got %v", err)
+	}
+	if err := c.Put(ctx, "", "value"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+
+	// The requests share the connections of the pool.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Ping(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := s.conns.Load(); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+
+	c.Close()
+	if err := c.Ping(ctx); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClient_Multiplexing(t *testing.T) {
+	s := startFakeServer(t)
+	c := New(s.l.Addr().String(), WithPoolSize(1))
+	defer c.Close()
+	ctx := context.Background()
+	s.values["/slow"] = "slow value"
+	c.Put(ctx, "fast", "fast value")
+
+	slow := make(chan string)
+	go func() {
+		value, _ := c.Get(ctx, "slow")
+		slow <- value
+	}()
+	// The responses to the later requests overtake the slow one on the
+	// same connection.
+	for i := 0; i < 10; i++ {
+		if value, err := c.Get(ctx, "fast"); err != nil || value != "fast value" {
+			t.Fatalf("Unexpected value %q, %v", value, err)
+		}
+	}
+	select {
+	case <-slow:
+		t.Fatal("Slow request finished before its release")
+	default:
+	}
+	close(s.release)
+	if value := <-slow; value != "slow value" {
+		t.Errorf("Unexpected slow value %q", value)
+	}
+	if n := s.conns.Load(); n != 1 {
+		t.Errorf("Expected a single connection, got %d", n)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	s := startFakeServer(t)
+	ctx := context.Background()
+
+	c := New(s.l.Addr().String(), WithRetries(3, time.Millisecond))
+	defer c.Close()
+	s.failures.Store(2)
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Errorf("Expected the put to succeed after the retries, got %v", err)
+	}
+	s.failures.Store(5)
+	if err := c.Put(ctx, "key", "value"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable after the retries, got %v", err)
+	}
+	s.failures.Store(0)
+
+	// The attempts give up after the timeout.
+	timeout := New(s.l.Addr().String(), WithTimeout(20*time.Millisecond), WithRetries(1, time.Millisecond))
+	defer timeout.Close()
+	start := time.Now()
+	if _, err := timeout.Get(ctx, "slow"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable on a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request took %s", elapsed)
+	}
+
+	// A service which is down fails after the retries.
+	addr := s.l.Addr().String()
+	s.l.Close()
+	down := New(addr, WithRetries(2, time.Millisecond))
+	defer down.Close()
+	if err := down.Ping(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable for a service which is down, got %v", err)
+	}
+	close(s.release)
+}
@@ -0,0 +1,125 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbproto"
+)
+
+// conn multiplexes the requests over a connection: the requests are written
+// with their IDs and a reading goroutine passes every response to the
+// request waiting for it.
+type conn struct {
+	nc      net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint32]chan dbproto.Response
+	nextID  uint32
+	err     error
+	done    chan struct{}
+}
+
+func dial(ctx context.Context, addr string, timeout time.Duration) (*conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	c := &conn{
+		nc:      nc,
+		pending: make(map[uint32]chan dbproto.Response),
+		done:    make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+// send writes the request and waits for its response.
+func (c *conn) send(ctx context.Context, req dbproto.Request) (dbproto.Response, error) {
+	responses := make(chan dbproto.Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return dbproto.Response{}, c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = responses
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	c.nc.SetWriteDeadline(deadline)
+	err := dbproto.WriteRequest(c.nc, req)
+	c.writeMu.Unlock()
+	if errors.Is(err, dbproto.ErrFrameTooLarge) || errors.Is(err, dbproto.ErrMalformed) {
+		return dbproto.Response{}, fmt.Errorf("%w: %s", ErrInvalid, err)
+	} else if err != nil {
+		// A partly written frame leaves the connection unusable.
+		c.fail(fmt.Errorf("%w: %s", ErrUnavailable, err))
+		return dbproto.Response{}, c.err
+	}
+
+	select {
+	case resp := <-responses:
+		return resp, nil
+	case <-c.done:
+		return dbproto.Response{}, c.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return dbproto.Response{}, fmt.Errorf("%w: request timed out", ErrUnavailable)
+		}
+		return dbproto.Response{}, ctx.Err()
+	}
+}
+
+func (c *conn) read() {
+	r := bufio.NewReader(c.nc)
+	for {
+		resp, err := dbproto.ReadResponse(r)
+		if err != nil {
+			c.fail(fmt.Errorf("%w: %s", ErrUnavailable, err))
+			return
+		}
+		c.mu.Lock()
+		responses := c.pending[resp.ID]
+		c.mu.Unlock()
+		if responses != nil {
+			// The buffer keeps the response of a request that gave up.
+			select {
+			case responses <- resp:
+			default:
+			}
+		}
+	}
+}
+
+// fail closes the connection, the requests waiting for their responses
+// get err.
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+		c.nc.Close()
+	}
+}
+
+func (c *conn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
@@ -0,0 +1,287 @@
+// Package dbtest provides a fake of the HTTP API of the db service for the
+// unit tests of its consumers.
+package dbtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is an in-memory fake of the HTTP API of the db service serving
+// the keys, GET /db lists, POST /db/_batch, /db/_mget and /db/_mset. Every bucket exists, the
+// empty name is the default one.
+//
+//	srv := dbtest.NewServer()
+//	defer srv.Close()
+//	client := dbclient.NewHTTP(srv.URL)
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]string
+	failures []int
+	requests int
+}
+
+// NewServer starts a fake server, the caller should Close it.
+func NewServer() *Server {
+	s := &Server{buckets: map[string]map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Set stores the value of the key in the bucket.
+func (s *Server) Set(bucket, key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bucket(bucket)[key] = value
+}
+
+// Value returns the value of the key in the bucket.
+func (s *Server) Value(bucket, key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.buckets[bucket][key]
+	return value, ok
+}
+
+// Fail makes the server respond with the status to the next n requests.
+func (s *Server) Fail(status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// Requests returns the number of the requests served so far.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) bucket(name string) map[string]string {
+	if s.buckets[name] == nil {
+		s.buckets[name] = map[string]string{}
+	}
+	return s.buckets[name]
+}
+
+func (s *Server) serve(res http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+	switch path := req.URL.EscapedPath(); {
+	case path == "/db":
+		s.list(res, req)
+	case path == "/db/_batch":
+		s.batch(res, req)
+	case path == "/db/_mget":
+		s.mget(res, req)
+	case path == "/db/_mset":
+		s.mset(res, req)
+	case strings.HasPrefix(path, "/db/"):
+		s.key(res, req, strings.TrimPrefix(path, "/db/"))
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+func (s *Server) key(res http.ResponseWriter, req *http.Request, path string) {
+	segments := strings.Split(path, "/")
+	if len(segments) > 2 || segments[len(segments)-1] == "" {
+		http.Error(res, "Invalid key", http.StatusBadRequest)
+		return
+	}
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			http.Error(res, "Key is not properly escaped", http.StatusBadRequest)
+			return
+		}
+		segments[i] = unescaped
+	}
+	bucket, key := "", segments[0]
+	if len(segments) == 2 {
+		bucket, key = segments[0], segments[1]
+	}
+	data := s.bucket(bucket)
+
+	switch req.Method {
+	case "GET", "HEAD":
+		value, ok := data[key]
+		if !ok {
+			http.Error(res, "Key not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]string{"key": key, "value": value})
+	case "POST":
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		data[key] = body.Value
+		res.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if _, ok := data[key]; !ok {
+			http.Error(res, "Key not found", http.StatusNotFound)
+			return
+		}
+		delete(data, key)
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) list(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := 100
+	if query.Has("limit") {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 1000 {
+			http.Error(res, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	data := s.bucket(query.Get("bucket"))
+	var keys []string
+	for key := range data {
+		if strings.HasPrefix(key, query.Get("prefix")) && (!query.Has("after") || key > query.Get("after")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type item struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	page := struct {
+		Items []item `json:"items"`
+		Next  string `json:"next,omitempty"`
+	}{Items: []item{}}
+	for i, key := range keys {
+		if i == limit {
+			page.Next = keys[limit-1]
+			break
+		}
+		page.Items = append(page.Items, item{key, data[key]})
+	}
+	writeJSON(res, http.StatusOK, page)
+}
+
+func (s *Server) batch(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var operations []struct {
+		Op    string `json:"op"`
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&operations); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	for _, op := range operations {
+		if op.Op != "put" && op.Op != "delete" {
+			http.Error(res, "Unknown operation "+strconv.Quote(op.Op), http.StatusBadRequest)
+			return
+		}
+	}
+	type result struct {
+		Status int    `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+	data := s.bucket(req.URL.Query().Get("bucket"))
+	results := make([]result, len(operations))
+	for i, op := range operations {
+		switch _, ok := data[op.Key]; {
+		case op.Op == "put":
+			data[op.Key] = op.Value
+			results[i] = result{Status: http.StatusCreated}
+		case !ok:
+			results[i] = result{Status: http.StatusNotFound, Error: "key not found"}
+		default:
+			delete(data, op.Key)
+			results[i] = result{Status: http.StatusOK}
+		}
+	}
+	writeJSON(res, http.StatusOK, map[string][]result{"results": results})
+}
+
+func (s *Server) mget(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	data := s.bucket(req.URL.Query().Get("bucket"))
+	response := struct {
+		Values  map[string]string `json:"values"`
+		Missing []string          `json:"missing"`
+	}{Values: map[string]string{}, Missing: []string{}}
+	for _, key := range request.Keys {
+		if value, ok := data[key]; ok {
+			response.Values[key] = value
+		} else {
+			response.Missing = append(response.Missing, key)
+		}
+	}
+	writeJSON(res, http.StatusOK, response)
+}
+
+func (s *Server) mset(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var records []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&records); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	type result struct {
+		Key    string `json:"key"`
+		Status int    `json:"status"`
+	}
+	data := s.bucket(req.URL.Query().Get("bucket"))
+	results := make([]result, len(records))
+	for i, record := range records {
+		data[record.Key] = record.Value
+		results[i] = result{Key: record.Key, Status: http.StatusCreated}
+	}
+	writeJSON(res, http.StatusOK, map[string][]result{"results": results})
+}
+
+func writeJSON(res http.ResponseWriter, status int, value any) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(value)
+}
@@ -0,0 +1,322 @@
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrConflict is returned when the service refuses the request in its
+	// current state, e.g. an import while the router is rebalancing.
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized is returned when the service requires a token and
+	// the client has none or an unknown one, see WithToken.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when the token of the client does not allow
+	// the request.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// StatusError is an error response of the HTTP API. It wraps the error
+// matching its status: ErrNotFound, ErrConflict, ErrInvalid, ErrNotLeader,
+// ErrUnauthorized, ErrForbidden or ErrUnavailable.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("db service responded %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return ErrInvalid
+	case http.StatusMisdirectedRequest:
+		return ErrNotLeader
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// KeyValue is a key with its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Operation is a put of the value or, with Delete set, a delete of the key
+// in a batch.
+type Operation struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+const (
+	// listPageSize is the number of the keys List asks for at once.
+	listPageSize = 1000
+	// multiSize is the number of the keys MGet and MSet send at once.
+	multiSize = 1000
+)
+
+// HTTPClient sends the requests to the HTTP API of the db service. The
+// idempotent calls, all but Batch, are retried with a growing
+// randomized delay while they fail with ErrUnavailable. An HTTPClient is
+// safe for concurrent use.
+type HTTPClient struct {
+	base   string
+	bucket string
+	opts   options
+}
+
+// NewHTTP returns a client of the db service at baseURL, e.g.
+// http://db:8083. WithPoolSize and WithDialTimeout do not apply, see
+// WithHTTPClient instead.
+func NewHTTP(baseURL string, opts ...Option) *HTTPClient {
+	return &HTTPClient{base: strings.TrimSuffix(baseURL, "/"), opts: newOptions(opts)}
+}
+
+// Bucket returns the client of the named bucket, the empty name selects
+// the default one.
+func (c *HTTPClient) Bucket(name string) *HTTPClient {
+	bucket := *c
+	bucket.bucket = name
+	return &bucket
+}
+
+// Get returns the value of the key.
+func (c *HTTPClient) Get(ctx context.Context, key string) (string, error) {
+	var kv KeyValue
+	err := c.do(ctx, "GET", c.keyPath(key), nil, true, &kv)
+	return kv.Value, err
+}
+
+// Exists reports whether the key exists without reading its value.
+func (c *HTTPClient) Exists(ctx context.Context, key string) (bool, error) {
+	err := c.do(ctx, "HEAD", c.keyPath(key), nil, true, nil)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put stores the value of the key.
+func (c *HTTPClient) Put(ctx context.Context, key, value string) error {
+	body, _ := json.Marshal(map[string]string{"value": value})
+	return c.do(ctx, "POST", c.keyPath(key), body, true, nil)
+}
+
+// Delete removes the key. A retried Delete whose first attempt succeeded
+// without the response reaching the client returns ErrNotFound.
+func (c *HTTPClient) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, "DELETE", c.keyPath(key), nil, true, nil)
+}
+
+// List returns the keys starting with prefix with their values in key
+// order, reading them page by page.
+func (c *HTTPClient) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	var list []KeyValue
+	query := c.query()
+	query.Set("prefix", prefix)
+	query.Set("limit", fmt.Sprint(listPageSize))
+	for {
+		var page struct {
+			Items []KeyValue `json:"items"`
+			Next  string     `json:"next"`
+		}
+		if err := c.do(ctx, "GET", "/db?"+query.Encode(), nil, true, &page); err != nil {
+			return list, err
+		}
+		list = append(list, page.Items...)
+		if page.Next == "" {
+			return list, nil
+		}
+		query.Set("after", page.Next)
+	}
+}
+
+// MGet returns the values of the keys, the missing keys are left out of the
+// map. Over a thousand keys are sent with several requests.
+func (c *HTTPClient) MGet(ctx context.Context, keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for start := 0; start < len(keys); start += multiSize {
+		body, _ := json.Marshal(map[string][]string{"keys": keys[start:min(start+multiSize, len(keys))]})
+		var response struct {
+			Values map[string]string `json:"values"`
+		}
+		if err := c.do(ctx, "POST", "/db/_mget?"+c.query().Encode(), body, true, &response); err != nil {
+			return values, err
+		}
+		for key, value := range response.Values {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// MSet stores the values of the keys in order. Every put succeeds or fails
+// on its own, the returned slice has the error of every put, nil for the
+// successful ones. Over a thousand keys are sent with several requests.
+func (c *HTTPClient) MSet(ctx context.Context, values []KeyValue) ([]error, error) {
+	errs := make([]error, 0, len(values))
+	for start := 0; start < len(values); start += multiSize {
+		chunk := values[start:min(start+multiSize, len(values))]
+		body, _ := json.Marshal(chunk)
+		var response struct {
+			Results []result `json:"results"`
+		}
+		if err := c.do(ctx, "POST", "/db/_mset?"+c.query().Encode(), body, true, &response); err != nil {
+			return nil, err
+		}
+		if len(response.Results) != len(chunk) {
+			return nil, fmt.Errorf("db service returned %d results for %d keys", len(response.Results), len(chunk))
+		}
+		for _, result := range response.Results {
+			errs = append(errs, result.err())
+		}
+	}
+	return errs, nil
+}
+
+// Batch runs the operations in order with a single request. Every operation
+// succeeds or fails on its own, the returned slice has the error of every
+// operation, nil for the successful ones. A failed request is not retried.
+func (c *HTTPClient) Batch(ctx context.Context, operations []Operation) ([]error, error) {
+	type operation struct {
+		Op    string `json:"op"`
+		Key   string `json:"key"`
+		Value string `json:"value,omitempty"`
+	}
+	request := make([]operation, len(operations))
+	for i, op := range operations {
+		request[i] = operation{Op: "put", Key: op.Key, Value: op.Value}
+		if op.Delete {
+			request[i] = operation{Op: "delete", Key: op.Key}
+		}
+	}
+	body, _ := json.Marshal(request)
+	var response struct {
+		Results []result `json:"results"`
+	}
+	if err := c.do(ctx, "POST", "/db/_batch?"+c.query().Encode(), body, false, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Results) != len(operations) {
+		return nil, fmt.Errorf("db service returned %d results for %d operations", len(response.Results), len(operations))
+	}
+	errs := make([]error, len(operations))
+	for i, result := range response.Results {
+		errs[i] = result.err()
+	}
+	return errs, nil
+}
+
+// result is the outcome of an operation of a batch or a put of MSet.
+type result struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func (r result) err() error {
+	if r.Status >= 400 {
+		return &StatusError{StatusCode: r.Status, Message: r.Error}
+	}
+	return nil
+}
+
+func (c *HTTPClient) query() url.Values {
+	query := url.Values{}
+	if c.bucket != "" {
+		query.Set("bucket", c.bucket)
+	}
+	return query
+}
+
+// keyPath is the escaped path of the key. A key named history gets an
+// escaped letter not to be taken for the history of a key.
+func (c *HTTPClient) keyPath(key string) string {
+	escaped := url.PathEscape(key)
+	if escaped == "history" {
+		escaped = "%68istory"
+	}
+	if c.bucket == "" {
+		return "/db/" + escaped
+	}
+	return "/db/" + url.PathEscape(c.bucket) + "/" + escaped
+}
+
+// do sends the request and decodes the JSON response into out unless it is
+// nil. The idempotent requests are retried.
+func (c *HTTPClient) do(ctx context.Context, method, path string, body []byte, idempotent bool, out any) error {
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, body, out)
+		if !idempotent || !errors.Is(err, ErrUnavailable) || attempt == c.opts.retries {
+			return err
+		}
+		if err := c.opts.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *HTTPClient) attempt(ctx context.Context, method, path string, body []byte, out any) error {
+	parent := ctx
+	if c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.token)
+	}
+	resp, err := c.opts.httpClient.Do(req)
+	if err != nil {
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %s", ErrUnavailable, err)
+		}
+		return fmt.Errorf("invalid response of the db service: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package dbclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient/dbtest"
+)
+
+func TestHTTPClient(t *testing.T) {
+	srv := dbtest.NewServer()
+	defer srv.Close()
+	c := dbclient.NewHTTP(srv.URL + "/")
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Put(ctx, "a/b c", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := srv.Value("", "a/b c"); !ok || value != "value" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+	if value, err := c.Get(ctx, "a/b c"); err != nil || value != "value" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if ok, err := c.Exists(ctx, "a/b c"); !ok || err != nil {
+		t.Errorf("Expected the key to exist, got %v, %v", ok, err)
+	}
+	if err := c.Delete(ctx, "a/b c"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Exists(ctx, "a/b c"); ok || err != nil {
+		t.Errorf("Expected the key deleted, got %v, %v", ok, err)
+	}
+	if err := c.Delete(ctx, "a/b c"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound on the second delete, got %v", err)
+	}
+
+	team := c.Bucket("team")
+	if err := team.Put(ctx, "key", "team value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := srv.Value("team", "key"); value != "team value" {
+		t.Errorf("Unexpected value in the bucket %q", value)
+	}
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected the default bucket unchanged, got %v", err)
+	}
+}
+
+func TestHTTPClient_List(t *testing.T) {
+	srv := dbtest.NewServer()
+	defer srv.Close()
+	for i := range 2500 {
+		srv.Set("", fmt.Sprintf("key-%04d", i), fmt.Sprint(i))
+	}
+	srv.Set("", "other", "value")
+
+	list, err := dbclient.NewHTTP(srv.URL).List(context.Background(), "key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2500 || list[0].Key != "key-0000" || list[2499].Value != "2499" {
+		t.Errorf("Unexpected list of %d keys", len(list))
+	}
+	if srv.Requests() != 3 {
+		t.Errorf("Expected 3 pages, got %d requests", srv.Requests())
+	}
+}
+
+func TestHTTPClient_Batch(t *testing.T) {
+	srv := dbtest.NewServer()
+	defer srv.Close()
+	srv.Set("team", "old", "value")
+	c := dbclient.NewHTTP(srv.URL, dbclient.WithRetries(3, time.Millisecond)).Bucket("team")
+	ctx := context.Background()
+
+	errs, err := c.Batch(ctx, []dbclient.Operation{
+		{Key: "new", Value: "v1"},
+		{Key: "old", Delete: true},
+		{Key: "missing", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 3 || errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], dbclient.ErrNotFound) {
+		t.Errorf("Unexpected results %v", errs)
+	}
+	if value, _ := srv.Value("team", "new"); value != "v1" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+
+	srv.Fail(http.StatusServiceUnavailable, 1)
+	before := srv.Requests()
+	if _, err := c.Batch(ctx, []dbclient.Operation{{Key: "new", Delete: true}}); !errors.Is(err, dbclient.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+	if n := srv.Requests() - before; n != 1 {
+		t.Errorf("Expected a failed batch not retried, got %d requests", n)
+	}
+}
+
+func TestHTTPClient_Retries(t *testing.T) {
+	srv := dbtest.NewServer()
+	defer srv.Close()
+	srv.Set("", "key", "value")
+	ctx := context.Background()
+
+	c := dbclient.NewHTTP(srv.URL, dbclient.WithRetries(3, time.Millisecond))
+	srv.Fail(http.StatusServiceUnavailable, 3)
+	if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Expected a retried success, got %q, %v", value, err)
+	}
+	if srv.Requests() != 4 {
+		t.Errorf("Expected 4 attempts, got %d", srv.Requests())
+	}
+
+	srv.Fail(http.StatusBadGateway, 4)
+	var status *dbclient.StatusError
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrUnavailable) || !errors.As(err, &status) || status.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected ErrUnavailable after the retries, got %v", err)
+	}
+
+	srv.Fail(http.StatusConflict, 1)
+	if err := c.Put(ctx, "key", "value"); !errors.Is(err, dbclient.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	c = dbclient.NewHTTP(srv.URL, dbclient.WithRetries(10, time.Second))
+	srv.Fail(http.StatusServiceUnavailable, 1)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to stop the retries, got %v", err)
+	}
+}
+
+func TestHTTPClient_Unreachable(t *testing.T) {
+	srv := dbtest.NewServer()
+	srv.Close()
+	c := dbclient.NewHTTP(srv.URL, dbclient.WithRetries(1, time.Millisecond))
+	if _, err := c.Get(context.Background(), "key"); !errors.Is(err, dbclient.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+}
+
+func TestHTTPClient_Multi(t *testing.T) {
+	srv := dbtest.NewServer()
+	defer srv.Close()
+	c := dbclient.NewHTTP(srv.URL).Bucket("team")
+	ctx := context.Background()
+
+	values := make([]dbclient.KeyValue, 1500)
+	keys := make([]string, 1501)
+	for i := range values {
+		values[i] = dbclient.KeyValue{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprint(i)}
+		keys[i] = values[i].Key
+	}
+	keys[1500] = "missing"
+
+	errs, err := c.MSet(ctx, values)
+	if err != nil || len(errs) != len(values) {
+		t.Fatalf("Unexpected results %d, %v", len(errs), err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error of %s: %v", values[i].Key, err)
+		}
+	}
+	if value, _ := srv.Value("team", "key-1499"); value != "1499" {
+		t.Errorf("Unexpected stored value %q", value)
+	}
+
+	got, err := c.MGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["missing"]; len(got) != 1500 || ok || got["key-7"] != "7" {
+		t.Errorf("Unexpected values of %d keys", len(got))
+	}
+	if srv.Requests() != 4 {
+		t.Errorf("Expected 2 requests of each call, got %d", srv.Requests())
+	}
+}
@@ -0,0 +1,111 @@
+package dbclient
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// maxBackoff limits the delay before a retry.
+const maxBackoff = 5 * time.Second
+
+type options struct {
+	poolSize    int
+	timeout     time.Duration
+	dialTimeout time.Duration
+	retries     int
+	backoff     time.Duration
+	httpClient  *http.Client
+	token       string
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		poolSize:    4,
+		timeout:     5 * time.Second,
+		dialTimeout: 2 * time.Second,
+		retries:     3,
+		backoff:     50 * time.Millisecond,
+		httpClient:  http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Option configures a Client or an HTTPClient.
+type Option func(*options)
+
+// WithPoolSize sets the number of the connections of a Client, 4 by
+// default.
+func WithPoolSize(n int) Option {
+	return func(o *options) {
+		o.poolSize = max(n, 1)
+	}
+}
+
+// WithTimeout limits every attempt of a request, 5 seconds by default.
+// The deadline of the context of the request applies as well.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithDialTimeout limits opening a connection of a Client, 2 seconds by
+// default.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithRetries sets the number of the retries of the requests failing with
+// ErrUnavailable and the base delay before them. The delay doubles with
+// every retry and is randomized, so that the clients failed at once do not
+// retry at once. The default is 3 retries with the base delay of 50ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.retries, o.backoff = max(n, 0), backoff
+	}
+}
+
+// WithHTTPClient sets the client sending the requests of an HTTPClient,
+// http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithToken sets the bearer token sent by an HTTPClient to the service
+// checking the tokens.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// wait sleeps before the retry following the attempt, a random delay
+// between the half and the whole of the doubled base delay.
+func (o options) wait(ctx context.Context, attempt int) error {
+	if o.backoff <= 0 {
+		return ctx.Err()
+	}
+	delay := o.backoff << min(attempt, 20)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	half := int64(delay / 2)
+	delay = time.Duration(half + rand.Int64N(half+1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
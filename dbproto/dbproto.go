@@ -0,0 +1,228 @@
+// Package dbproto implements the binary protocol of the db service.
+//
+// Every message is a frame starting with its size as a big-endian uint32
+// not counting the size itself, followed by the ID of the request. The
+// responses carry the ID of their request, so that a connection multiplexes
+// any number of requests in flight and the responses may come in any order.
+//
+// A request frame is
+//
+//	size u32 | id u32 | op u8 | timeout ms u32 | bucket len u16 | bucket | key len u32 | key | value
+//
+// and a response frame is
+//
+//	size u32 | id u32 | status u8 | value or error message
+package dbproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxFrameSize limits the size of a frame.
+const MaxFrameSize = 64 << 20
+
+const (
+	requestHeaderSize  = 4 + 4 + 1 + 4 + 2 + 4
+	responseHeaderSize = 4 + 4 + 1
+)
+
+// Op is the operation of a request.
+type Op uint8
+
+// The operations. Ping is answered with StatusOK, Get with the value.
+const (
+	OpPing Op = iota
+	OpGet
+	OpPut
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPing:
+		return "PING"
+	case OpGet:
+		return "GET"
+	case OpPut:
+		return "PUT"
+	case OpDelete:
+		return "DELETE"
+	}
+	return fmt.Sprintf("Op(%d)", op)
+}
+
+// Status is the outcome of a request, the value of a response with other
+// status than StatusOK is the error message.
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	// StatusNotFound is returned for the missing keys.
+	StatusNotFound
+	// StatusInvalid is returned for the rejected requests: unknown
+	// operations and buckets, invalid or too large keys and values.
+	StatusInvalid
+	// StatusUnavailable is returned when the store is closing or the
+	// request timed out. The request may succeed when retried.
+	StatusUnavailable
+	// StatusNotLeader is returned for the writes to a follower.
+	StatusNotLeader
+	// StatusError is returned for the other failures.
+	StatusError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusNotFound:
+		return "NOT_FOUND"
+	case StatusInvalid:
+		return "INVALID"
+	case StatusUnavailable:
+		return "UNAVAILABLE"
+	case StatusNotLeader:
+		return "NOT_LEADER"
+	case StatusError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Status(%d)", s)
+}
+
+var (
+	// ErrFrameTooLarge is returned for the frames over MaxFrameSize.
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrMalformed is returned for the frames not following the format.
+	ErrMalformed = errors.New("malformed frame")
+)
+
+// Request asks to run the operation on the key of the bucket, the default
+// bucket has the empty name. A zero Timeout leaves the request without
+// a deadline.
+type Request struct {
+	ID      uint32
+	Op      Op
+	Timeout time.Duration
+	Bucket  string
+	Key     string
+	Value   string
+}
+
+// Response is the result of the request with the same ID.
+type Response struct {
+	ID     uint32
+	Status Status
+	Value  string
+}
+
+// WriteRequest writes the request frame with a single call to w.
+func WriteRequest(w io.Writer, req Request) error {
+	if len(req.Bucket) > 0xffff {
+		return fmt.Errorf("%w: bucket name is too long", ErrMalformed)
+	}
+	size := requestHeaderSize + len(req.Bucket) + len(req.Key) + len(req.Value)
+	if size-4 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	timeout := req.Timeout.Milliseconds()
+	if timeout < 0 || (timeout == 0 && req.Timeout > 0) {
+		timeout = 1
+	}
+	timeout = min(timeout, 0xffffffff)
+
+	frame := make([]byte, 0, size)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(size-4))
+	frame = binary.BigEndian.AppendUint32(frame, req.ID)
+	frame = append(frame, byte(req.Op))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(timeout))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(req.Bucket)))
+	frame = append(frame, req.Bucket...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(req.Key)))
+	frame = append(frame, req.Key...)
+	frame = append(frame, req.Value...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadRequest reads a request frame.
+func ReadRequest(r io.Reader) (Request, error) {
+	frame, err := readFrame(r, requestHeaderSize-4)
+	if err != nil {
+		return Request{}, err
+	}
+	req := Request{
+		ID:      binary.BigEndian.Uint32(frame),
+		Op:      Op(frame[4]),
+		Timeout: time.Duration(binary.BigEndian.Uint32(frame[5:])) * time.Millisecond,
+	}
+	frame = frame[9:]
+	bucketLen := int(binary.BigEndian.Uint16(frame))
+	frame = frame[2:]
+	if len(frame) < bucketLen+4 {
+		return req, fmt.Errorf("%w: bucket name overflows the frame", ErrMalformed)
+	}
+	req.Bucket, frame = string(frame[:bucketLen]), frame[bucketLen:]
+	keyLen := int(binary.BigEndian.Uint32(frame))
+	frame = frame[4:]
+	if len(frame) < keyLen {
+		return req, fmt.Errorf("%w: key overflows the frame", ErrMalformed)
+	}
+	req.Key, req.Value = string(frame[:keyLen]), string(frame[keyLen:])
+	return req, nil
+}
+
+// WriteResponse writes the response frame with a single call to w.
+func WriteResponse(w io.Writer, resp Response) error {
+	size := responseHeaderSize + len(resp.Value)
+	if size-4 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 0, size)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(size-4))
+	frame = binary.BigEndian.AppendUint32(frame, resp.ID)
+	frame = append(frame, byte(resp.Status))
+	frame = append(frame, resp.Value...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadResponse reads a response frame.
+func ReadResponse(r io.Reader) (Response, error) {
+	frame, err := readFrame(r, responseHeaderSize-4)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{
+		ID:     binary.BigEndian.Uint32(frame),
+		Status: Status(frame[4]),
+		Value:  string(frame[5:]),
+	}, nil
+}
+
+// readFrame reads the frame following its size, it has at least minSize
+// bytes.
+func readFrame(r io.Reader, minSize int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	if int(size) < minSize {
+		return nil, fmt.Errorf("%w: frame of %d bytes is too short", ErrMalformed, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,76 @@
+package dbproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	requests := []Request{
+		{ID: 1, Op: OpPing},
+		{ID: 2, Op: OpGet, Key: "key"},
+		{ID: 3, Op: OpPut, Timeout: 1500 * time.Millisecond, Bucket: "team", Key: "k\x00ey", Value: "v\r\nalue"},
+		{ID: 4, Op: OpDelete, Timeout: time.Microsecond, Key: "key"},
+	}
+	for _, req := range requests {
+		if err := WriteRequest(&buf, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range requests {
+		req, err := ReadRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want.Timeout > 0 && want.Timeout < time.Millisecond {
+			// The timeouts are rounded up to a millisecond.
+			want.Timeout = time.Millisecond
+		}
+		if req != want {
+			t.Errorf("Expected %+v, got %+v", want, req)
+		}
+	}
+	if _, err := ReadRequest(&buf); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	response := Response{ID: 7, Status: StatusNotFound, Value: "missing"}
+	if err := WriteResponse(&buf, response); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ReadResponse(&buf); err != nil || resp != response {
+		t.Errorf("Expected %+v, got %+v, %v", response, resp, err)
+	}
+}
+
+func TestFrames_Malformed(t *testing.T) {
+	frame := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+	if _, err := ReadRequest(bytes.NewReader(frame)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	WriteRequest(&buf, Request{ID: 1, Op: OpGet, Key: "key"})
+	short := buf.Bytes()[:buf.Len()-1]
+	if _, err := ReadRequest(bytes.NewReader(short)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+
+	// The key length points past the end of the frame.
+	corrupted := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint32(corrupted[15:], 100)
+	if _, err := ReadRequest(bytes.NewReader(corrupted)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+
+	tooShort := binary.BigEndian.AppendUint32(nil, 2)
+	tooShort = append(tooShort, 0, 0)
+	if _, err := ReadResponse(bytes.NewReader(tooShort)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed for a short frame, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +10,9 @@ import (
 
 type Server interface {
 	Start()
+	// Shutdown stops the server without interrupting the requests in
+	// progress, see http.Server.Shutdown.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -19,10 +23,16 @@ func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
 		err := s.httpServer.ListenAndServe()
-		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		}
 	}()
 }
 
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// AddMember adds a node to the cluster, or changes the address of
+// a member, and waits until the change is committed. The node must be
+// started with no members of its own, it receives the whole log from the
+// leader.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	if m.ID == "" || m.Addr == "" {
+		return fmt.Errorf("member needs an ID and an address: %+v", m)
+	}
+	return n.changeMembers(ctx, func(members []Member) []Member {
+		members = slices.DeleteFunc(members, func(existing Member) bool {
+			return existing.ID == m.ID
+		})
+		return append(members, m)
+	})
+}
+
+// RemoveMember removes the node from the cluster and waits until the
+// change is committed. A leader removing itself steps down afterwards.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []Member) []Member {
+		return slices.DeleteFunc(members, func(existing Member) bool {
+			return existing.ID == id
+		})
+	})
+}
+
+// changeMembers appends the membership made by change to the log. Only one
+// change at a time is allowed, so that the majorities of the old and the
+// new membership always overlap.
+func (n *Node) changeMembers(ctx context.Context, change func([]Member) []Member) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if n.membersIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrMembershipChange
+	}
+	members := change(slices.Clone(n.members))
+	if len(members) == 0 {
+		n.mu.Unlock()
+		return fmt.Errorf("cannot remove the last member %s", n.id)
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	waiters, err := n.appendLeader([]Entry{{Kind: EntryMembers, Data: data}})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return n.wait(ctx, waiters)
+}
+
+// hasMembersEntry reports whether the log has a membership entry from the
+// index on. It must be called with n.mu held.
+func (n *Node) hasMembersEntry(from uint64) bool {
+	for index := from; index <= n.lastIndex(); index++ {
+		if n.entry(index).Kind == EntryMembers {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMembers takes the membership from the last membership entry of the
+// log. It must be called with n.mu held.
+func (n *Node) updateMembers() {
+	n.members, n.membersIndex = n.membersAt(n.lastIndex())
+}
+
+// membersAt returns the membership at the index and the index of the entry
+// defining it: the last membership entry up to the index, or the snapshot
+// with the membership of the entries it replaced, or no entry for the
+// bootstrap membership. It must be called with n.mu held.
+func (n *Node) membersAt(last uint64) ([]Member, uint64) {
+	for index := last; index > n.snapshot.Index; index-- {
+		e := n.entry(index)
+		if e.Kind != EntryMembers {
+			continue
+		}
+		var members []Member
+		if err := json.Unmarshal(e.Data, &members); err != nil {
+			log.Printf("Raft node %s skips the invalid membership entry %d: %s", n.id, index, err)
+			continue
+		}
+		return members, index
+	}
+	if n.snapshot.Index > 0 {
+		return slices.Clone(n.snapshot.Members), n.snapshot.Index
+	}
+	return slices.Clone(n.bootstrap), 0
+}
@@ -0,0 +1,785 @@
+// Package raft replicates a log of commands between the nodes of a cluster
+// with the Raft consensus algorithm. A command is applied to the state
+// machine of every node once a majority of the nodes persisted it.
+//
+// The log is kept in memory and on the disk. A node with a state machine
+// implementing Snapshotter replaces the applied entries of the log with the
+// state of the machine once there are SnapshotThreshold of them, and brings
+// the members missing the replaced entries up to date with a snapshot.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned by Propose and the membership changes on the
+	// nodes that are not the leader, see Node.Leader.
+	ErrNotLeader = errors.New("node is not the leader")
+	// ErrLeadershipLost is returned by Propose when the proposed entry was
+	// replaced by the entry of another leader and will never be applied.
+	ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+	// ErrStopped is returned by the operations of a stopped node.
+	ErrStopped = errors.New("node is stopped")
+	// ErrMembershipChange is returned for a membership change requested while
+	// the previous one is not committed yet.
+	ErrMembershipChange = errors.New("membership change in progress")
+)
+
+// Defaults of a node, see Config.
+const (
+	DefaultElectionTimeout   = 500 * time.Millisecond
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 10000
+	// maxAppendEntries limits the entries sent in one AppendEntries request.
+	maxAppendEntries = 256
+	// snapshotTimeout limits the time of sending a snapshot to a member.
+	snapshotTimeout = 5 * time.Minute
+)
+
+// Member is a node of the cluster, Addr is its address for the Transport.
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// Config configures a Node.
+type Config struct {
+	// ID identifies the node in the cluster.
+	ID string
+	// Dir keeps the persistent state of the node.
+	Dir string
+	// Members is the initial membership of the cluster. It is the same on
+	// all the nodes bootstrapping the cluster and empty on the nodes joining
+	// it later with AddMember. The membership changes in the log override it.
+	Members   []Member
+	Transport Transport
+	// ElectionTimeout is the minimum time without hearing from the leader
+	// before a follower starts an election, the actual one is randomized
+	// up to twice as long. HeartbeatInterval is the period of the empty
+	// AppendEntries requests of the leader.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is the number of the applied entries kept in the
+	// log before they are replaced by the state of the machine. It applies
+	// to the state machines implementing Snapshotter only, the log of the
+	// others is kept in full.
+	SnapshotThreshold uint64
+}
+
+// StateMachine receives the committed commands in the log order. Apply must
+// be deterministic: the same commands applied in the same order must bring
+// every node to the same state and fail the same way.
+type StateMachine interface {
+	// Apply applies the command at the index, the error is returned to the
+	// proposer.
+	Apply(index uint64, command []byte) error
+	// Applied returns the index of the last applied command. The commands
+	// following it are applied again after a restart.
+	Applied() uint64
+}
+
+// Snapshotter is implemented by the state machines keeping their state on
+// the disk. It lets the node drop the applied entries from its log.
+type Snapshotter interface {
+	// Sync makes the state of the applied commands durable. The entries up
+	// to the last applied one are removed from the log afterwards.
+	Sync() error
+	// WriteSnapshot writes the state of the applied commands to w and
+	// returns the index of the last command it includes.
+	WriteSnapshot(w io.Writer) (uint64, error)
+	// RestoreSnapshot replaces the state with the one written by
+	// WriteSnapshot of another node and makes it durable.
+	RestoreSnapshot(r io.Reader) error
+}
+
+// Role is the role of a node in its current term.
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// EntryKind tells the commands from the entries used by Raft itself.
+type EntryKind byte
+
+const (
+	// EntryCommand carries a command for the state machine.
+	EntryCommand EntryKind = iota
+	// EntryNoop is appended by every new leader to commit the entries of
+	// the previous terms.
+	EntryNoop
+	// EntryMembers carries the JSON list of the members of the cluster. It
+	// takes effect as soon as it is appended to the log.
+	EntryMembers
+)
+
+// Entry is an entry of the replicated log.
+type Entry struct {
+	Term uint64    `json:"term"`
+	Kind EntryKind `json:"kind"`
+	Data []byte    `json:"data,omitempty"`
+}
+
+// Status describes the state of a node.
+type Status struct {
+	ID            string   `json:"id"`
+	Role          Role     `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader,omitempty"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+	LastIndex     uint64   `json:"last_index"`
+	CommitIndex   uint64   `json:"commit_index"`
+	AppliedIndex  uint64   `json:"applied_index"`
+	Members       []Member `json:"members"`
+}
+
+// waiter is a proposer waiting for its entry to be applied.
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a member of a Raft cluster.
+type Node struct {
+	id        string
+	transport Transport
+	election  time.Duration
+	heartbeat time.Duration
+	storage   *storage
+	bootstrap []Member
+	sm        StateMachine
+	threshold uint64
+	// applyMu makes the commands applied to the state machine and the
+	// snapshots restored into it take turns.
+	applyMu sync.Mutex
+
+	// mu guards all the state below.
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	// snapshot describes the entries replaced by the state of the machine,
+	// log holds the ones following it.
+	snapshot    snapshotMeta
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	role        Role
+	leader      Member
+	// lastContact is the time the node last heard from the leader, the
+	// election starts at deadline.
+	lastContact time.Time
+	deadline    time.Time
+	// restoring is set while a snapshot of the leader is restored, the node
+	// does not start elections meanwhile.
+	restoring bool
+	// members is the membership defined by the entry at membersIndex, or
+	// by the snapshot or the bootstrap one for the snapshot index.
+	members      []Member
+	membersIndex uint64
+	// The replication state of the leader: the next entry to send and the
+	// last one known to be persisted by every peer, and the channels waking
+	// up and stopping the replication to the peers.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicators map[string]replicator
+	waiters     map[uint64]waiter
+
+	applyNeeded chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	routines    sync.WaitGroup
+}
+
+// NewNode opens the persistent state of the node in cfg.Dir. The node takes
+// part in the cluster once it is started.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft node ID is empty")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	s, state, snapshot, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:          cfg.ID,
+		transport:   cfg.Transport,
+		election:    cfg.ElectionTimeout,
+		heartbeat:   cfg.HeartbeatInterval,
+		storage:     s,
+		bootstrap:   cfg.Members,
+		threshold:   cfg.SnapshotThreshold,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		snapshot:    snapshot,
+		log:         entries,
+		role:        Follower,
+		waiters:     make(map[uint64]waiter),
+		applyNeeded: make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+	}
+	n.updateMembers()
+	return n, nil
+}
+
+// Start applies the committed commands to sm and starts taking part in the
+// elections. The state of sm includes the entries replaced by the snapshot,
+// even if the last of them are not commands.
+func (n *Node) Start(sm StateMachine) {
+	n.mu.Lock()
+	n.sm = sm
+	n.lastApplied = max(sm.Applied(), n.snapshot.Index)
+	n.commitIndex = n.lastApplied
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	n.routines.Add(2)
+	go n.runTimer()
+	go n.runApply()
+}
+
+// Stop stops the node and closes its files. The pending proposals fail
+// with ErrStopped.
+func (n *Node) Stop() error {
+	n.stopOnce.Do(func() {
+		n.mu.Lock()
+		close(n.stopped)
+		n.stopReplication()
+		n.mu.Unlock()
+	})
+	n.routines.Wait()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.storage.close()
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader.ID,
+		SnapshotIndex: n.snapshot.Index,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		Members:       append([]Member(nil), n.members...),
+	}
+}
+
+// Leader returns the leader known to the node, if any.
+func (n *Node) Leader() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader, n.leader.ID != ""
+}
+
+// IsLeader reports whether the node is the leader of its term.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == Leader
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+// entry returns the entry at the index following the snapshot.
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.snapshot.Index-1]
+}
+
+// termAt returns the term of the entry at the index, 0 for the index 0 and
+// the ones replaced by the snapshot except its last one.
+func (n *Node) termAt(index uint64) uint64 {
+	if index <= n.snapshot.Index {
+		if index == n.snapshot.Index {
+			return n.snapshot.Term
+		}
+		return 0
+	}
+	return n.entry(index).Term
+}
+
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(n.election + time.Duration(rand.Int63n(int64(n.election))))
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) member(id string) Member {
+	for _, m := range n.members {
+		if m.ID == id {
+			return m
+		}
+	}
+	return Member{ID: id}
+}
+
+// quorum is the number of the members making a majority.
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+// setTerm moves the node to a newer term as a follower without a vote.
+func (n *Node) setTerm(term uint64) error {
+	if term > n.term {
+		if err := n.storage.saveState(hardState{Term: term}); err != nil {
+			return err
+		}
+		n.term, n.votedFor = term, ""
+		n.leader = Member{}
+	}
+	if n.role != Follower {
+		n.role = Follower
+		n.stopReplication()
+	}
+	return nil
+}
+
+// runTimer starts an election once the deadline passes without hearing from
+// the leader. The nodes outside the membership never start one.
+func (n *Node) runTimer() {
+	defer n.routines.Done()
+	ticker := time.NewTicker(n.election / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.role != Leader && !n.restoring && time.Now().After(n.deadline) && n.isMember(n.id) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection votes for the node in the next term and asks the other
+// members for their votes. It must be called with n.mu held.
+func (n *Node) startElection() {
+	term := n.term + 1
+	if err := n.storage.saveState(hardState{Term: term, VotedFor: n.id}); err != nil {
+		log.Printf("Raft node %s failed to start an election: %s", n.id, err)
+		n.resetDeadline()
+		return
+	}
+	n.term, n.votedFor, n.role, n.leader = term, n.id, Candidate, Member{}
+	n.resetDeadline()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	req := VoteRequest{
+		Term:      term,
+		Candidate: n.id,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.termAt(n.lastIndex()),
+	}
+	for _, peer := range n.members {
+		if peer.ID == n.id {
+			continue
+		}
+		go func(peer Member) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.election)
+			defer cancel()
+			resp, err := n.transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.setTerm(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader starts replicating to the followers, beginning with an empty
+// entry of the new term. It must be called with n.mu held.
+func (n *Node) becomeLeader() {
+	select {
+	case <-n.stopped:
+		return
+	default:
+	}
+	n.role = Leader
+	n.leader = n.member(n.id)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.replicators = make(map[string]replicator)
+	log.Printf("Raft node %s is the leader of term %d", n.id, n.term)
+	if _, err := n.appendLocal([]Entry{{Term: n.term, Kind: EntryNoop}}); err != nil {
+		log.Printf("Raft node %s failed to append to its log: %s", n.id, err)
+		n.setTerm(n.term)
+		return
+	}
+	n.updateReplication()
+	n.advanceCommit()
+}
+
+// VoteRequest is the RequestVote RPC of a candidate.
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// VoteResponse is the reply to a VoteRequest.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// RequestVote handles the vote request of a candidate. A follower keeps
+// supporting a leader it heard from within the election timeout, so that
+// the nodes cut off from the cluster or removed from it do not disrupt it.
+// A leader steps down for a candidate of a later term.
+func (n *Node) RequestVote(req VoteRequest) (VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader && n.leader.ID != "" && time.Since(n.lastContact) < n.election {
+		return VoteResponse{Term: n.term}, nil
+	}
+	if req.Term < n.term || (req.Term == n.term && n.role == Leader) {
+		return VoteResponse{Term: n.term}, nil
+	}
+	if err := n.setTerm(req.Term); err != nil {
+		return VoteResponse{}, err
+	}
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= n.lastIndex())
+	if !upToDate || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return VoteResponse{Term: n.term}, nil
+	}
+	if err := n.storage.saveState(hardState{Term: n.term, VotedFor: req.Candidate}); err != nil {
+		return VoteResponse{}, err
+	}
+	n.votedFor = req.Candidate
+	n.resetDeadline()
+	return VoteResponse{Term: n.term, Granted: true}, nil
+}
+
+// AppendRequest is the AppendEntries RPC of the leader.
+type AppendRequest struct {
+	Term        uint64  `json:"term"`
+	Leader      Member  `json:"leader"`
+	PrevIndex   uint64  `json:"prev_index"`
+	PrevTerm    uint64  `json:"prev_term"`
+	Entries     []Entry `json:"entries,omitempty"`
+	CommitIndex uint64  `json:"commit_index"`
+}
+
+// AppendResponse is the reply to an AppendRequest. A follower missing the
+// entry at PrevIndex sets ConflictIndex to the first index the leader
+// should send from.
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// AppendEntries handles the entries replicated by the leader. The entries
+// are persisted before the node replies.
+func (n *Node) AppendEntries(req AppendRequest) (AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}, nil
+	}
+	if err := n.setTerm(req.Term); err != nil {
+		return AppendResponse{}, err
+	}
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+	n.resetDeadline()
+
+	if req.PrevIndex < n.snapshot.Index {
+		// The entries up to the snapshot are committed, so they match.
+		skip := min(n.snapshot.Index-req.PrevIndex, uint64(len(req.Entries)))
+		req.Entries = req.Entries[skip:]
+		req.PrevIndex += skip
+		if req.PrevIndex < n.snapshot.Index {
+			return AppendResponse{Term: n.term, Success: true}, nil
+		}
+		req.PrevTerm = n.snapshot.Term
+	}
+	if req.PrevIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}, nil
+	}
+	if term := n.termAt(req.PrevIndex); term != req.PrevTerm {
+		// Skip the whole conflicting term at once.
+		conflict := req.PrevIndex
+		for conflict > n.commitIndex+1 && n.termAt(conflict-1) == term {
+			conflict--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: conflict}, nil
+	}
+
+	entries := req.Entries
+	for i, e := range req.Entries {
+		index := req.PrevIndex + 1 + uint64(i)
+		if index > n.lastIndex() {
+			break
+		}
+		if n.termAt(index) == e.Term {
+			entries = req.Entries[i+1:]
+			continue
+		}
+		if index <= n.commitIndex {
+			return AppendResponse{}, fmt.Errorf("leader %s replaces the committed entry %d", req.Leader.ID, index)
+		}
+		if err := n.storage.truncate(index); err != nil {
+			return AppendResponse{}, err
+		}
+		n.log = n.log[:index-n.snapshot.Index-1]
+		n.updateMembers()
+		break
+	}
+	if len(entries) > 0 {
+		if err := n.storage.append(entries); err != nil {
+			return AppendResponse{}, err
+		}
+		first := n.lastIndex() + 1
+		n.log = append(n.log, entries...)
+		if n.hasMembersEntry(first) {
+			n.updateMembers()
+		}
+	}
+
+	lastNew := req.PrevIndex + uint64(len(req.Entries))
+	if commit := min(req.CommitIndex, lastNew); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.notifyApply()
+	}
+	return AppendResponse{Term: n.term, Success: true}, nil
+}
+
+// SnapshotRequest is the InstallSnapshot RPC of the leader sending its
+// state to a member missing the entries replaced by the snapshot. Index
+// and Term are the ones of the last entry the state includes and Members
+// is the membership at that entry.
+type SnapshotRequest struct {
+	Term    uint64   `json:"term"`
+	Leader  Member   `json:"leader"`
+	Index   uint64   `json:"index"`
+	Last    uint64   `json:"last_term"`
+	Members []Member `json:"members"`
+}
+
+// SnapshotResponse is the reply to a SnapshotRequest.
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// InstallSnapshot replaces the state of the machine with the snapshot of
+// the leader read from data. The entries of the log following the snapshot
+// are kept if the log has its last entry, the log is dropped otherwise.
+func (n *Node) InstallSnapshot(req SnapshotRequest, data io.Reader) (SnapshotResponse, error) {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	if err := n.setTerm(req.Term); err != nil {
+		n.mu.Unlock()
+		return SnapshotResponse{}, err
+	}
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+	n.resetDeadline()
+	snapshotter, ok := n.sm.(Snapshotter)
+	if req.Index <= n.commitIndex || n.restoring || !ok {
+		defer n.mu.Unlock()
+		if !ok {
+			return SnapshotResponse{}, errors.New("state machine cannot restore snapshots")
+		}
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	n.restoring = true
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	err := snapshotter.RestoreSnapshot(data)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.restoring = false
+	n.lastContact = time.Now()
+	n.resetDeadline()
+	if err != nil {
+		return SnapshotResponse{}, err
+	}
+	var rest []Entry
+	if req.Index > n.snapshot.Index && req.Index < n.lastIndex() && n.termAt(req.Index) == req.Last {
+		rest = n.log[req.Index-n.snapshot.Index:]
+	}
+	if err := n.replaceLog(snapshotMeta{Index: req.Index, Term: req.Last, Members: req.Members}, rest); err != nil {
+		return SnapshotResponse{}, err
+	}
+	for index, w := range n.waiters {
+		if index <= req.Index {
+			delete(n.waiters, index)
+			w.done <- ErrLeadershipLost
+		}
+	}
+	n.commitIndex = max(n.commitIndex, req.Index)
+	n.lastApplied = req.Index
+	log.Printf("Raft node %s restored the snapshot of %s at %d", n.id, req.Leader.ID, req.Index)
+	return SnapshotResponse{Term: n.term}, nil
+}
+
+// replaceLog persists the snapshot followed by the entries as the log. It
+// must be called with n.mu held.
+func (n *Node) replaceLog(snapshot snapshotMeta, entries []Entry) error {
+	if err := n.storage.compact(snapshot, entries); err != nil {
+		return err
+	}
+	n.snapshot, n.log = snapshot, slices.Clone(entries)
+	n.updateMembers()
+	return nil
+}
+
+// compactLog replaces the applied entries with the state of the machine
+// once there are at least the snapshot threshold of them. The state is
+// synced first, so that the machine never needs the dropped entries again.
+func (n *Node) compactLog() {
+	snapshotter, ok := n.sm.(Snapshotter)
+	if !ok {
+		return
+	}
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	index := n.lastApplied
+	due := index >= n.snapshot.Index+n.threshold
+	n.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := snapshotter.Sync(); err != nil {
+		log.Printf("Raft node %s failed to sync the state before compacting the log: %s", n.id, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members, _ := n.membersAt(index)
+	snapshot := snapshotMeta{Index: index, Term: n.termAt(index), Members: members}
+	if err := n.replaceLog(snapshot, n.log[index-n.snapshot.Index:]); err != nil {
+		log.Printf("Raft node %s failed to compact the log: %s", n.id, err)
+	}
+}
+
+// sendSnapshot sends the state of the machine to the peer missing the
+// entries replaced by the snapshot. It reports whether the peer has it.
+func (n *Node) sendSnapshot(term uint64, peer Member) bool {
+	snapshotter, ok := n.sm.(Snapshotter)
+	if !ok {
+		return false
+	}
+	file, err := os.CreateTemp(n.storage.dir, "snapshot-*")
+	if err != nil {
+		log.Printf("Raft node %s failed to write a snapshot: %s", n.id, err)
+		return false
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	n.mu.Lock()
+	base := n.snapshot.Index
+	n.mu.Unlock()
+	index, err := snapshotter.WriteSnapshot(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Raft node %s failed to write a snapshot: %s", n.id, err)
+		return false
+	}
+	// The state includes every entry up to the snapshot of the log, the
+	// last of those may be not commands.
+	index = max(index, base)
+
+	n.mu.Lock()
+	if n.role != Leader || n.term != term || index < n.snapshot.Index {
+		n.mu.Unlock()
+		return false
+	}
+	members, _ := n.membersAt(index)
+	req := SnapshotRequest{
+		Term:    term,
+		Leader:  n.leader,
+		Index:   index,
+		Last:    n.termAt(index),
+		Members: members,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	resp, err := n.transport.InstallSnapshot(ctx, peer, req, file)
+	if err != nil {
+		log.Printf("Raft node %s failed to send a snapshot to %s: %s", n.id, peer.ID, err)
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.setTerm(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.term != term {
+		return false
+	}
+	n.matchIndex[peer.ID] = max(n.matchIndex[peer.ID], index)
+	n.nextIndex[peer.ID] = max(n.nextIndex[peer.ID], index+1)
+	n.advanceCommit()
+	return true
+}
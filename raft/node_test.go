@@ -0,0 +1,537 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network delivers the RPCs between the nodes of a test cluster in-process
+// and drops the ones crossing a partition.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	// group assigns the nodes to partitions, the nodes of different groups
+	// cannot reach each other.
+	group map[string]int
+}
+
+type networkTransport struct {
+	net  *network
+	from string
+}
+
+var errUnreachable = errors.New("member is unreachable")
+
+func (net *network) reach(from, to string) (*Node, error) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	node, ok := net.nodes[to]
+	if !ok || net.group[from] != net.group[to] {
+		return nil, errUnreachable
+	}
+	return node, nil
+}
+
+func (t networkTransport) RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error) {
+	node, err := t.net.reach(t.from, to.ID)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+	return node.RequestVote(req)
+}
+
+func (t networkTransport) AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error) {
+	node, err := t.net.reach(t.from, to.ID)
+	if err != nil {
+		return AppendResponse{}, err
+	}
+	return node.AppendEntries(req)
+}
+
+func (t networkTransport) InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest, data io.Reader) (SnapshotResponse, error) {
+	node, err := t.net.reach(t.from, to.ID)
+	if err != nil {
+		return SnapshotResponse{}, err
+	}
+	return node.InstallSnapshot(req, data)
+}
+
+// machine records the applied commands.
+type machine struct {
+	mu       sync.Mutex
+	commands []string
+	applied  uint64
+}
+
+func (m *machine) Apply(index uint64, command []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = index
+	if string(command) == "fail" {
+		return errors.New("rejected command")
+	}
+	m.commands = append(m.commands, string(command))
+	return nil
+}
+
+func (m *machine) Applied() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.applied
+}
+
+func (m *machine) state() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.commands)
+}
+
+// snapshotMachine is a machine with the snapshots of its commands. Its
+// state is kept in memory across the restarts of the node.
+type snapshotMachine struct {
+	machine
+	syncs int
+}
+
+type machineSnapshot struct {
+	Commands []string `json:"commands"`
+	Applied  uint64   `json:"applied"`
+}
+
+func (m *snapshotMachine) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncs++
+	return nil
+}
+
+func (m *snapshotMachine) WriteSnapshot(w io.Writer) (uint64, error) {
+	m.mu.Lock()
+	snapshot := machineSnapshot{slices.Clone(m.commands), m.applied}
+	m.mu.Unlock()
+	return snapshot.Applied, json.NewEncoder(w).Encode(snapshot)
+}
+
+func (m *snapshotMachine) RestoreSnapshot(r io.Reader) error {
+	var snapshot machineSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands, m.applied = snapshot.Commands, snapshot.Applied
+	return nil
+}
+
+// stateMachine is the state of a test node.
+type stateMachine interface {
+	StateMachine
+	state() []string
+}
+
+type cluster struct {
+	t        *testing.T
+	dir      string
+	net      *network
+	machines map[string]stateMachine
+	// threshold, if set, makes the nodes compact their logs with the
+	// snapshots of their machines.
+	threshold uint64
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	return newSnapshotCluster(t, size, 0)
+}
+
+// newSnapshotCluster starts a cluster compacting the logs once there are
+// threshold applied entries, a zero threshold disables the snapshots.
+func newSnapshotCluster(t *testing.T, size int, threshold uint64) *cluster {
+	c := &cluster{
+		t:         t,
+		dir:       t.TempDir(),
+		net:       &network{nodes: make(map[string]*Node), group: make(map[string]int)},
+		machines:  make(map[string]stateMachine),
+		threshold: threshold,
+	}
+	var members []Member
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		members = append(members, Member{ID: id, Addr: id})
+	}
+	for _, m := range members {
+		c.start(m.ID, members)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids() {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start runs the node with the state kept in the directory of its ID.
+func (c *cluster) start(id string, members []Member) *Node {
+	c.t.Helper()
+	n, err := NewNode(Config{
+		ID:                id,
+		Dir:               filepath.Join(c.dir, id),
+		Members:           members,
+		Transport:         networkTransport{c.net, id},
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.machines[id] == nil {
+		if c.threshold > 0 {
+			c.machines[id] = &snapshotMachine{}
+		} else {
+			c.machines[id] = &machine{}
+		}
+	}
+	n.Start(c.machines[id])
+	c.net.mu.Lock()
+	c.net.nodes[id] = n
+	c.net.mu.Unlock()
+	return n
+}
+
+func (c *cluster) stop(id string) {
+	c.net.mu.Lock()
+	n := c.net.nodes[id]
+	delete(c.net.nodes, id)
+	c.net.mu.Unlock()
+	if n != nil {
+		n.Stop()
+	}
+}
+
+func (c *cluster) ids() []string {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	var ids []string
+	for id := range c.net.nodes {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (c *cluster) node(id string) *Node {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	return c.net.nodes[id]
+}
+
+// partition puts the nodes into a group cut off from the rest.
+func (c *cluster) partition(group int, ids ...string) {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	for _, id := range ids {
+		c.net.group[id] = group
+	}
+}
+
+func (c *cluster) heal() {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	clear(c.net.group)
+}
+
+// leader waits for a single leader among the nodes of the IDs.
+func (c *cluster) leader(ids ...string) *Node {
+	c.t.Helper()
+	var leader *Node
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		for _, id := range ids {
+			if n := c.node(id); n.IsLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = n
+			}
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+// converge waits for the machines of the IDs to hold the commands.
+func (c *cluster) converge(commands []string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		waitFor(c.t, id+" to apply "+fmt.Sprint(commands), func() bool {
+			return slices.Equal(c.machines[id].state(), commands)
+		})
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func propose(n *Node, command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return n.Propose(ctx, []byte(command))
+}
+
+func TestNode_Replication(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader("n1", "n2", "n3")
+	if err := propose(leader, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Propose(context.Background(), []byte("b"), []byte("fail"), []byte("c")); err == nil {
+		t.Error("Expected the error of the failed command")
+	}
+	c.converge([]string{"a", "b", "c"}, "n1", "n2", "n3")
+
+	for _, id := range []string{"n1", "n2", "n3"} {
+		if n := c.node(id); n != leader {
+			if err := propose(n, "x"); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("Expected ErrNotLeader from %s, got %v", id, err)
+			}
+			if l, ok := n.Leader(); !ok || l.ID != leader.id {
+				t.Errorf("%s does not know the leader: %+v", id, l)
+			}
+		}
+	}
+}
+
+func TestNode_Partition(t *testing.T) {
+	c := newCluster(t, 3)
+	oldLeader := c.leader("n1", "n2", "n3")
+	if err := propose(oldLeader, "a"); err != nil {
+		t.Fatal(err)
+	}
+	var rest []string
+	for _, id := range c.ids() {
+		if id != oldLeader.id {
+			rest = append(rest, id)
+		}
+	}
+
+	// The leader cut off from the majority cannot commit.
+	c.partition(1, oldLeader.id)
+	lost := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		lost <- oldLeader.Propose(ctx, []byte("lost"))
+	}()
+	newLeader := c.leader(rest...)
+	if err := propose(newLeader, "b"); err != nil {
+		t.Fatal(err)
+	}
+	c.converge([]string{"a", "b"}, rest...)
+	if got := c.machines[oldLeader.id].state(); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Partitioned leader applied %v", got)
+	}
+
+	// After healing, the old leader drops its uncommitted entry.
+	c.heal()
+	if err := <-lost; !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("Expected ErrLeadershipLost, got %v", err)
+	}
+	if err := propose(c.leader(c.ids()...), "c"); err != nil {
+		t.Fatal(err)
+	}
+	c.converge([]string{"a", "b", "c"}, c.ids()...)
+}
+
+func TestNode_NoQuorum(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader("n1", "n2", "n3")
+	for _, id := range c.ids() {
+		if id != leader.id {
+			c.partition(1, id)
+			break
+		}
+	}
+	// One follower is enough for the majority.
+	if err := propose(leader, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.ids() {
+		c.partition(2, id)
+	}
+	c.partition(3, leader.id)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := leader.Propose(ctx, []byte("b")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the proposal without a majority to time out, got %v", err)
+	}
+	if status := leader.Status(); status.CommitIndex >= status.LastIndex {
+		t.Errorf("Expected the entry to stay uncommitted, got %+v", status)
+	}
+}
+
+func TestNode_Restart(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader("n1", "n2", "n3")
+	for _, command := range []string{"a", "b"} {
+		if err := propose(leader, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.converge([]string{"a", "b"}, c.ids()...)
+	term := leader.Status().Term
+
+	members := leader.Status().Members
+	for _, id := range c.ids() {
+		c.stop(id)
+	}
+	for _, m := range members {
+		c.start(m.ID, members)
+	}
+	leader = c.leader(c.ids()...)
+	if status := leader.Status(); status.Term <= term || status.LastIndex < 3 {
+		t.Errorf("Expected the term and the log to survive the restart, got %+v", status)
+	}
+	if err := propose(leader, "c"); err != nil {
+		t.Fatal(err)
+	}
+	// The machines kept their state, only the new command is applied.
+	c.converge([]string{"a", "b", "c"}, c.ids()...)
+}
+
+func TestNode_Membership(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader("n1", "n2", "n3")
+	if err := propose(leader, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.start("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := leader.AddMember(ctx, Member{ID: "n4", Addr: "n4"}); err != nil {
+		t.Fatal(err)
+	}
+	c.converge([]string{"a"}, "n4")
+	if members := c.node("n4").Status().Members; len(members) != 4 {
+		t.Errorf("Expected the new node to learn the membership, got %v", members)
+	}
+
+	// The leader removes itself and the remaining nodes elect a new one.
+	if err := leader.RemoveMember(ctx, leader.id); err != nil {
+		t.Fatal(err)
+	}
+	var rest []string
+	for _, id := range c.ids() {
+		if id != leader.id {
+			rest = append(rest, id)
+		}
+	}
+	newLeader := c.leader(rest...)
+	if newLeader == leader {
+		t.Fatal("Removed leader kept leading")
+	}
+	c.stop(leader.id)
+	if err := propose(newLeader, "b"); err != nil {
+		t.Fatal(err)
+	}
+	c.converge([]string{"a", "b"}, rest...)
+	if err := newLeader.AddMember(ctx, Member{ID: "", Addr: "x"}); err == nil {
+		t.Error("Expected a member without an ID to be rejected")
+	}
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	c := newSnapshotCluster(t, 3, 5)
+	leader := c.leader("n1", "n2", "n3")
+	var lagging string
+	for _, id := range c.ids() {
+		if id != leader.id {
+			lagging = id
+			c.partition(1, id)
+			break
+		}
+	}
+
+	var commands []string
+	for i := 0; i < 20; i++ {
+		commands = append(commands, fmt.Sprint(i))
+		if err := propose(leader, commands[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the leader to compact its log", func() bool {
+		return leader.Status().SnapshotIndex >= 15
+	})
+	if status := leader.Status(); status.LastIndex-status.SnapshotIndex >= 10 {
+		t.Errorf("Expected the applied entries dropped from the log, got %+v", status)
+	}
+
+	// The lagging follower and a new member get the snapshot.
+	c.heal()
+	c.start("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := leader.AddMember(ctx, Member{ID: "n4", Addr: "n4"}); err != nil {
+		t.Fatal(err)
+	}
+	c.converge(commands, lagging, "n4")
+	if status := c.node("n4").Status(); status.SnapshotIndex == 0 || len(status.Members) != 4 {
+		t.Errorf("Expected n4 to start from a snapshot with the members, got %+v", status)
+	}
+
+	// The compacted logs survive the restart.
+	members := leader.Status().Members
+	for _, id := range c.ids() {
+		c.stop(id)
+	}
+	for _, m := range members {
+		c.start(m.ID, nil)
+	}
+	leader = c.leader(c.ids()...)
+	commands = append(commands, "last")
+	if err := propose(leader, "last"); err != nil {
+		t.Fatal(err)
+	}
+	c.converge(commands, c.ids()...)
+}
+
+func TestNode_RequestVote(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader("n1", "n2", "n3")
+	if err := propose(leader, "a"); err != nil {
+		t.Fatal(err)
+	}
+	term := leader.Status().Term
+
+	if resp, err := leader.RequestVote(VoteRequest{Term: term, Candidate: "x", LastIndex: 100, LastTerm: term}); err != nil || resp.Granted {
+		t.Errorf("Expected the leader to refuse a vote in its term, got %+v, %v", resp, err)
+	}
+	// A candidate of a later term makes the leader step down even without
+	// getting the vote for an outdated log.
+	resp, err := leader.RequestVote(VoteRequest{Term: term + 1, Candidate: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Granted || resp.Term != term+1 {
+		t.Errorf("Expected the vote refused in the term %d, got %+v", term+1, resp)
+	}
+	if status := leader.Status(); status.Role == Leader && status.Term == term {
+		t.Errorf("Expected the leader to step down, got %+v", status)
+	}
+}
@@ -0,0 +1,302 @@
+package raft
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// replicator sends the log of the leader to a peer, notify wakes it up for
+// new entries and stop ends it.
+type replicator struct {
+	notify chan struct{}
+	stop   chan struct{}
+}
+
+// Propose appends the commands to the log and waits until they are
+// committed and applied on this node. It returns the error of the first
+// failed command, ErrNotLeader if the node is not the leader and
+// ErrLeadershipLost if the commands were dropped by the next leader. The
+// commands may still be applied if ctx is done before.
+func (n *Node) Propose(ctx context.Context, commands ...[]byte) error {
+	entries := make([]Entry, len(commands))
+	for i, command := range commands {
+		entries[i] = Entry{Kind: EntryCommand, Data: command}
+	}
+	n.mu.Lock()
+	waiters, err := n.appendLeader(entries)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return n.wait(ctx, waiters)
+}
+
+// appendLeader appends the entries of the leader to its log and registers
+// a waiter for every one of them. It must be called with n.mu held.
+func (n *Node) appendLeader(entries []Entry) ([]waiter, error) {
+	select {
+	case <-n.stopped:
+		return nil, ErrStopped
+	default:
+	}
+	if n.role != Leader {
+		return nil, ErrNotLeader
+	}
+	for i := range entries {
+		entries[i].Term = n.term
+	}
+	first, err := n.appendLocal(entries)
+	if err != nil {
+		return nil, err
+	}
+	waiters := make([]waiter, len(entries))
+	for i := range entries {
+		waiters[i] = waiter{term: n.term, done: make(chan error, 1)}
+		n.waiters[first+uint64(i)] = waiters[i]
+	}
+	if n.hasMembersEntry(first) {
+		n.updateMembers()
+		n.updateReplication()
+	}
+	n.advanceCommit()
+	for _, r := range n.replicators {
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+	}
+	return waiters, nil
+}
+
+// wait returns the result of the first failed entry once all of them are
+// applied.
+func (n *Node) wait(ctx context.Context, waiters []waiter) error {
+	var result error
+	for _, w := range waiters {
+		select {
+		case err := <-w.done:
+			if result == nil {
+				result = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stopped:
+			return ErrStopped
+		}
+	}
+	return result
+}
+
+// appendLocal persists the entries at the end of the log and returns the
+// index of the first one. It must be called with n.mu held.
+func (n *Node) appendLocal(entries []Entry) (uint64, error) {
+	if err := n.storage.append(entries); err != nil {
+		return 0, err
+	}
+	first := n.lastIndex() + 1
+	n.log = append(n.log, entries...)
+	return first, nil
+}
+
+// updateReplication starts the replication to the new members and stops it
+// for the removed ones. It must be called with n.mu held by the leader.
+func (n *Node) updateReplication() {
+	for id, r := range n.replicators {
+		if !n.isMember(id) {
+			close(r.stop)
+			delete(n.replicators, id)
+		}
+	}
+	for _, peer := range n.members {
+		if _, ok := n.replicators[peer.ID]; ok || peer.ID == n.id {
+			continue
+		}
+		r := replicator{notify: make(chan struct{}, 1), stop: make(chan struct{})}
+		n.replicators[peer.ID] = r
+		n.nextIndex[peer.ID] = n.lastIndex() + 1
+		n.matchIndex[peer.ID] = 0
+		n.routines.Add(1)
+		go n.replicate(n.term, peer, r)
+	}
+}
+
+// stopReplication stops all the replicators of a former leader. It must be
+// called with n.mu held.
+func (n *Node) stopReplication() {
+	for id, r := range n.replicators {
+		close(r.stop)
+		delete(n.replicators, id)
+	}
+}
+
+// replicate sends the entries the peer is missing, or an empty request
+// every heartbeat interval, until the node stops being the leader of the
+// term or the peer is removed.
+func (n *Node) replicate(term uint64, peer Member, r replicator) {
+	defer n.routines.Done()
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		next := n.nextIndex[peer.ID]
+		if next <= n.snapshot.Index {
+			// The peer misses the entries replaced by the snapshot.
+			n.mu.Unlock()
+			if !n.sendSnapshot(term, peer) && !n.backoff(r) {
+				return
+			}
+			continue
+		}
+		last := min(n.lastIndex(), next-1+maxAppendEntries)
+		req := AppendRequest{
+			Term:        term,
+			Leader:      n.leader,
+			PrevIndex:   next - 1,
+			PrevTerm:    n.termAt(next - 1),
+			Entries:     slices.Clone(n.log[next-1-n.snapshot.Index : last-n.snapshot.Index]),
+			CommitIndex: n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.election)
+		resp, err := n.transport.AppendEntries(ctx, peer, req)
+		cancel()
+
+		more := false
+		if err == nil {
+			n.mu.Lock()
+			if resp.Term > n.term {
+				n.setTerm(resp.Term)
+			} else if n.role == Leader && n.term == term {
+				if resp.Success {
+					match := req.PrevIndex + uint64(len(req.Entries))
+					n.matchIndex[peer.ID] = max(n.matchIndex[peer.ID], match)
+					n.nextIndex[peer.ID] = max(n.nextIndex[peer.ID], match+1)
+					n.advanceCommit()
+				} else {
+					n.nextIndex[peer.ID] = max(1, min(resp.ConflictIndex, next-1))
+				}
+				more = n.nextIndex[peer.ID] <= n.lastIndex()
+			}
+			n.mu.Unlock()
+		}
+		if !more && !n.pause(r) {
+			return
+		}
+	}
+}
+
+// pause waits for new entries or the next heartbeat. It reports false if
+// the replication is stopped.
+func (n *Node) pause(r replicator) bool {
+	timer := time.NewTimer(n.heartbeat)
+	defer timer.Stop()
+	select {
+	case <-r.notify:
+	case <-timer.C:
+	case <-r.stop:
+		return false
+	case <-n.stopped:
+		return false
+	}
+	return true
+}
+
+// backoff waits an election timeout before another snapshot is written for
+// a member that failed to take the last one. The new entries do not end the
+// wait. It reports false if the replication is stopped.
+func (n *Node) backoff(r replicator) bool {
+	timer := time.NewTimer(n.election)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.stop:
+		return false
+	case <-n.stopped:
+		return false
+	}
+}
+
+// advanceCommit commits the entries of the current term persisted by
+// a majority of the members. A leader that is no longer a member steps down
+// once its removal is committed. It must be called with n.mu held.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 0
+		for _, m := range n.members {
+			if m.ID == n.id || n.matchIndex[m.ID] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.notifyApply()
+			break
+		}
+	}
+	if n.role == Leader && !n.isMember(n.id) && n.commitIndex >= n.membersIndex {
+		log.Printf("Raft node %s is removed from the cluster, stepping down", n.id)
+		n.setTerm(n.term)
+		n.leader = Member{}
+	}
+}
+
+func (n *Node) notifyApply() {
+	select {
+	case n.applyNeeded <- struct{}{}:
+	default:
+	}
+}
+
+// runApply applies the committed commands to the state machine and passes
+// the results to the proposers.
+func (n *Node) runApply() {
+	defer n.routines.Done()
+	for {
+		select {
+		case <-n.applyNeeded:
+		case <-n.stopped:
+			return
+		}
+		for n.applyNext() {
+		}
+		n.compactLog()
+	}
+}
+
+// applyNext applies the next committed command, it reports false if there
+// is none.
+func (n *Node) applyNext() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	index := n.lastApplied + 1
+	e := n.entry(index)
+	n.mu.Unlock()
+
+	var err error
+	if e.Kind == EntryCommand {
+		err = n.sm.Apply(index, e.Data)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied = index
+	if w, ok := n.waiters[index]; ok {
+		delete(n.waiters, index)
+		if w.term != e.Term {
+			err = ErrLeadershipLost
+		}
+		w.done <- err
+	}
+	return true
+}
@@ -0,0 +1,295 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Files of the persistent state in the directory of a node.
+const (
+	stateFileName = "raft-state.json"
+	logFileName   = "raft-log"
+)
+
+// snapshotRecord is the kind of the record starting a compacted log, its
+// data is the JSON of the snapshotMeta.
+const snapshotRecord EntryKind = 255
+
+// A log record is laid out as follows, all the integers are little endian:
+//
+//	size     uint32  size of the payload
+//	checksum uint32  CRC-32 (IEEE) of the payload
+//	term     uint64  payload: the term of the entry,
+//	kind     byte    its kind
+//	data     bytes   and the data till the end of the payload
+const (
+	recordHeaderSize  = 8
+	payloadHeaderSize = 9
+)
+
+var errCorruptedRecord = errors.New("corrupted raft log record")
+
+// hardState is the term and the vote persisted before answering any
+// request of the term.
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// snapshotMeta describes the entries replaced by the state of the state
+// machine: the index and the term of the last of them and the membership
+// they defined.
+type snapshotMeta struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []Member `json:"members"`
+}
+
+// storage keeps the hard state and the log of a node on the disk. Every
+// change is synced before the methods return.
+type storage struct {
+	dir string
+	log *os.File
+	// base is the index of the last entry replaced by a snapshot. offsets
+	// holds the file offset of every entry after it, offsets[i] is the
+	// offset of the entry with index base+i+1, and size the end of the last
+	// one.
+	base    uint64
+	offsets []int64
+	size    int64
+}
+
+// openStorage reads the persistent state in dir, creating the directory if
+// needed. A record cut off at the end of the log by a crash is discarded.
+// The entries follow the snapshot, which is zero for a log never compacted.
+func openStorage(dir string) (*storage, hardState, snapshotMeta, []Entry, error) {
+	var state hardState
+	var snapshot snapshotMeta
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, state, snapshot, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, state, snapshot, nil, fmt.Errorf("reading the raft state: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, state, snapshot, nil, err
+	}
+	s := &storage{dir: dir, log: file}
+	snapshot, entries, err := s.load()
+	if err != nil {
+		file.Close()
+		return nil, state, snapshot, nil, err
+	}
+	return s, state, snapshot, entries, nil
+}
+
+func (s *storage) load() (snapshotMeta, []Entry, error) {
+	var snapshot snapshotMeta
+	info, err := s.log.Stat()
+	if err != nil {
+		return snapshot, nil, err
+	}
+	in := bufio.NewReader(io.NewSectionReader(s.log, 0, info.Size()))
+	var entries []Entry
+	for {
+		e, size, err := readRecord(in)
+		if err == io.EOF {
+			break
+		} else if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorruptedRecord) {
+			log.Printf("Discarding %d bytes of the raft log after offset %d: %s", info.Size()-s.size, s.size, err)
+			if err := s.log.Truncate(s.size); err != nil {
+				return snapshot, nil, err
+			}
+			break
+		} else if err != nil {
+			return snapshot, nil, err
+		}
+		if e.Kind == snapshotRecord {
+			// A compacted log is replaced atomically, so the snapshot is
+			// always its first record.
+			if s.size != 0 {
+				return snapshot, nil, fmt.Errorf("%w: snapshot at offset %d", errCorruptedRecord, s.size)
+			}
+			if err := json.Unmarshal(e.Data, &snapshot); err != nil {
+				return snapshot, nil, fmt.Errorf("reading the raft snapshot: %w", err)
+			}
+			s.base = snapshot.Index
+			s.size += size
+			continue
+		}
+		s.offsets = append(s.offsets, s.size)
+		s.size += size
+		entries = append(entries, e)
+	}
+	if _, err := s.log.Seek(s.size, io.SeekStart); err != nil {
+		return snapshot, nil, err
+	}
+	return snapshot, entries, nil
+}
+
+// saveState replaces the hard state atomically.
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, stateFileName+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, stateFileName))
+}
+
+// append writes the entries after the last one.
+func (s *storage) append(entries []Entry) error {
+	var buf []byte
+	offsets := make([]int64, len(entries))
+	for i, e := range entries {
+		offsets[i] = s.size + int64(len(buf))
+		buf = appendRecord(buf, e)
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		// Cut off whatever part of the records got written.
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(buf))
+	return nil
+}
+
+// truncate removes the entries from the index, following the snapshot, on.
+func (s *storage) truncate(index uint64) error {
+	if index > s.base+uint64(len(s.offsets)) {
+		return nil
+	}
+	size := s.offsets[index-s.base-1]
+	if err := s.log.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.offsets, s.size = s.offsets[:index-s.base-1], size
+	return nil
+}
+
+// compact replaces the log with the snapshot followed by the entries. The
+// new log is written next to the old one and renamed over it, so a crash
+// leaves one of them in place.
+func (s *storage) compact(snapshot snapshotMeta, entries []Entry) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	buf := appendRecord(nil, Entry{Term: snapshot.Term, Kind: snapshotRecord, Data: data})
+	offsets := make([]int64, len(entries))
+	for i, e := range entries {
+		offsets[i] = int64(len(buf))
+		buf = appendRecord(buf, e)
+	}
+
+	path := filepath.Join(s.dir, logFileName)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.log.Close()
+	s.log, s.base, s.offsets, s.size = file, snapshot.Index, offsets, int64(len(buf))
+	return nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+func appendRecord(buf []byte, e Entry) []byte {
+	payloadSize := payloadHeaderSize + len(e.Data)
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize+payloadHeaderSize)...)
+	buf = append(buf, e.Data...)
+	record := buf[start:]
+	binary.LittleEndian.PutUint32(record, uint32(payloadSize))
+	binary.LittleEndian.PutUint64(record[recordHeaderSize:], e.Term)
+	record[recordHeaderSize+8] = byte(e.Kind)
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[recordHeaderSize:]))
+	return buf
+}
+
+// readRecord reads the next log record and returns its entry and its size.
+func readRecord(in *bufio.Reader) (Entry, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return Entry{}, 0, err
+	}
+	payloadSize := binary.LittleEndian.Uint32(header[:])
+	if payloadSize < payloadHeaderSize {
+		return Entry{}, 0, errCorruptedRecord
+	}
+	payload := make([]byte, payloadSize)
+	if _, err := io.ReadFull(in, payload); err == io.EOF {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return Entry{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return Entry{}, 0, errCorruptedRecord
+	}
+	e := Entry{
+		Term: binary.LittleEndian.Uint64(payload),
+		Kind: EntryKind(payload[8]),
+		Data: payload[payloadHeaderSize:],
+	}
+	return e, int64(recordHeaderSize + payloadSize), nil
+}
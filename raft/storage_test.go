@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, state, _, entries, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Term != 0 || len(entries) != 0 {
+		t.Fatalf("Expected an empty state, got %+v %v", state, entries)
+	}
+	if err := s.saveState(hardState{Term: 3, VotedFor: "n2"}); err != nil {
+		t.Fatal(err)
+	}
+	written := []Entry{
+		{Term: 1, Kind: EntryNoop},
+		{Term: 1, Kind: EntryCommand, Data: []byte("a")},
+		{Term: 2, Kind: EntryCommand, Data: []byte("b")},
+	}
+	if err := s.append(written); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]Entry{{Term: 3, Kind: EntryMembers, Data: []byte("[]")}}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// A record cut off by a crash is dropped.
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(appendRecord(nil, Entry{Term: 3, Data: []byte("torn")})[:12])
+	file.Close()
+
+	s, state, _, entries, err = openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if state.Term != 3 || state.VotedFor != "n2" {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if len(entries) != 3 || entries[1].Term != 1 || string(entries[1].Data) != "a" || entries[2].Kind != EntryMembers || entries[2].Term != 3 {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+	if err := s.append([]Entry{{Term: 3, Data: []byte("c")}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.offsets) != 4 {
+		t.Errorf("Expected 4 entries, got %d", len(s.offsets))
+	}
+}
+
+func TestStorage_Compact(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, Entry{Term: 1, Data: []byte{byte('a' + i)}})
+	}
+	if err := s.append(entries); err != nil {
+		t.Fatal(err)
+	}
+	members := []Member{{ID: "n1", Addr: "n1"}}
+	if err := s.compact(snapshotMeta{Index: 3, Term: 1, Members: members}, entries[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]Entry{{Term: 2, Data: []byte("f")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.truncate(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]Entry{{Term: 3, Data: []byte("g")}}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	s, _, snapshot, entries, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if snapshot.Index != 3 || snapshot.Term != 1 || len(snapshot.Members) != 1 || snapshot.Members[0] != members[0] {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+	if len(entries) != 3 || string(entries[0].Data) != "d" || string(entries[2].Data) != "g" || entries[2].Term != 3 {
+		t.Errorf("Unexpected entries after the snapshot %+v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(dir, logFileName+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary log left, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Transport delivers the RPCs of a node to the other members.
+type Transport interface {
+	RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error)
+	// InstallSnapshot sends the snapshot read from data along with req.
+	InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest, data io.Reader) (SnapshotResponse, error)
+}
+
+// snapshotHeader carries the JSON of the SnapshotRequest, the body of the
+// request is the snapshot.
+const snapshotHeader = "X-Raft-Snapshot"
+
+// HTTPTransport sends the RPCs as JSON POST requests to the Handler of the
+// member, the member address being the base URL of its HTTP server. Token is
+// sent as the bearer token of the requests when it is set, for the members
+// serving the Handler behind an authentication.
+type HTTPTransport struct {
+	Client *http.Client
+	Token  string
+}
+
+func (t HTTPTransport) RequestVote(ctx context.Context, to Member, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.call(ctx, to.Addr+"/raft/vote", req, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) AppendEntries(ctx context.Context, to Member, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.call(ctx, to.Addr+"/raft/append", req, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) InstallSnapshot(ctx context.Context, to Member, req SnapshotRequest, data io.Reader) (SnapshotResponse, error) {
+	var resp SnapshotResponse
+	header, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", to.Addr+"/raft/snapshot", data)
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	httpReq.Header.Set(snapshotHeader, string(header))
+	err = t.do(httpReq, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) call(ctx context.Context, url string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return t.do(httpReq, resp)
+}
+
+func (t HTTPTransport) do(httpReq *http.Request, resp any) error {
+	url := httpReq.URL.String()
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if t.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("POST %s: %s: %s", url, httpResp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// NewHandler serves the RPCs of HTTPTransport for the node on
+// POST /raft/vote, POST /raft/append and POST /raft/snapshot, the node status on
+// GET /raft/status and the membership on /raft/members: GET lists the
+// members, POST with a Member adds one and DELETE /raft/members/<id>
+// removes one. The membership changes on the other nodes than the leader
+// get 421 Misdirected Request.
+func NewHandler(n *Node) http.Handler {
+	h := http.NewServeMux()
+	h.HandleFunc("/raft/vote", rpcHandler(n.RequestVote))
+	h.HandleFunc("/raft/append", rpcHandler(n.AppendEntries))
+	h.HandleFunc("/raft/snapshot", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var rpc SnapshotRequest
+		if err := json.Unmarshal([]byte(req.Header.Get(snapshotHeader)), &rpc); err != nil {
+			http.Error(res, "Invalid "+snapshotHeader+" header", http.StatusBadRequest)
+			return
+		}
+		resp, err := n.InstallSnapshot(rpc, req.Body)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(res, http.StatusOK, resp)
+	})
+	h.HandleFunc("/raft/status", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(res, http.StatusOK, n.Status())
+	})
+	h.HandleFunc("/raft/members", membersHandler(n))
+	h.HandleFunc("/raft/members/", membersHandler(n))
+	return h
+}
+
+func rpcHandler[Req, Resp any](handle func(Req) (Resp, error)) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var rpc Req
+		if err := json.NewDecoder(req.Body).Decode(&rpc); err != nil {
+			http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		resp, err := handle(rpc)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(res, http.StatusOK, resp)
+	}
+}
+
+func membersHandler(n *Node) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/raft/members"), "/")
+		var err error
+		switch {
+		case req.Method == "GET" && id == "":
+			writeJSON(res, http.StatusOK, n.Status().Members)
+			return
+		case req.Method == "POST" && id == "":
+			var m Member
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+				return
+			}
+			err = n.AddMember(req.Context(), m)
+		case req.Method == "DELETE" && id != "":
+			err = n.RemoveMember(req.Context(), id)
+		default:
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case err == nil:
+			writeJSON(res, http.StatusOK, n.Status().Members)
+		case errors.Is(err, ErrNotLeader):
+			if leader, ok := n.Leader(); ok {
+				res.Header().Set("Location", leader.Addr+req.URL.Path)
+			}
+			http.Error(res, err.Error(), http.StatusMisdirectedRequest)
+		case errors.Is(err, ErrMembershipChange):
+			http.Error(res, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrStopped), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			http.Error(res, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, value any) {
+	response, _ := json.Marshal(value)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(response)
+}
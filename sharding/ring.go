@@ -0,0 +1,121 @@
+// Package sharding assigns the keys to the db nodes by consistent hashing.
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points every node takes on the ring.
+const DefaultVirtualNodes = 64
+
+// Node is a db service owning a part of the keys, URL is the base URL of
+// its HTTP API.
+type Node struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Ring maps the keys to the nodes. Every node takes a number of virtual
+// points on a ring of hashes, a key belongs to the node of the first point
+// following the hash of the key. Adding a node moves only the keys taken
+// over by the new node. A Ring is immutable.
+type Ring struct {
+	vnodes int
+	nodes  []Node
+	points []point
+}
+
+type point struct {
+	hash uint64
+	node int
+}
+
+// NewRing builds a ring of the nodes with vnodes points each.
+func NewRing(vnodes int, nodes ...Node) (*Ring, error) {
+	if vnodes <= 0 {
+		return nil, fmt.Errorf("invalid number of virtual nodes %d", vnodes)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("ring needs at least one node")
+	}
+	r := &Ring{vnodes: vnodes, nodes: slices.Clone(nodes)}
+	for i, n := range r.nodes {
+		if n.Name == "" || n.URL == "" {
+			return nil, fmt.Errorf("node needs a name and a URL: %+v", n)
+		}
+		if slices.ContainsFunc(r.nodes[:i], func(other Node) bool { return other.Name == n.Name }) {
+			return nil, fmt.Errorf("duplicate node %s", n.Name)
+		}
+		for v := 0; v < vnodes; v++ {
+			r.points = append(r.points, point{hash(n.Name + "#" + strconv.Itoa(v)), i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.nodes[r.points[i].node].Name < r.nodes[r.points[j].node].Name
+	})
+	return r, nil
+}
+
+// Owner returns the node the key belongs to.
+func (r *Ring) Owner(key string) Node {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i].node]
+}
+
+// Nodes returns the nodes of the ring.
+func (r *Ring) Nodes() []Node {
+	return slices.Clone(r.nodes)
+}
+
+// Add returns the ring with the node added.
+func (r *Ring) Add(n Node) (*Ring, error) {
+	return NewRing(r.vnodes, append(r.Nodes(), n)...)
+}
+
+// Remove returns the ring without the node.
+func (r *Ring) Remove(name string) (*Ring, error) {
+	nodes := slices.DeleteFunc(r.Nodes(), func(n Node) bool {
+		return n.Name == name
+	})
+	if len(nodes) == len(r.nodes) {
+		return nil, fmt.Errorf("unknown node %s", name)
+	}
+	return NewRing(r.vnodes, nodes...)
+}
+
+// Key is the key the ring places a key of the bucket by, the default
+// bucket has the empty name.
+func Key(bucket, key string) string {
+	if bucket == "" {
+		return key
+	}
+	return bucket + "/" + key
+}
+
+// hash is the 64-bit FNV-1a hash with the bits mixed by the splitmix64
+// finalizer, so that similar strings spread over the ring.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,75 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testNodes(names ...string) []Node {
+	nodes := make([]Node, len(names))
+	for i, name := range names {
+		nodes[i] = Node{Name: name, URL: "http://" + name}
+	}
+	return nodes
+}
+
+func TestRing(t *testing.T) {
+	ring, err := NewRing(DefaultVirtualNodes, testNodes("db1", "db2", "db3", "db4")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 10000
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := ring.Owner(key)
+		owners[key] = owner.Name
+		counts[owner.Name]++
+	}
+	for name, count := range counts {
+		if count < keys/4*6/10 || count > keys/4*14/10 {
+			t.Errorf("Node %s owns %d of %d keys", name, count, keys)
+		}
+	}
+
+	grown, err := ring.Add(Node{Name: "db5", URL: "http://db5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := grown.Owner(key).Name; newOwner != owner {
+			moved++
+			if newOwner != "db5" {
+				t.Fatalf("Key %s moved from %s to %s instead of the new node", key, owner, newOwner)
+			}
+		}
+	}
+	if moved < keys/5/2 || moved > keys/5*2 {
+		t.Errorf("Expected about a fifth of the keys to move, %d of %d moved", moved, keys)
+	}
+
+	shrunk, err := grown.Remove("db5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range owners {
+		if shrunk.Owner(key).Name != owner {
+			t.Fatalf("Key %s is not back at %s", key, owner)
+		}
+	}
+
+	if _, err := ring.Add(Node{Name: "db1", URL: "http://other"}); err == nil {
+		t.Error("Expected an error for a duplicate node")
+	}
+	if _, err := ring.Remove("missing"); err == nil {
+		t.Error("Expected an error for an unknown node")
+	}
+	if _, err := NewRing(DefaultVirtualNodes); err == nil {
+		t.Error("Expected an error for an empty ring")
+	}
+	if Key("", "k") != "k" || Key("b", "k") != "b/k" {
+		t.Error("Unexpected ring keys")
+	}
+}